@@ -0,0 +1,19 @@
+// Package clock abstracts time, so time-dependent code can be driven by a fake clock in tests
+package clock
+
+import "time"
+
+// Clock provides current time and timers
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is a Clock backed by the time package
+type Real struct{}
+
+// Now returns current local time
+func (Real) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time on the returned channel
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
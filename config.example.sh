@@ -1,18 +0,0 @@
-#!/bin/bash
-
-servers=(
-  "root@1.1.1.1"
-  "root@2.2.2.2"
-)
-ports=(
-  "22"
-  "22"
-)
-paths=(
-  "/root"
-  "/opt/elixir"
-)
-tags=(
-  "latest"
-  "testnet"
-)
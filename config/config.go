@@ -1,6 +1,11 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"strings"
 
@@ -11,15 +16,58 @@ const configFile = "config.yml"
 
 // default values
 const (
-	defaultUser             = "root"
-	defaultContainerName    = "elixir"         // Replace with your container name
-	defaultRestartPolicy    = "unless-stopped" // Set to "always", "unless-stopped", or "no"
-	defaultEnvFilePath      = "/opt/elixir/validator.env"
-	defaultServiceName      = "elixir-updater"
-	defaultHost             = "http://localhost"
-	defaultPort             = "17690"
-	defaultDockerAPIVersion = "1.42"
-	defaultImageName        = "elixirprotocol/validator:latest"
+	defaultUser            = "root"
+	defaultContainerName   = "elixir"         // Replace with your container name
+	defaultRestartPolicy   = "unless-stopped" // Set to "always", "unless-stopped", "on-failure" or "no"
+	defaultEnvFilePath     = "/opt/elixir/validator.env"
+	defaultServiceName     = "elixir-updater"
+	defaultHost            = "http://localhost"
+	defaultPort            = "17690"
+	defaultHostIP          = "0.0.0.0"
+	defaultDockerWait      = "5m"
+	defaultImageName       = "elixirprotocol/validator:latest"
+	defaultUpdateSchedule  = "0 * * * *"   // every hour at minute 0
+	defaultMetricsSchedule = "*/5 * * * *" // every 5 minutes
+	defaultKeepPrevImages  = 1
+	defaultShutdownTimeout = "60s"
+	defaultUpdateGrace     = "2m"
+	defaultAlertsMode      = AlertsSuppress
+	defaultCrashPolicy     = CrashNotify
+	defaultLogLines        = 100
+	defaultLogExcerptLines = 10
+	defaultHealthInterval  = "30s"
+	defaultHealthTimeout   = "10s"
+	defaultHealthStart     = "1m"
+	defaultHealthRetries   = 3
+	defaultHealthWait      = "5m"
+	defaultCrashLoopLimit  = 3
+	defaultCrashLoopWindow = "10m"
+	defaultSelfUpdateSched = "30 4 * * *" // every day at 04:30
+	defaultSelfUpdateTries = 3
+	defaultHeartbeatSched  = "* * * * *"
+	defaultHubStaleAfter   = "5m"
+	defaultHubSkewAfter    = "2h"
+	defaultHubSoak         = "30m"
+	defaultHookTimeout     = "1m"
+	defaultRuntime         = "auto"
+)
+
+// alerts_during_update values
+const (
+	AlertsSuppress = "suppress"
+	AlertsLabel    = "label"
+)
+
+// runtimes are runtime values, see delixir.Runtimes
+var runtimes = []string{"auto", "docker", "podman"}
+
+// hookPoints are hooks[].point values, see delixir.HookPoints
+var hookPoints = []string{"before-pull", "before-stop", "after-start", "after-healthy", "rollback"}
+
+// crash.policy values
+const (
+	CrashNotify  = "notify"
+	CrashRestart = "restart"
 )
 
 // Config represents app configuration
@@ -27,15 +75,142 @@ type Config struct {
 	TGBotToken    string `yaml:"tg_bot_token"`
 	TGForceChatID int64  `yaml:"tg_force_chat_id"`
 
-	User             string `yaml:"user"`
-	ContainerName    string `yaml:"container_name"`
-	RestartPolicy    string `yaml:"restart_policy"`
-	EnvFilePath      string `yaml:"env_file_path"`
-	ServiceName      string `yaml:"service_name"`
-	Host             string `yaml:"host"`
-	Port             string `yaml:"port"`
+	User          string `yaml:"user"`
+	ContainerName string `yaml:"container_name"`
+	RestartPolicy string `yaml:"restart_policy"`
+	EnvFilePath   string `yaml:"env_file_path"`
+	ServiceName   string `yaml:"service_name"`
+	// Host is the URL of the health endpoint without the port, derived from HostIP if empty
+	Host string `yaml:"host"`
+	// Port is the container port, it's published on HostIP:HostPort and serves the health endpoint
+	Port     string `yaml:"port"`
+	HostPort string `yaml:"host_port"`
+	HostIP   string `yaml:"host_ip"`
+	// Ports are additional port mappings in "docker run -p" format: [IP:][HOST_PORT:]CONTAINER_PORT[/PROTOCOL]
+	Ports []string `yaml:"ports"`
+	// Runtime is "auto", "docker" or "podman", the API socket of the runtime is detected unless RuntimeHost is set
+	Runtime     string `yaml:"runtime"`
+	RuntimeHost string `yaml:"runtime_host"`
+	// Rootless installs the service as a systemd user unit of the current user, User is ignored
+	Rootless bool `yaml:"rootless"`
+	// DockerAPIVersion is negotiated with the Docker daemon if empty
 	DockerAPIVersion string `yaml:"docker_api_version"`
-	ImageName        string `yaml:"image_name"`
+	// DockerWaitTimeout is the time to wait for the Docker daemon on startup
+	DockerWaitTimeout string `yaml:"docker_wait_timeout"`
+	ImageName         string `yaml:"image_name"`
+	UpdateSchedule    string `yaml:"update_schedule"`
+	MetricsSchedule   string `yaml:"metrics_schedule"`
+	Platform          string `yaml:"platform"`
+	ShutdownTimeout   string `yaml:"shutdown_timeout"`
+	// UpdateGracePeriod is the time after the container swap during which health check failures
+	// are treated as caused by the update
+	UpdateGracePeriod string `yaml:"update_grace_period"`
+	// AlertsDuringUpdate is "suppress" or "label", defines what to do with health alerts during update
+	AlertsDuringUpdate string `yaml:"alerts_during_update"`
+	// KeepPreviousImages is a number of superseded images to keep for rollback, -1 disables the cleanup
+	KeepPreviousImages *int `yaml:"keep_previous_images"`
+	// AdoptContainers makes the validator container started by hand under another name managed
+	AdoptContainers *bool `yaml:"adopt_containers"`
+
+	Registry RegistryConfig `yaml:"registry"`
+	Crash    CrashConfig    `yaml:"crash"`
+	Logs     LogsConfig     `yaml:"logs"`
+	// Healthcheck is Docker health check of the validator container
+	Healthcheck HealthcheckConfig `yaml:"healthcheck"`
+	SelfUpdate  SelfUpdateConfig  `yaml:"self_update"`
+	Hub         HubConfig         `yaml:"hub"`
+	// Hooks are run at points of the container update in the order of definition
+	Hooks []HookConfig `yaml:"hooks"`
+
+	// lines maps dotted option paths to the YAML lines they were defined at
+	lines map[string]int
+}
+
+// RegistryConfig represents container registry configuration
+type RegistryConfig struct {
+	Mirror           string `yaml:"mirror"`
+	DisableFallback  bool   `yaml:"disable_fallback"`
+	Username         string `yaml:"username"`
+	Password         string `yaml:"password"`
+	DockerConfigPath string `yaml:"docker_config_path"`
+}
+
+// CrashConfig represents reaction to validator container crashes
+type CrashConfig struct {
+	// Policy is "notify" or "restart", the latter also starts the exited container
+	Policy string `yaml:"policy"`
+	// LoopLimit crashes within LoopWindow are treated as a crash loop, which stops restarts
+	LoopLimit  int    `yaml:"loop_limit"`
+	LoopWindow string `yaml:"loop_window"`
+}
+
+// LogsConfig represents validator container logs capture for alerts
+type LogsConfig struct {
+	// Lines is a number of last log lines captured on alerts, 0 disables the capture
+	Lines        *int `yaml:"lines"`
+	ExcerptLines int  `yaml:"excerpt_lines"`
+	// Attach makes captured lines sent as a file in addition to the excerpt
+	Attach *bool `yaml:"attach"`
+	// Patterns are regular expressions of known errors, in addition to built-in ones
+	Patterns []string `yaml:"patterns"`
+}
+
+// HealthcheckConfig represents Docker health check of the validator container
+type HealthcheckConfig struct {
+	Disable bool `yaml:"disable"`
+	// Test is a shell command, by default the health endpoint is requested with curl or wget
+	Test        string `yaml:"test"`
+	Interval    string `yaml:"interval"`
+	Timeout     string `yaml:"timeout"`
+	StartPeriod string `yaml:"start_period"`
+	Retries     int    `yaml:"retries"`
+	// Wait is the time to wait for the container to become healthy after update before rollback, "0s" disables
+	Wait string `yaml:"wait"`
+}
+
+// SelfUpdateConfig represents updates of the updater binary itself
+type SelfUpdateConfig struct {
+	// URL of the latest release in GitHub releases API format, empty disables self-update
+	URL      string `yaml:"url"`
+	Schedule string `yaml:"schedule"`
+	// Asset is the binary asset name, Checksums is the asset name of SHA-256 sums
+	Asset     string `yaml:"asset"`
+	Checksums string `yaml:"checksums"`
+	// PublicKey is a base64 ed25519 key, the signature of checksums is required if set
+	PublicKey string `yaml:"public_key"`
+	// MaxStartAttempts of the new binary before rollback to the previous one
+	MaxStartAttempts int `yaml:"max_start_attempts"`
+}
+
+// HubConfig represents fleet status aggregation: heartbeats to the hub and the hub mode
+type HubConfig struct {
+	// Listen is the address to serve the hub API on, empty disables the hub mode
+	Listen string `yaml:"listen"`
+	// URL of the hub to send heartbeats to, empty disables heartbeats
+	URL string `yaml:"url"`
+	// Token is the shared bearer token of the hub API
+	Token             string `yaml:"token"`
+	HeartbeatSchedule string `yaml:"heartbeat_schedule"`
+	// StaleAfter is the time without heartbeats after which an instance is stale
+	StaleAfter string `yaml:"stale_after"`
+	// SkewAfter is the time instances may run different images or updater versions before alerting
+	SkewAfter string `yaml:"skew_after"`
+	// CoordinateRollouts makes container updates wait for the hub permission,
+	// Canary instances update first and other ones wait for them to stay healthy for Soak
+	CoordinateRollouts bool   `yaml:"coordinate_rollouts"`
+	Canary             bool   `yaml:"canary"`
+	Soak               string `yaml:"soak"`
+}
+
+// HookConfig represents a command or a webhook run at the update point
+type HookConfig struct {
+	// Point is one of "before-pull", "before-stop", "after-start", "after-healthy", "rollback".
+	// Failed before-pull and before-stop hooks veto the update
+	Point string `yaml:"point"`
+	// Command is run with "sh -c", URL receives the event as JSON in a POST request. Exactly one is required
+	Command string `yaml:"command"`
+	URL     string `yaml:"url"`
+	Timeout string `yaml:"timeout"`
 }
 
 // SetDefaults to the config
@@ -48,7 +223,50 @@ func (c *Config) SetDefaults() {
 	c.ServiceName = strings.TrimSpace(c.ServiceName)
 	c.Host = strings.TrimSpace(c.Host)
 	c.Port = strings.TrimSpace(c.Port)
+	c.HostPort = strings.TrimSpace(c.HostPort)
+	c.HostIP = strings.TrimSpace(c.HostIP)
+	for i := range c.Ports {
+		c.Ports[i] = strings.TrimSpace(c.Ports[i])
+	}
+	c.Runtime = strings.ToLower(strings.TrimSpace(c.Runtime))
+	c.RuntimeHost = strings.TrimSpace(c.RuntimeHost)
 	c.DockerAPIVersion = strings.TrimSpace(c.DockerAPIVersion)
+	c.DockerWaitTimeout = strings.TrimSpace(c.DockerWaitTimeout)
+	c.ImageName = strings.TrimSpace(c.ImageName)
+	c.UpdateSchedule = strings.TrimSpace(c.UpdateSchedule)
+	c.MetricsSchedule = strings.TrimSpace(c.MetricsSchedule)
+	c.Platform = strings.TrimSpace(c.Platform)
+	c.ShutdownTimeout = strings.TrimSpace(c.ShutdownTimeout)
+	c.UpdateGracePeriod = strings.TrimSpace(c.UpdateGracePeriod)
+	c.AlertsDuringUpdate = strings.TrimSpace(c.AlertsDuringUpdate)
+	c.Registry.Mirror = strings.TrimSuffix(strings.TrimSpace(c.Registry.Mirror), "/")
+	c.Registry.Username = strings.TrimSpace(c.Registry.Username)
+	c.Registry.DockerConfigPath = strings.TrimSpace(c.Registry.DockerConfigPath)
+	c.Crash.Policy = strings.TrimSpace(c.Crash.Policy)
+	c.Crash.LoopWindow = strings.TrimSpace(c.Crash.LoopWindow)
+	c.Healthcheck.Test = strings.TrimSpace(c.Healthcheck.Test)
+	c.Healthcheck.Interval = strings.TrimSpace(c.Healthcheck.Interval)
+	c.Healthcheck.Timeout = strings.TrimSpace(c.Healthcheck.Timeout)
+	c.Healthcheck.StartPeriod = strings.TrimSpace(c.Healthcheck.StartPeriod)
+	c.Healthcheck.Wait = strings.TrimSpace(c.Healthcheck.Wait)
+	c.SelfUpdate.URL = strings.TrimSpace(c.SelfUpdate.URL)
+	c.SelfUpdate.Schedule = strings.TrimSpace(c.SelfUpdate.Schedule)
+	c.SelfUpdate.Asset = strings.TrimSpace(c.SelfUpdate.Asset)
+	c.SelfUpdate.Checksums = strings.TrimSpace(c.SelfUpdate.Checksums)
+	c.SelfUpdate.PublicKey = strings.TrimSpace(c.SelfUpdate.PublicKey)
+	c.Hub.Listen = strings.TrimSpace(c.Hub.Listen)
+	c.Hub.URL = strings.TrimSuffix(strings.TrimSpace(c.Hub.URL), "/")
+	c.Hub.Token = strings.TrimSpace(c.Hub.Token)
+	c.Hub.HeartbeatSchedule = strings.TrimSpace(c.Hub.HeartbeatSchedule)
+	c.Hub.StaleAfter = strings.TrimSpace(c.Hub.StaleAfter)
+	c.Hub.SkewAfter = strings.TrimSpace(c.Hub.SkewAfter)
+	c.Hub.Soak = strings.TrimSpace(c.Hub.Soak)
+	for i := range c.Hooks {
+		c.Hooks[i].Point = strings.TrimSpace(c.Hooks[i].Point)
+		c.Hooks[i].Command = strings.TrimSpace(c.Hooks[i].Command)
+		c.Hooks[i].URL = strings.TrimSpace(c.Hooks[i].URL)
+		c.Hooks[i].Timeout = strings.TrimSpace(c.Hooks[i].Timeout)
+	}
 
 	if c.User == "" {
 		c.User = defaultUser
@@ -65,31 +283,191 @@ func (c *Config) SetDefaults() {
 	if c.ServiceName == "" {
 		c.ServiceName = defaultServiceName
 	}
-	if c.Host == "" {
-		c.Host = defaultHost
-	}
 	if c.Port == "" {
 		c.Port = defaultPort
 	}
-	if c.DockerAPIVersion == "" {
-		c.DockerAPIVersion = defaultDockerAPIVersion
+	if c.HostPort == "" {
+		c.HostPort = c.Port
+	}
+	if c.HostIP == "" {
+		c.HostIP = defaultHostIP
+	}
+	if c.Host == "" {
+		c.Host = hostURL(c.HostIP)
+	}
+	if c.Runtime == "" {
+		c.Runtime = defaultRuntime
+	}
+	if c.DockerWaitTimeout == "" {
+		c.DockerWaitTimeout = defaultDockerWait
 	}
 	if c.ImageName == "" {
 		c.ImageName = defaultImageName
 	}
+	if c.UpdateSchedule == "" {
+		c.UpdateSchedule = defaultUpdateSchedule
+	}
+	if c.MetricsSchedule == "" {
+		c.MetricsSchedule = defaultMetricsSchedule
+	}
+	if c.ShutdownTimeout == "" {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.UpdateGracePeriod == "" {
+		c.UpdateGracePeriod = defaultUpdateGrace
+	}
+	if c.AlertsDuringUpdate == "" {
+		c.AlertsDuringUpdate = defaultAlertsMode
+	}
+	if c.KeepPreviousImages == nil {
+		keep := defaultKeepPrevImages
+		c.KeepPreviousImages = &keep
+	}
+	if c.AdoptContainers == nil {
+		adopt := true
+		c.AdoptContainers = &adopt
+	}
+	if c.Crash.Policy == "" {
+		c.Crash.Policy = defaultCrashPolicy
+	}
+	if c.Crash.LoopLimit == 0 {
+		c.Crash.LoopLimit = defaultCrashLoopLimit
+	}
+	if c.Crash.LoopWindow == "" {
+		c.Crash.LoopWindow = defaultCrashLoopWindow
+	}
+	if c.Logs.Lines == nil {
+		lines := defaultLogLines
+		c.Logs.Lines = &lines
+	}
+	if c.Logs.ExcerptLines == 0 {
+		c.Logs.ExcerptLines = defaultLogExcerptLines
+	}
+	if c.Logs.Attach == nil {
+		attach := true
+		c.Logs.Attach = &attach
+	}
+	if c.Healthcheck.Interval == "" {
+		c.Healthcheck.Interval = defaultHealthInterval
+	}
+	if c.Healthcheck.Timeout == "" {
+		c.Healthcheck.Timeout = defaultHealthTimeout
+	}
+	if c.Healthcheck.StartPeriod == "" {
+		c.Healthcheck.StartPeriod = defaultHealthStart
+	}
+	if c.Healthcheck.Retries == 0 {
+		c.Healthcheck.Retries = defaultHealthRetries
+	}
+	if c.Healthcheck.Wait == "" {
+		c.Healthcheck.Wait = defaultHealthWait
+	}
+	if c.SelfUpdate.Schedule == "" {
+		c.SelfUpdate.Schedule = defaultSelfUpdateSched
+	}
+	if c.SelfUpdate.MaxStartAttempts == 0 {
+		c.SelfUpdate.MaxStartAttempts = defaultSelfUpdateTries
+	}
+	if c.Hub.HeartbeatSchedule == "" {
+		c.Hub.HeartbeatSchedule = defaultHeartbeatSched
+	}
+	if c.Hub.StaleAfter == "" {
+		c.Hub.StaleAfter = defaultHubStaleAfter
+	}
+	if c.Hub.SkewAfter == "" {
+		c.Hub.SkewAfter = defaultHubSkewAfter
+	}
+	if c.Hub.Soak == "" {
+		c.Hub.Soak = defaultHubSoak
+	}
+	for i := range c.Hooks {
+		if c.Hooks[i].Timeout == "" {
+			c.Hooks[i].Timeout = defaultHookTimeout
+		}
+	}
 }
 
 // New initializes new app configuration
 func New() (Config, error) {
-	var cfg Config
 	b, err := os.ReadFile(configFile)
 	if err != nil {
-		return cfg, err
+		return Config{}, err
 	}
+	return Parse(b)
+}
+
+// Parse decodes YAML configuration strictly, sets defaults and validates the result.
+// All found problems are reported at once as *ValidationError
+func Parse(b []byte) (Config, error) {
+	var cfg Config
 
-	if err = yaml.Unmarshal(b, &cfg); err != nil {
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
 		return cfg, err
 	}
+	cfg.lines = make(map[string]int)
+	if len(root.Content) > 0 {
+		collectLines(root.Content[0], "", cfg.lines)
+	}
+
+	verr := &ValidationError{File: configFile}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return cfg, err
+		}
+		fields := make(map[int]string, len(cfg.lines))
+		for field, line := range cfg.lines {
+			fields[line] = field
+		}
+		for _, e := range typeErr.Errors {
+			verr.addDecodeError(e, fields)
+		}
+	}
+
 	cfg.SetDefaults()
+	cfg.validate(verr)
+	if len(verr.Problems) > 0 {
+		return cfg, verr
+	}
 	return cfg, nil
 }
+
+// collectLines walks YAML mapping and sequence nodes and stores line numbers of keys by their dotted paths,
+// sequence items are indexed like "hooks[0].point"
+func collectLines(node *yaml.Node, prefix string, lines map[string]int) {
+	if node.Kind == yaml.SequenceNode {
+		for i, item := range node.Content {
+			collectLines(item, fmt.Sprintf("%s[%d]", prefix, i), lines)
+		}
+		return
+	}
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		path := key.Value
+		if prefix != "" {
+			path = prefix + "." + key.Value
+		}
+		if _, exists := lines[path]; !exists {
+			lines[path] = key.Line
+		}
+		collectLines(value, path, lines)
+	}
+}
+
+// hostURL returns the URL of the host the port is published on: localhost if it's published on all interfaces
+func hostURL(hostIP string) string {
+	ip := net.ParseIP(hostIP)
+	if ip == nil || ip.IsUnspecified() {
+		return defaultHost
+	}
+	if ip.To4() == nil {
+		return "http://[" + hostIP + "]"
+	}
+	return "http://" + hostIP
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/go-connections/nat"
+	"github.com/robfig/cron/v3"
+)
+
+// restartPolicies contains restart policy names accepted by Docker
+var restartPolicies = []string{"no", "always", "unless-stopped", "on-failure"}
+
+var platformRegexp = regexp.MustCompile(`^[a-z0-9_-]+/[a-z0-9_-]+(/[a-z0-9_-]+)?$`)
+
+var dockerAPIVersionRegexp = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// Problem represents a single configuration problem
+type Problem struct {
+	Line    int // zero if the option was not set in the file
+	Field   string
+	Message string
+}
+
+// String implements fmt.Stringer
+func (p Problem) String() string {
+	var s string
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: ", p.Line)
+	}
+	if p.Field != "" {
+		s += p.Field + ": "
+	}
+	return s + p.Message
+}
+
+// ValidationError contains all problems found in the configuration
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+// Error implements error
+func (e *ValidationError) Error() string {
+	problems := slices.Clone(e.Problems) // sorted by line without changing the error
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	lines := make([]string, 0, len(problems)+1)
+	lines = append(lines, fmt.Sprintf("invalid configuration %s (%d problems):", e.File, len(problems)))
+	for _, p := range problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ValidationError) add(line int, field, format string, args ...any) {
+	e.Problems = append(e.Problems, Problem{Line: line, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// addDecodeError adds the YAML decoder error message which is formatted like "line N: message".
+// fields maps line numbers to option names defined at them
+func (e *ValidationError) addDecodeError(s string, fields map[int]string) {
+	var line int
+	if _, err := fmt.Sscanf(s, "line %d:", &line); err == nil {
+		s = strings.TrimSpace(s[strings.Index(s, ":")+1:])
+	}
+
+	var unknown string
+	if _, err := fmt.Sscanf(s, "field %s not found in type", &unknown); err == nil {
+		// the decoder reports the bare key, the path of a nested one is known from its line
+		if field := fields[line]; strings.HasSuffix(field, "."+unknown) {
+			unknown = field
+		}
+		e.add(line, unknown, "unknown option")
+		return
+	}
+	e.add(line, fields[line], "%s", s)
+}
+
+// Validate the config values. Should be called after SetDefaults
+func (c *Config) Validate() error {
+	verr := &ValidationError{File: configFile}
+	c.validate(verr)
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validate adds found problems into verr
+func (c *Config) validate(verr *ValidationError) {
+	line := func(field string) int { return c.lines[field] }
+
+	if !slices.Contains(restartPolicies, c.RestartPolicy) {
+		verr.add(line("restart_policy"), "restart_policy", "invalid value %q, allowed values are: %s",
+			c.RestartPolicy, strings.Join(restartPolicies, ", "))
+	}
+
+	if err := validatePort(c.Port); err != nil {
+		verr.add(line("port"), "port", "%v", err)
+	}
+	if err := validatePort(c.HostPort); err != nil {
+		verr.add(line("host_port"), "host_port", "%v", err)
+	}
+	if net.ParseIP(c.HostIP) == nil {
+		verr.add(line("host_ip"), "host_ip", "invalid IP address %q", c.HostIP)
+	}
+	for i, spec := range c.Ports {
+		if _, err := nat.ParsePortSpec(spec); err != nil {
+			verr.add(line("ports"), fmt.Sprintf("ports[%d]", i), "invalid port mapping %q: %v", spec, err)
+		}
+	}
+
+	if u, err := url.Parse(c.Host); err != nil {
+		verr.add(line("host"), "host", "invalid URL %q: %v", c.Host, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		verr.add(line("host"), "host", "invalid URL %q: scheme must be http or https", c.Host)
+	}
+
+	if _, err := reference.ParseNormalizedNamed(c.ImageName); err != nil {
+		verr.add(line("image_name"), "image_name", "invalid image reference %q: %v", c.ImageName, err)
+	}
+
+	if !slices.Contains(runtimes, c.Runtime) {
+		verr.add(line("runtime"), "runtime", "invalid value %q, allowed values are: %s", c.Runtime, strings.Join(runtimes, ", "))
+	}
+	if c.RuntimeHost != "" {
+		if u, err := url.Parse(c.RuntimeHost); err != nil || (u.Scheme != "unix" && u.Scheme != "tcp") {
+			verr.add(line("runtime_host"), "runtime_host",
+				"invalid host %q, expected format is unix:///PATH or tcp://HOST:PORT", c.RuntimeHost)
+		}
+	}
+
+	if c.DockerAPIVersion != "" && !dockerAPIVersionRegexp.MatchString(c.DockerAPIVersion) {
+		verr.add(line("docker_api_version"), "docker_api_version",
+			"invalid version %q, expected format is MAJOR.MINOR, e.g. \"1.42\"", c.DockerAPIVersion)
+	}
+
+	if d, err := time.ParseDuration(c.DockerWaitTimeout); err != nil || d <= 0 {
+		verr.add(line("docker_wait_timeout"), "docker_wait_timeout",
+			"invalid duration %q, expected positive value like \"5m\"", c.DockerWaitTimeout)
+	}
+
+	if c.Platform != "" && !platformRegexp.MatchString(c.Platform) {
+		verr.add(line("platform"), "platform",
+			"invalid platform %q, expected format is OS/ARCH[/VARIANT], e.g. \"linux/arm64\"", c.Platform)
+	}
+
+	if d, err := time.ParseDuration(c.ShutdownTimeout); err != nil || d <= 0 {
+		verr.add(line("shutdown_timeout"), "shutdown_timeout",
+			"invalid duration %q, expected positive value like \"60s\" or \"2m\"", c.ShutdownTimeout)
+	}
+
+	if d, err := time.ParseDuration(c.UpdateGracePeriod); err != nil || d < 0 {
+		verr.add(line("update_grace_period"), "update_grace_period",
+			"invalid duration %q, expected value like \"2m\"", c.UpdateGracePeriod)
+	}
+	if c.AlertsDuringUpdate != AlertsSuppress && c.AlertsDuringUpdate != AlertsLabel {
+		verr.add(line("alerts_during_update"), "alerts_during_update",
+			"invalid value %q, allowed values are: %s, %s", c.AlertsDuringUpdate, AlertsSuppress, AlertsLabel)
+	}
+
+	if c.KeepPreviousImages != nil && *c.KeepPreviousImages < -1 {
+		verr.add(line("keep_previous_images"), "keep_previous_images",
+			"invalid value %d, must be -1 (cleanup disabled) or greater", *c.KeepPreviousImages)
+	}
+
+	if c.Registry.Mirror != "" {
+		if _, err := reference.ParseNormalizedNamed(c.Registry.Mirror + "/image"); err != nil ||
+			strings.Contains(c.Registry.Mirror, "://") {
+			verr.add(line("registry.mirror"), "registry.mirror",
+				"invalid registry host %q, expected format is HOST[:PORT]", c.Registry.Mirror)
+		}
+	}
+	if c.Registry.Password != "" && c.Registry.Username == "" {
+		verr.add(line("registry.password"), "registry.password", "set without registry.username")
+	}
+
+	if c.Crash.Policy != CrashNotify && c.Crash.Policy != CrashRestart {
+		verr.add(line("crash.policy"), "crash.policy",
+			"invalid value %q, allowed values are: %s, %s", c.Crash.Policy, CrashNotify, CrashRestart)
+	}
+	if c.Crash.LoopLimit < 1 {
+		verr.add(line("crash.loop_limit"), "crash.loop_limit", "invalid value %d, must be 1 or greater", c.Crash.LoopLimit)
+	}
+	if d, err := time.ParseDuration(c.Crash.LoopWindow); err != nil || d <= 0 {
+		verr.add(line("crash.loop_window"), "crash.loop_window",
+			"invalid duration %q, expected positive value like \"10m\"", c.Crash.LoopWindow)
+	}
+
+	if c.Logs.Lines != nil && *c.Logs.Lines < 0 {
+		verr.add(line("logs.lines"), "logs.lines", "invalid value %d, must be 0 (capture disabled) or greater", *c.Logs.Lines)
+	}
+	if c.Logs.ExcerptLines < 1 {
+		verr.add(line("logs.excerpt_lines"), "logs.excerpt_lines", "invalid value %d, must be 1 or greater", c.Logs.ExcerptLines)
+	}
+	for _, pattern := range c.Logs.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			verr.add(line("logs.patterns"), "logs.patterns", "invalid regular expression %q: %v", pattern, err)
+		}
+	}
+
+	for _, option := range []struct{ field, value string }{
+		{"healthcheck.interval", c.Healthcheck.Interval},
+		{"healthcheck.timeout", c.Healthcheck.Timeout},
+		{"healthcheck.start_period", c.Healthcheck.StartPeriod},
+	} {
+		field, value := option.field, option.value
+		if d, err := time.ParseDuration(value); err != nil || d < time.Millisecond {
+			verr.add(line(field), field, "invalid duration %q, expected value of at least 1ms like \"30s\"", value)
+		}
+	}
+	if c.Healthcheck.Retries < 1 {
+		verr.add(line("healthcheck.retries"), "healthcheck.retries", "invalid value %d, must be 1 or greater", c.Healthcheck.Retries)
+	}
+	if d, err := time.ParseDuration(c.Healthcheck.Wait); err != nil || d < 0 {
+		verr.add(line("healthcheck.wait"), "healthcheck.wait",
+			"invalid duration %q, expected value like \"5m\" or \"0s\" to disable waiting", c.Healthcheck.Wait)
+	}
+
+	if c.SelfUpdate.URL != "" {
+		if u, err := url.Parse(c.SelfUpdate.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			verr.add(line("self_update.url"), "self_update.url", "invalid URL %q, expected http or https URL", c.SelfUpdate.URL)
+		}
+	}
+	if c.SelfUpdate.PublicKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.SelfUpdate.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			verr.add(line("self_update.public_key"), "self_update.public_key",
+				"invalid key, expected base64 encoded ed25519 public key of %d bytes", ed25519.PublicKeySize)
+		}
+	}
+	if c.SelfUpdate.MaxStartAttempts < 1 {
+		verr.add(line("self_update.max_start_attempts"), "self_update.max_start_attempts",
+			"invalid value %d, must be 1 or greater", c.SelfUpdate.MaxStartAttempts)
+	}
+	if _, err := cron.ParseStandard(c.SelfUpdate.Schedule); err != nil {
+		verr.add(line("self_update.schedule"), "self_update.schedule", "invalid cron expression %q: %v", c.SelfUpdate.Schedule, err)
+	}
+
+	if c.Hub.Listen != "" {
+		host, port, err := net.SplitHostPort(c.Hub.Listen)
+		switch {
+		case err != nil || (port != "0" && validatePort(port) != nil):
+			verr.add(line("hub.listen"), "hub.listen", "invalid address %q, expected format is [HOST]:PORT", c.Hub.Listen)
+		case c.Hub.Token == "" && !isLoopback(host):
+			// the hub API exposes the fleet and controls rollouts
+			verr.add(line("hub.listen"), "hub.listen", "non-loopback address %q requires hub.token", c.Hub.Listen)
+		}
+	}
+	if c.Hub.URL != "" {
+		if u, err := url.Parse(c.Hub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			verr.add(line("hub.url"), "hub.url", "invalid URL %q, expected http or https URL", c.Hub.URL)
+		}
+	}
+	if c.Hub.CoordinateRollouts && c.Hub.URL == "" {
+		verr.add(line("hub.coordinate_rollouts"), "hub.coordinate_rollouts", "set without hub.url")
+	}
+	if _, err := cron.ParseStandard(c.Hub.HeartbeatSchedule); err != nil {
+		verr.add(line("hub.heartbeat_schedule"), "hub.heartbeat_schedule",
+			"invalid cron expression %q: %v", c.Hub.HeartbeatSchedule, err)
+	}
+	for _, option := range []struct{ field, value string }{
+		{"hub.stale_after", c.Hub.StaleAfter},
+		{"hub.skew_after", c.Hub.SkewAfter},
+		{"hub.soak", c.Hub.Soak},
+	} {
+		field, value := option.field, option.value
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			verr.add(line(field), field, "invalid duration %q, expected positive value like \"5m\"", value)
+		}
+	}
+
+	for i, hook := range c.Hooks {
+		field := fmt.Sprintf("hooks[%d]", i)
+		if !slices.Contains(hookPoints, hook.Point) {
+			verr.add(line("hooks"), field+".point", "invalid value %q, allowed values are: %s",
+				hook.Point, strings.Join(hookPoints, ", "))
+		}
+		switch {
+		case (hook.Command == "") == (hook.URL == ""):
+			verr.add(line("hooks"), field, "exactly one of command and url is required")
+		case hook.URL != "":
+			if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				verr.add(line("hooks"), field+".url", "invalid URL %q, expected http or https URL", hook.URL)
+			}
+		}
+		if d, err := time.ParseDuration(hook.Timeout); err != nil || d <= 0 {
+			verr.add(line("hooks"), field+".timeout", "invalid duration %q, expected positive value like \"1m\"", hook.Timeout)
+		}
+	}
+
+	if _, err := cron.ParseStandard(c.UpdateSchedule); err != nil {
+		verr.add(line("update_schedule"), "update_schedule", "invalid cron expression %q: %v", c.UpdateSchedule, err)
+	}
+	if _, err := cron.ParseStandard(c.MetricsSchedule); err != nil {
+		verr.add(line("metrics_schedule"), "metrics_schedule", "invalid cron expression %q: %v", c.MetricsSchedule, err)
+	}
+}
+
+// validatePort checks that s is a number in range 1-65535
+func validatePort(s string) error {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: not a number", s)
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d: must be in range 1-65535", port)
+	}
+	return nil
+}
+
+// isLoopback returns whether the listen host accepts local connections only
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
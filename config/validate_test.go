@@ -0,0 +1,180 @@
+package config_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mtfelian/elixir-testnet-updater/config"
+)
+
+// parseProblems parses the configuration expecting validation problems
+func parseProblems(t *testing.T, yml string) *config.ValidationError {
+	t.Helper()
+	_, err := config.Parse([]byte(yml))
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected *config.ValidationError, got %v", err)
+	}
+	return verr
+}
+
+// requireProblem checks that the problem of the field is reported at the line with the message part
+func requireProblem(t *testing.T, verr *config.ValidationError, line int, field, message string) {
+	t.Helper()
+	for _, p := range verr.Problems {
+		if p.Field == field && p.Line == line && strings.Contains(p.Message, message) {
+			return
+		}
+	}
+	t.Errorf("no problem %q of %s at line %d in %v", message, field, line, verr.Problems)
+}
+
+func TestParseExample(t *testing.T) {
+	b, err := os.ReadFile("../config.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Parse(b)
+	if err != nil {
+		t.Fatalf("example configuration is invalid: %v", err)
+	}
+	if cfg.ContainerName != "elixir" || cfg.HostPort != "17690" || cfg.Runtime != "auto" {
+		t.Errorf("unexpected configuration: %+v", cfg)
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	cfg, err := config.Parse(nil)
+	if err != nil {
+		t.Fatalf("empty configuration is invalid: %v", err)
+	}
+	if cfg.Port != "17690" || cfg.Host != "http://localhost" || *cfg.KeepPreviousImages != 1 || !*cfg.AdoptContainers {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+}
+
+func TestParseUnknownFields(t *testing.T) {
+	verr := parseProblems(t, `container_name: "elixir"
+imagename: "elixirprotocol/validator:latest"
+registry:
+  mirror: "registry.local:5000"
+  mirorr: "typo"
+hooks:
+  - point: before-pull
+    command: "true"
+    timout: 1m
+`)
+	requireProblem(t, verr, 2, "imagename", "unknown option")
+	requireProblem(t, verr, 5, "registry.mirorr", "unknown option")
+	requireProblem(t, verr, 9, "hooks[0].timout", "unknown option")
+	if len(verr.Problems) != 3 {
+		t.Errorf("expected 3 problems, got %v", verr.Problems)
+	}
+}
+
+func TestParseTypeErrors(t *testing.T) {
+	verr := parseProblems(t, `crash:
+  loop_limit: "many"
+keep_previous_images: [1]
+`)
+	requireProblem(t, verr, 2, "crash.loop_limit", "cannot unmarshal")
+	requireProblem(t, verr, 3, "keep_previous_images", "cannot unmarshal")
+}
+
+func TestParseReportsAllProblems(t *testing.T) {
+	verr := parseProblems(t, `update_schedule: "every hour"
+restart_policy: "sometimes"
+port: "70000"
+host_ip: "localhost"
+ports: ["9000:9000", "udp:1"]
+image_name: "Invalid Image"
+platform: "linux"
+registry:
+  password: "secret"
+healthcheck:
+  retries: -1
+  wait: "soon"
+hub:
+  url: "hub.local"
+  coordinate_rollouts: true
+hooks:
+  - point: "before-start"
+    command: "true"
+    url: "http://hooks.local"
+host_port: "17690"
+`)
+	for _, p := range []struct {
+		line           int
+		field, message string
+	}{
+		{1, "update_schedule", "invalid cron expression"},
+		{2, "restart_policy", `invalid value "sometimes"`},
+		{3, "port", "must be in range 1-65535"},
+		{4, "host_ip", `invalid IP address "localhost"`},
+		{5, "ports[1]", `invalid port mapping "udp:1"`},
+		{6, "image_name", "invalid image reference"},
+		{7, "platform", "expected format is OS/ARCH[/VARIANT]"},
+		{9, "registry.password", "set without registry.username"},
+		{11, "healthcheck.retries", "must be 1 or greater"},
+		{12, "healthcheck.wait", `invalid duration "soon"`},
+		{14, "hub.url", "expected http or https URL"},
+		{16, "hooks[0].point", `invalid value "before-start"`},
+		{16, "hooks[0]", "exactly one of command and url is required"},
+	} {
+		requireProblem(t, verr, p.line, p.field, p.message)
+	}
+	if len(verr.Problems) != 13 {
+		t.Errorf("expected 13 problems, got %d: %v", len(verr.Problems), verr.Problems)
+	}
+
+	message := verr.Error()
+	if !strings.HasPrefix(message, "invalid configuration config.yml (13 problems):\n  line 1: update_schedule: ") {
+		t.Errorf("unexpected error message:\n%s", message)
+	}
+	if strings.Index(message, "line 3: port:") > strings.Index(message, "line 16: hooks[0]") {
+		t.Errorf("problems are not sorted by line:\n%s", message)
+	}
+}
+
+func TestParseHubListen(t *testing.T) {
+	for _, tc := range []struct {
+		listen, token string
+		valid         bool
+	}{
+		{listen: ":8080", token: "secret", valid: true},
+		{listen: "127.0.0.1:8080", valid: true},
+		{listen: "localhost:8080", valid: true},
+		{listen: "[::1]:8080", valid: true},
+		{listen: ":8080"},
+		{listen: "0.0.0.0:8080"},
+		{listen: "10.0.0.5:8080"},
+	} {
+		yml := fmt.Sprintf("hub:\n  listen: %q\n  token: %q\n", tc.listen, tc.token)
+		if tc.valid {
+			if _, err := config.Parse([]byte(yml)); err != nil {
+				t.Errorf("listen %q with token %q: %v", tc.listen, tc.token, err)
+			}
+			continue
+		}
+		requireProblem(t, parseProblems(t, yml), 2, "hub.listen", "requires hub.token")
+	}
+}
+
+func TestValidationErrorKeepsProblems(t *testing.T) {
+	verr := &config.ValidationError{File: "config.yml", Problems: []config.Problem{
+		{Line: 5, Field: "b", Message: "second"},
+		{Line: 2, Field: "a", Message: "first"},
+	}}
+	problems := slices.Clone(verr.Problems)
+	message := verr.Error()
+	if !slices.Equal(verr.Problems, problems) {
+		t.Errorf("Error changed the problems: %v", verr.Problems)
+	}
+	if message != "invalid configuration config.yml (2 problems):\n  line 2: a: first\n  line 5: b: second" {
+		t.Errorf("unexpected error message:\n%s", message)
+	}
+}
@@ -0,0 +1,131 @@
+package delixir
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// unmanagedContainers returns containers not labelled as managed which run the validator image,
+// and other containers publishing the validator port
+func (dc *DockerClient) unmanagedContainers(ctx context.Context) (validators, portUsers []types.Container, err error) {
+	containers, err := dc.cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	localImageID, _, err := dc.localImage(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repos, hostPorts := dc.imageRepositories(), dc.hostPorts()
+	for _, cont := range containers {
+		managed := cont.Labels[LabelManagedBy] == ManagedBy
+		switch {
+		case !managed && ((localImageID != "" && cont.ImageID == localImageID) || isImageOf(cont.Image, repos)):
+			validators = append(validators, cont)
+		case publishesPort(cont, hostPorts):
+			portUsers = append(portUsers, cont)
+		}
+	}
+	return validators, portUsers, nil
+}
+
+// adoptionCandidate returns the validator container started by hand to take over if the managed one doesn't exist,
+// or nil if there is none. It returns an error if the container can't be created without a conflict
+// with existing ones
+func (dc *DockerClient) adoptionCandidate(ctx context.Context) (*types.Container, error) {
+	containerID, err := dc.containerExists(ctx)
+	if err != nil || containerID != "" {
+		return nil, err
+	}
+	validators, portUsers, err := dc.unmanagedContainers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error looking for existing containers: %v", err)
+	}
+
+	switch {
+	case len(validators) > 1:
+		return nil, fmt.Errorf("found %d validator containers %s, remove the extra ones or rename the one to manage to %q",
+			len(validators), containerNames(validators), dc.containerName)
+	case len(validators) == 1 && !dc.adopt:
+		return nil, fmt.Errorf("found validator container %s not managed by the updater, adoption is disabled: "+
+			"rename it to %q or remove it", containerNames(validators), dc.containerName)
+	case len(portUsers) > 0:
+		return nil, fmt.Errorf("ports are already published by container %s", containerNames(portUsers))
+	case len(validators) == 0:
+		return nil, nil
+	}
+	return &validators[0], nil
+}
+
+// adoptContainer takes over the validator container started by hand, see adoptionCandidate.
+// It is renamed to the managed container name, and gets the labels when recreated on the next update
+func (dc *DockerClient) adoptContainer(ctx context.Context) error {
+	found, err := dc.adoptionCandidate(ctx)
+	if err != nil || found == nil {
+		return err
+	}
+	fmt.Printf("Adopting validator container %s...\n", containerName(*found))
+	if err := dc.cli.ContainerRename(ctx, found.ID, dc.containerName); err != nil {
+		return fmt.Errorf("error renaming container %q: %v", containerName(*found), err)
+	}
+	dc.notifier.SendBroadcastMessage(fmt.Sprintf("validator container %q was adopted and renamed to %q",
+		containerName(*found), dc.containerName))
+	return nil
+}
+
+// guardConflict runs adoptContainer, notifying about the conflict once until it changes.
+// It returns false if the check should not proceed
+func (dc *DockerClient) guardConflict(ctx context.Context) bool {
+	err := dc.adoptContainer(ctx)
+	if err == nil {
+		dc.conflict = ""
+		return true
+	}
+	log.Printf("Not managing the container: %v", err)
+	if msg := err.Error(); dc.conflict != msg {
+		dc.conflict = msg
+		dc.notifier.SendBroadcastMessage("container conflict: " + msg)
+	}
+	return false
+}
+
+// containerName returns the container name without the leading slash
+func containerName(cont types.Container) string {
+	if len(cont.Names) == 0 {
+		return shortID(cont.ID)
+	}
+	return strings.TrimPrefix(cont.Names[0], "/")
+}
+
+// containerNames formats names of the containers
+func containerNames(containers []types.Container) string {
+	names := make([]string, 0, len(containers))
+	for _, cont := range containers {
+		names = append(names, strconv.Quote(containerName(cont)))
+	}
+	return strings.Join(names, ", ")
+}
+
+// isImageOf returns whether the image reference belongs to one of repos
+func isImageOf(imageRef string, repos map[string]bool) bool {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	return err == nil && repos[reference.FamiliarName(named)]
+}
+
+// publishesPort returns whether the container publishes one of the host ports in "PORT/PROTOCOL" format
+func publishesPort(cont types.Container, hostPorts map[string]bool) bool {
+	for _, p := range cont.Ports {
+		if p.PublicPort != 0 && hostPorts[fmt.Sprintf("%d/%s", p.PublicPort, p.Type)] {
+			return true
+		}
+	}
+	return false
+}
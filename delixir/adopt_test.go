@@ -0,0 +1,122 @@
+package delixir_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+// addManualContainer adds a running container started by hand, publishing the validator port
+func addManualContainer(engine *dockertest.Engine, name, ref string) {
+	engine.AddContainer(name, ref, dockertest.StateRunning)
+	port := nat.Port("17690/tcp")
+	engine.SetContainerConfig(name, container.Config{Image: ref, Env: []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=test"}},
+		container.HostConfig{PortBindings: nat.PortMap{port: []nat.PortBinding{{HostPort: "17690"}}}})
+}
+
+func withAdopt(p *delixir.DockerClientParams) { p.Adopt = true }
+
+func TestCheckAndUpdateContainerAdopt(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addManualContainer(engine, "validator", testImage)
+	dc, notifier := newTestClient(t, engine, withAdopt)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := len(engine.Containers()); n != 1 {
+		t.Errorf("there are %d containers, expected 1", n)
+	}
+	if cont.Config.Labels[delixir.LabelManagedBy] != delixir.ManagedBy {
+		t.Errorf("container labels are %v", cont.Config.Labels)
+	}
+	if n := engine.CallCount("ContainerRename"); n != 1 {
+		t.Errorf("container was renamed %d times, expected once", n)
+	}
+	if !notifier.Contains(`validator container "validator" was adopted`) {
+		t.Errorf("adoption is not notified: %v", notifier.Messages())
+	}
+	if !notifier.Contains("recreated to apply configuration changes") {
+		t.Errorf("drift of the adopted container is not notified: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerAdoptDisabled(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addManualContainer(engine, "validator", testImage)
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+	dc.CheckAndUpdateContainer(context.Background())
+
+	if _, ok := engine.Container(testContainerName); ok {
+		t.Errorf("conflicting container was created")
+	}
+	if n := engine.CallCount("ContainerRename"); n != 0 {
+		t.Errorf("container was renamed %d times, expected none", n)
+	}
+	if n := notifier.Count("adoption is disabled"); n != 1 {
+		t.Errorf("conflict was notified %d times, expected once: %v", n, notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerConflicts(t *testing.T) {
+	for name, setup := range map[string]func(engine *dockertest.Engine){
+		"several validators": func(engine *dockertest.Engine) {
+			addManualContainer(engine, "validator-1", testImage)
+			engine.AddContainer("validator-2", testImage, dockertest.StateExited)
+		},
+		"port is used": func(engine *dockertest.Engine) {
+			engine.Publish("nginx:latest")
+			engine.PullLocal("nginx:latest")
+			addManualContainer(engine, "web", "nginx:latest")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			engine := dockertest.NewEngine()
+			engine.Publish(testImage)
+			engine.PullLocal(testImage)
+			setup(engine)
+			dc, notifier := newTestClient(t, engine, withAdopt)
+
+			dc.CheckAndUpdateContainer(context.Background())
+
+			if _, ok := engine.Container(testContainerName); ok {
+				t.Errorf("conflicting container was created")
+			}
+			if n := engine.CallCount("ContainerRename") + engine.CallCount("ContainerStop"); n != 0 {
+				t.Errorf("existing containers were touched %d times", n)
+			}
+			if !notifier.Contains("container conflict") {
+				t.Errorf("conflict is not notified: %v", notifier.Messages())
+			}
+		})
+	}
+}
+
+func TestPlanAdopt(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addManualContainer(engine, "validator", testImage)
+	dc, _ := newTestClient(t, engine, withAdopt)
+
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	requireActions(t, plan, "rename container validator", "stop container", "remove container", "create container",
+		"start container")
+	requireNoChanges(t, engine)
+	if n := engine.CallCount("ContainerRename"); n != 0 {
+		t.Errorf("container was renamed during the dry run")
+	}
+}
@@ -0,0 +1,75 @@
+package delixir
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// backoff limits for waiting for the Docker daemon
+const (
+	daemonBackoffMin = time.Second
+	daemonBackoffMax = 30 * time.Second
+)
+
+// daemonState tracks Docker daemon availability to report outages and recoveries once
+type daemonState struct {
+	mu        sync.Mutex
+	down      bool
+	downSince time.Time
+}
+
+// CheckDaemon pings the Docker daemon, notifying when it becomes unreachable and when it recovers
+func (dc *DockerClient) CheckDaemon(ctx context.Context) error {
+	_, err := dc.cli.Ping(ctx)
+	if err != nil && ctx.Err() != nil {
+		return err // cancelled, it's not an outage
+	}
+
+	dc.daemon.mu.Lock()
+	defer dc.daemon.mu.Unlock()
+	switch {
+	case err != nil && !dc.daemon.down:
+		dc.daemon.down, dc.daemon.downSince = true, dc.clock.Now()
+		log.Printf("Docker daemon is unreachable: %v", err)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("Docker daemon is unreachable: %v", err))
+	case err == nil && dc.daemon.down:
+		dc.daemon.down = false
+		downtime := dc.clock.Now().Sub(dc.daemon.downSince).Round(time.Second)
+		log.Printf("Docker daemon is reachable again after %s", downtime)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("Docker daemon is reachable again after %s", downtime))
+	}
+	return err
+}
+
+// WaitForDaemon pings the Docker daemon with exponential backoff until it responds, timeout expires or ctx is done.
+// API version is negotiated with the first successful ping unless it is set explicitly
+func (dc *DockerClient) WaitForDaemon(ctx context.Context, timeout time.Duration) error {
+	deadline := dc.clock.Now().Add(timeout)
+	backoff := daemonBackoffMin
+	for {
+		err := dc.CheckDaemon(ctx)
+		if err == nil {
+			fmt.Printf("Docker daemon is ready, API version %s\n", dc.cli.ClientVersion())
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		remaining := deadline.Sub(dc.clock.Now())
+		if remaining <= 0 {
+			return fmt.Errorf("docker daemon is not reachable for %s: %v", timeout, err)
+		}
+		wait := min(backoff, remaining)
+		fmt.Printf("Waiting %s for Docker daemon: %v\n", wait, err)
+		select {
+		case <-dc.clock.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, daemonBackoffMax)
+	}
+}
@@ -3,14 +3,19 @@ package delixir
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
-	"github.com/docker/go-connections/nat"
+	"github.com/mtfelian/elixir-testnet-updater/clock"
 	"github.com/mtfelian/elixir-testnet-updater/notifier"
 )
 
@@ -20,45 +25,331 @@ const (
 
 // DockerClientParams represents docker client parameters
 type DockerClientParams struct {
-	EnvVars       []string
+	EnvVars []string
+	// EnvFilePath is re-read on every check to apply env file changes to the container, EnvVars are used if empty
+	EnvFilePath   string
 	Notifier      notifier.Notifier
-	APIVersion    string
+	APIVersion    string // negotiated with the daemon if empty
 	ContainerName string
-	Port          string
+	// Port is the container port serving the health endpoint, published on HostIP:HostPort
+	Port string
+	// HostPort defaults to Port, HostIP defaults to all interfaces
+	HostPort string
+	HostIP   string
+	// ExtraPorts are additional port mappings in "docker run -p" format, e.g. "127.0.0.1:9000:9000/udp"
+	ExtraPorts    []string
 	RestartPolicy string
 	ImageName     string
+	Registry      RegistryParams
+	Platform      string // detected from the Docker daemon if empty
+	// KeepPreviousImages is a number of superseded images to keep for rollback, negative disables cleanup
+	KeepPreviousImages int
+
+	// UpdateGracePeriod is the time after a container swap during which UpdateInProgress still reports true,
+	// defaults to DefaultUpdateGracePeriod
+	UpdateGracePeriod time.Duration
+	// Crash defines reaction to container crashes reported by Docker events, see WatchEvents
+	Crash CrashParams
+	// Logs defines container logs capture for alerts
+	Logs LogsParams
+	// Healthcheck defines Docker health check of the container and waiting for it after update
+	Healthcheck HealthcheckParams
+	// Clock defaults to the real clock
+	Clock clock.Clock
+	// RolloutGate coordinates updates across a fleet, updates are not coordinated if nil
+	RolloutGate RolloutGate
+	// Hooks run custom actions at points of the update, see HookPoints
+	Hooks Hooks
+	// Version of the updater is stamped on created containers, see LabelVersion
+	Version string
+	// Adopt makes the only validator container started by hand under another name managed,
+	// if the managed one doesn't exist. Otherwise such container blocks creation of the managed one
+	Adopt bool
+
+	// Runtime is one of Runtimes, its API socket is detected unless Host is set, see DetectHost.
+	// Defaults to RuntimeAuto
+	Runtime string
+	// Host is the API host URL, e.g. "unix:///run/user/1000/podman/podman.sock"
+	Host string
+	// API is Docker Engine API implementation, a client of the Runtime API is used if nil
+	API DockerAPI
+	// RegistryURL overrides registry API base URL by registry host, e.g. to use a local registry in tests
+	RegistryURL func(host string) string
 }
 
 // NewDockerClient creates new Docker client
 func NewDockerClient(p DockerClientParams) (*DockerClient, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion(p.APIVersion))
-	if err != nil {
-		log.Fatalf("Failed to create Docker client: %v", err)
+	cli := p.API
+	if cli == nil {
+		if p.Runtime == "" {
+			p.Runtime = RuntimeAuto
+		}
+		host, err := DetectHost(p.Runtime, p.Host)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using %s container runtime API at %s", p.Runtime, host)
+		opts := []client.Opt{client.FromEnv, client.WithHost(host), client.WithAPIVersionNegotiation()}
+		if p.APIVersion != "" {
+			opts = append(opts, client.WithVersion(p.APIVersion))
+		}
+		if cli, err = client.NewClientWithOpts(opts...); err != nil {
+			return nil, fmt.Errorf("failed to create Docker client: %v", err)
+		}
 	}
-	return &DockerClient{
+
+	dc := &DockerClient{
 		cli:           cli,
 		envVars:       p.EnvVars,
+		envFilePath:   p.EnvFilePath,
 		notifier:      p.Notifier,
 		containerName: p.ContainerName,
 		port:          p.Port,
+		hostPort:      p.HostPort,
+		hostIP:        p.HostIP,
+		extraPorts:    p.ExtraPorts,
 		restartPolicy: p.RestartPolicy,
 		imageName:     p.ImageName,
-	}, nil
+		registry:      p.Registry,
+		registryAPI:   newRegistryClient(p.Registry),
+
+		keepPreviousImages: p.KeepPreviousImages,
+		crashParams:        p.Crash,
+		logs:               p.Logs,
+		healthcheck:        p.Healthcheck,
+		clock:              p.Clock,
+		rolloutGate:        p.RolloutGate,
+		adopt:              p.Adopt,
+		version:            p.Version,
+		hooks:              p.Hooks,
+	}
+	dc.swap.gracePeriod = p.UpdateGracePeriod
+	if dc.hostPort == "" {
+		dc.hostPort = dc.port
+	}
+	if dc.hostIP == "" {
+		dc.hostIP = "0.0.0.0"
+	}
+	if _, _, err := dc.portMappings(); err != nil {
+		return nil, err
+	}
+	if p.RegistryURL != nil {
+		dc.registryAPI.baseURL = p.RegistryURL
+	}
+	if dc.clock == nil {
+		dc.clock = clock.Real{}
+	}
+	if dc.swap.gracePeriod <= 0 {
+		dc.swap.gracePeriod = DefaultUpdateGracePeriod
+	}
+	if dc.logs.ExcerptLines <= 0 {
+		dc.logs.ExcerptLines = DefaultLogExcerptLines
+	}
+	var err error
+	if dc.logPatterns, err = compileLogPatterns(p.Logs.Patterns); err != nil {
+		return nil, err
+	}
+	if dc.crashParams.Policy == "" {
+		dc.crashParams.Policy = CrashNotify
+	}
+	if dc.crashParams.LoopLimit <= 0 {
+		dc.crashParams.LoopLimit = DefaultCrashLoopLimit
+	}
+	if dc.crashParams.LoopWindow <= 0 {
+		dc.crashParams.LoopWindow = DefaultCrashLoopWindow
+	}
+	if p.Platform != "" {
+		platform, err := ParsePlatform(p.Platform)
+		if err != nil {
+			return nil, err
+		}
+		dc.detectedPlatform = &platform
+	}
+	return dc, nil
 }
 
 // DockerClient represents docker client
 type DockerClient struct {
-	cli           *client.Client
+	cli           DockerAPI
 	envVars       []string
+	envFilePath   string
 	notifier      notifier.Notifier
 	containerName string
 	port          string
+	hostPort      string
+	hostIP        string
+	extraPorts    []string
 	restartPolicy string
 	imageName     string
+	registry      RegistryParams
+	registryAPI   *registryClient
+
+	keepPreviousImages int
+	crashParams        CrashParams
+	logs               LogsParams
+	logPatterns        []*regexp.Regexp
+	healthcheck        HealthcheckParams
+	clock              clock.Clock
+	rolloutGate        RolloutGate
+	// rejectedImageID is the image which failed the health check after update, it is not installed again.
+	// heldImageID is the image which update is held by the rollout gate. Both are guarded by opMu
+	rejectedImageID string
+	heldImageID     string
+	// vetoedPull is the digest and the reason of the last notified pull veto, guarded by opMu
+	vetoedPull string
+	// adopt enables adoption of containers started by hand, conflict is the last notified container conflict
+	adopt    bool
+	conflict string
+	version  string
+	hooks    Hooks
+
+	// opMu serializes update operations, swap tracks container recreation for health checks,
+	// daemon tracks Docker daemon availability, crash tracks container crashes
+	opMu   sync.Mutex
+	swap   swapState
+	daemon daemonState
+	crash  crashState
+
+	platformMu       sync.Mutex
+	detectedPlatform *Platform
 }
 
+// remoteImage represents the result of the registry check of the image tag
+type remoteImage struct {
+	Digest  string // manifest digest
+	ImageID string // ID of the image for the platform, empty if it was not resolved
+	Pull    bool   // whether the image should be pulled
+	// RateLimited means the image differs from the local one, but the pull is postponed due to the rate limit
+	RateLimited bool
+}
+
+// checkRemoteImage checks the registry manifest of the image tag and compares its digest with the local image.
+// The image should be pulled if the check fails
+func (dc *DockerClient) checkRemoteImage(ctx context.Context) (remoteImage, error) {
+	imageRef, remote, err := dc.remoteManifest(ctx)
+	if err != nil {
+		return remoteImage{Pull: true}, err
+	}
+	result := remoteImage{Digest: remote.Digest}
+
+	localImageID, localDigests, err := dc.localImage(ctx)
+	if err != nil {
+		return remoteImage{Digest: remote.Digest, Pull: true}, err
+	}
+	for _, digest := range localDigests {
+		if digest == remote.Digest {
+			fmt.Printf("Local image digest %s matches the registry\n", remote.Digest)
+			result.ImageID = localImageID
+			return result, nil
+		}
+	}
+
+	// the tag may point to a manifest list which changed for other platforms only
+	if localImageID != "" {
+		platform, err := dc.platform(ctx)
+		if err != nil {
+			return remoteImage{Digest: remote.Digest, Pull: true}, err
+		}
+		configDigest, err := dc.registryAPI.platformConfigDigest(ctx, imageRef, remote.Digest, platform)
+		if err != nil {
+			return remoteImage{Digest: remote.Digest, Pull: true}, err
+		}
+		result.ImageID = configDigest
+		if configDigest == localImageID {
+			fmt.Printf("Local image %s matches the registry image for platform %s\n", localImageID, platform)
+			return result, nil
+		}
+	}
+
+	fmt.Printf("Registry has image digest %s, local digests are %v\n", remote.Digest, localDigests)
+	if remote.RateLimitRemaining == 0 {
+		log.Printf("Registry pull rate limit is exhausted, postponing the pull of %s", remote.Digest)
+		result.RateLimited = true
+		return result, nil
+	}
+	if remote.RateLimitRemaining != rateLimitUnknown {
+		fmt.Printf("Registry pull rate limit remaining: %d\n", remote.RateLimitRemaining)
+	}
+	result.Pull = true
+	return result, nil
+}
+
+// remoteManifest requests the manifest digest of the image from the mirror if it is configured,
+// falling back to the original registry. It returns the image reference the manifest was requested for
+func (dc *DockerClient) remoteManifest(ctx context.Context) (string, manifestInfo, error) {
+	imageRef := dc.imageName
+	if dc.registry.Mirror != "" {
+		mirrorRef, err := mirrorReference(dc.imageName, dc.registry.Mirror)
+		if err != nil {
+			return imageRef, manifestInfo{}, err
+		}
+		imageRef = mirrorRef
+	}
+
+	remote, err := dc.registryAPI.headManifest(ctx, imageRef)
+	if err != nil && dc.registry.Mirror != "" && !dc.registry.DisableFallback {
+		log.Printf("Error checking manifest on mirror %s: %v. Falling back to %s", dc.registry.Mirror, err, dc.imageName)
+		imageRef = dc.imageName
+		remote, err = dc.registryAPI.headManifest(ctx, imageRef)
+	}
+	return imageRef, remote, err
+}
+
+// localImage returns ID and repository digests of the local image, or nothing if the image doesn't exist
+func (dc *DockerClient) localImage(ctx context.Context) (string, []string, error) {
+	inspect, _, err := dc.cli.ImageInspectWithRaw(ctx, dc.imageName)
+	if client.IsErrNotFound(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	digests := make([]string, 0, len(inspect.RepoDigests))
+	for _, repoDigest := range inspect.RepoDigests {
+		if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+			digests = append(digests, digest)
+		}
+	}
+	return inspect.ID, digests, nil
+}
+
+// pullLatestImage pulls the image from the mirror if it is configured, falling back to the original registry
 func (dc *DockerClient) pullLatestImage(ctx context.Context) error {
-	reader, err := dc.cli.ImagePull(ctx, dc.imageName, image.PullOptions{Platform: "linux/amd64"})
+	if dc.registry.Mirror == "" {
+		return dc.pullImage(ctx, dc.imageName)
+	}
+
+	mirrorRef, err := mirrorReference(dc.imageName, dc.registry.Mirror)
+	if err != nil {
+		return err
+	}
+	if err = dc.pullImage(ctx, mirrorRef); err == nil {
+		// tag the mirrored image with the original name, so the container is always created from it
+		return dc.cli.ImageTag(ctx, mirrorRef, dc.imageName)
+	}
+	if dc.registry.DisableFallback {
+		return fmt.Errorf("error pulling from mirror %s: %v", dc.registry.Mirror, err)
+	}
+	log.Printf("Error pulling from mirror %s: %v. Falling back to %s", dc.registry.Mirror, err, dc.imageName)
+	return dc.pullImage(ctx, dc.imageName)
+}
+
+func (dc *DockerClient) pullImage(ctx context.Context, imageRef string) error {
+	registryAuth, err := dc.registry.encodedAuth(imageRef)
+	if err != nil {
+		return fmt.Errorf("error getting registry credentials: %v", err)
+	}
+
+	platform, err := dc.platform(ctx)
+	if err != nil {
+		return err
+	}
+
+	reader, err := dc.cli.ImagePull(ctx, imageRef, image.PullOptions{
+		Platform:     platform.String(),
+		RegistryAuth: registryAuth,
+	})
 	if err != nil {
 		return err
 	}
@@ -71,6 +362,7 @@ func (dc *DockerClient) pullLatestImage(ctx context.Context) error {
 			Status   string `json:"status"`
 			Progress string `json:"progress"`
 			ID       string `json:"id"`
+			Error    string `json:"error"`
 		}
 
 		if err := decoder.Decode(&msg); err == io.EOF {
@@ -78,6 +370,9 @@ func (dc *DockerClient) pullLatestImage(ctx context.Context) error {
 		} else if err != nil {
 			return err
 		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
 
 		// Print status and progress if available
 		if msg.ID != "" {
@@ -90,17 +385,45 @@ func (dc *DockerClient) pullLatestImage(ctx context.Context) error {
 	return nil
 }
 
-// CheckAndUpdateContainer image
+// CheckAndUpdateContainer image. If another check is in progress, it returns immediately
 func (dc *DockerClient) CheckAndUpdateContainer(ctx context.Context) {
+	if !dc.opMu.TryLock() {
+		log.Println("Another update operation is in progress, skipping the check")
+		return
+	}
+	defer dc.opMu.Unlock()
+
+	if err := dc.CheckDaemon(ctx); err != nil {
+		log.Printf("Skipping the check, Docker daemon is unreachable: %v", err)
+		return
+	}
+	dc.reloadEnv()
+	if !dc.guardConflict(ctx) {
+		return
+	}
+
 	currentContainerData, err := dc.getCurrentContainerData(ctx)
 	if err != nil {
 		log.Printf("Error getting current image ID: %v", err)
 	}
 
-	fmt.Println("Pulling the latest image...")
-	if err := dc.pullLatestImage(ctx); err != nil {
-		log.Printf("Error pulling image: %v", err)
-		return
+	fmt.Println("Checking the registry for a new image...")
+	remote, err := dc.checkRemoteImage(ctx)
+	if err != nil {
+		log.Printf("Error checking the registry manifest, pulling anyway: %v", err)
+	}
+
+	if remote.Pull {
+		// without the registry digest there is no new image to show the before-pull hooks,
+		// before-stop ones still run if the pull brings one
+		if remote.Digest != "" && !dc.pullAllowed(ctx, currentContainerData, remote.Digest) {
+			return
+		}
+		fmt.Println("Pulling the latest image...")
+		if err := dc.pullLatestImage(ctx); err != nil {
+			log.Printf("Error pulling image: %v", err)
+			return
+		}
 	}
 
 	newImageID, err := dc.getImageID(ctx)
@@ -109,15 +432,35 @@ func (dc *DockerClient) CheckAndUpdateContainer(ctx context.Context) {
 		return
 	}
 
-	if currentContainerData.ImageID != newImageID {
+	if currentContainerData.ImageID != newImageID && newImageID == dc.rejectedImageID {
+		log.Printf("Image %q failed the health check after update, waiting for a newer one", newImageID)
+	} else if currentContainerData.ImageID != newImageID && currentContainerData.ImageID != "" &&
+		!dc.rolloutAllowed(ctx, newImageID) { // the first installation is not coordinated
+		fmt.Println("Waiting for the rollout coordinator to allow the update.")
+	} else if currentContainerData.ImageID != newImageID {
 		fmt.Println("New image found, updating container...")
-		dc.updateContainer(ctx)
+		err := dc.rollout(ctx, currentContainerData, newImageID)
+		if errors.Is(err, ErrVetoed) { // not a failure of the image
+			log.Printf("Not updating container: %v", err)
+			dc.notifier.SendBroadcastMessage(fmt.Sprintf("update to image %q was vetoed: %v", newImageID, err))
+			return
+		}
+		dc.reportRollout(ctx, newImageID, err)
+		if err != nil {
+			log.Printf("Error updating container: %v", err)
+			dc.notifier.SendBroadcastMessage(fmt.Sprintf("failed to update container to image %q: %v", newImageID, err))
+			return
+		}
 		dc.notifier.SendBroadcastMessage(fmt.Sprintf("updated image from %q to %q",
 			currentContainerData.ImageID, newImageID))
-	} else { // currentContainerData.ImageID != newImageID
+	} else if !dc.reconcileDrift(ctx, currentContainerData) { // currentContainerData.ImageID == newImageID
 		fmt.Println("Container is already up to date.")
 		fmt.Printf("Current container status is %q. Restarting it\n", currentContainerData.State)
-		if currentContainerData.State == containerStateExited {
+		if currentContainerData.State == containerStateExited && dc.CrashLooping() {
+			log.Println("Container is crash looping, not starting it")
+		} else if currentContainerData.State == containerStateExited {
+			endSwap := dc.beginSwap()
+			defer endSwap()
 			if err := dc.containerStart(ctx, currentContainerData.ContainerID); err != nil {
 				log.Printf("attempted to start container %q after stopping attempt, error: %v",
 					currentContainerData.ContainerID, err)
@@ -125,24 +468,26 @@ func (dc *DockerClient) CheckAndUpdateContainer(ctx context.Context) {
 		}
 		//dc.notifier.SendBroadcastMessage("image is up-to-date")
 	}
+
+	if dc.keepPreviousImages >= 0 {
+		report, err := dc.cleanupImages(ctx, newImageID, dc.keepPreviousImages)
+		if err != nil {
+			log.Printf("Error cleaning up old images: %v", err)
+		}
+		if len(report.RemovedImages) > 0 {
+			fmt.Printf("Images cleanup: %s\n", report)
+			dc.notifier.SendBroadcastMessage("images cleanup: " + report.String())
+		}
+	}
 }
 
 // containerExists returns containerID if it exists, otherwise returns empty string
 func (dc *DockerClient) containerExists(ctx context.Context) (string, error) {
-	containers, err := dc.cli.ContainerList(ctx, container.ListOptions{All: true})
-	if err != nil {
+	cont, err := dc.findContainer(ctx)
+	if err != nil || cont == nil {
 		return "", err
 	}
-
-	for _, cont := range containers {
-		for _, name := range cont.Names {
-			if name == "/"+dc.containerName {
-				return cont.ID, nil
-			}
-		}
-	}
-
-	return "", nil
+	return cont.ID, nil
 }
 
 // ContainerData represents container data
@@ -153,28 +498,23 @@ type ContainerData struct {
 }
 
 func (dc *DockerClient) getCurrentContainerData(ctx context.Context) (ContainerData, error) {
-	containers, err := dc.cli.ContainerList(ctx, container.ListOptions{All: true})
+	cont, err := dc.findContainer(ctx)
 	if err != nil {
 		return ContainerData{}, err
 	}
-
-	for _, cont := range containers {
-		for _, name := range cont.Names {
-			if name == "/"+dc.containerName {
-				return ContainerData{
-					ContainerID: cont.ID,
-					ImageID:     cont.ImageID,
-					State:       cont.State,
-				}, nil
-			}
-		}
+	if cont == nil {
+		return ContainerData{}, fmt.Errorf("container %s not found", dc.containerName)
 	}
-
-	return ContainerData{}, fmt.Errorf("container %s not found", dc.containerName)
+	return ContainerData{
+		ContainerID: cont.ID,
+		ImageID:     cont.ImageID,
+		State:       cont.State,
+	}, nil
 }
 
 func (dc *DockerClient) containerStop(ctx context.Context, containerID string) error {
 	fmt.Println("Stopping the container...")
+	dc.expectStop(containerID)
 	if err := dc.cli.ContainerStop(ctx, containerID, container.StopOptions{}); err != nil {
 		log.Printf("Error stopping container: %v", err)
 		return err
@@ -201,7 +541,7 @@ func (dc *DockerClient) getImageID(ctx context.Context) (string, error) {
 	for _, img := range images {
 		for _, tag := range img.RepoTags {
 			fmt.Printf(">> found image %q, our image is %q\n", tag, dc.imageName)
-			if tag == dc.imageName {
+			if sameTag(tag, dc.imageName) {
 				return img.ID, nil
 			}
 		}
@@ -210,59 +550,86 @@ func (dc *DockerClient) getImageID(ctx context.Context) (string, error) {
 	return "", fmt.Errorf("image %s not found", dc.imageName)
 }
 
-func (dc *DockerClient) updateContainer(ctx context.Context) {
+// rollout recreates the container with the new image and waits for it to become healthy.
+// An unhealthy container is rolled back to the previous image, and the new image is rejected
+func (dc *DockerClient) rollout(ctx context.Context, current ContainerData, newImageID string) error {
+	event := HookEvent{ContainerID: current.ContainerID, CurrentImageID: current.ImageID, NewImage: newImageID}
+	if current.ContainerID != "" {
+		event.Point = HookBeforeStop
+		if err := dc.runPreHooks(ctx, event); err != nil {
+			return err
+		}
+	}
+	defer dc.beginSwap()()
+
+	containerID, err := dc.updateContainer(ctx, dc.imageName)
+	if err != nil {
+		return err
+	}
+	event.Point, event.ContainerID = HookAfterStart, containerID
+	dc.runPostHooks(ctx, event)
+	err = dc.waitHealthy(ctx, containerID)
+	if err == nil {
+		event.Point = HookAfterHealthy
+		dc.runPostHooks(ctx, event)
+		return nil
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+
+	dc.rejectedImageID = newImageID
+	dc.alert(ctx, containerID, fmt.Sprintf("container is not healthy after update to image %q: %v", newImageID, err))
+	if current.ImageID == "" {
+		return fmt.Errorf("%v, no previous image to roll back to", err)
+	}
+	fmt.Printf("Rolling back to image %s...\n", current.ImageID)
+	rollbackID, rollbackErr := dc.updateContainer(ctx, current.ImageID)
+	if rollbackErr != nil {
+		err = fmt.Errorf("%v, rollback to image %q failed: %v", err, current.ImageID, rollbackErr)
+	} else {
+		err = fmt.Errorf("%v, rolled back to image %q", err, current.ImageID)
+	}
+	event.Point, event.ContainerID, event.Error = HookRollback, rollbackID, err.Error()
+	dc.runPostHooks(ctx, event)
+	return err
+}
+
+// updateContainer replaces the container with a new one created from imageRef and returns its ID
+func (dc *DockerClient) updateContainer(ctx context.Context, imageRef string) (string, error) {
 	fmt.Println("checking container existence...")
-	containerID, err := dc.containerExists(ctx)
+	current, err := dc.findContainer(ctx)
 	if err != nil {
-		log.Printf("Error checking container for existence: %v", err)
-		return
+		return "", fmt.Errorf("error checking container for existence: %v", err)
 	}
 
-	if containerID != "" {
-		if err := dc.containerStop(ctx, containerID); err != nil {
-			return
+	var previousImage string
+	if current != nil {
+		previousImage = dc.rolloutImage(ctx, current.ImageID)
+		if err := dc.containerStop(ctx, current.ID); err != nil {
+			return "", err
 		}
 
 		fmt.Println("Removing the container...")
-		if err := dc.cli.ContainerRemove(ctx, containerID, container.RemoveOptions{}); err != nil {
-			log.Printf("Error removing container: %v", err)
-			return
+		if err := dc.cli.ContainerRemove(ctx, current.ID, container.RemoveOptions{}); err != nil {
+			return "", fmt.Errorf("error removing container: %v", err)
 		}
 	}
 
-	natPort, err := nat.NewPort("tcp", dc.port)
+	config, hostConfig, err := dc.containerSpec(imageRef, previousImage)
 	if err != nil {
-		log.Printf("Error creating NatPort: %v", err)
-		return
+		return "", err
 	}
 	fmt.Println("Starting a new container with the updated image...")
-	resp, err := dc.cli.ContainerCreate(ctx, &container.Config{
-		Image: dc.imageName,
-		Env:   dc.envVars,
-		ExposedPorts: nat.PortSet{
-			natPort: struct{}{},
-		},
-	}, &container.HostConfig{
-		PortBindings: nat.PortMap{
-			natPort: []nat.PortBinding{
-				{
-					HostIP:   "0.0.0.0",
-					HostPort: dc.port,
-				},
-			},
-		},
-		RestartPolicy: container.RestartPolicy{
-			Name: container.RestartPolicyMode(dc.restartPolicy),
-		},
-	}, nil, nil, dc.containerName)
+	resp, err := dc.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, dc.containerName)
 	if err != nil {
-		log.Printf("Error creating container: %v", err)
-		return
+		return "", fmt.Errorf("error creating container: %v", err)
 	}
 
 	if err := dc.containerStart(ctx, resp.ID); err != nil {
-		return
+		return "", err
 	}
 
 	fmt.Println("Container updated successfully.")
+	return resp.ID, nil
 }
@@ -0,0 +1,233 @@
+package delixir_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+)
+
+const (
+	testImage         = "elixirprotocol/validator:latest"
+	testContainerName = "elixir"
+)
+
+func newTestClient(t *testing.T, engine *dockertest.Engine, options ...func(*delixir.DockerClientParams),
+) (*delixir.DockerClient, *harness.Recorder) {
+	t.Helper()
+	registry := httptest.NewServer(engine)
+	t.Cleanup(registry.Close)
+
+	notifier := &harness.Recorder{}
+	p := delixir.DockerClientParams{
+		EnvVars:            []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=test"},
+		Notifier:           notifier,
+		ContainerName:      testContainerName,
+		Port:               "17690",
+		RestartPolicy:      "unless-stopped",
+		ImageName:          testImage,
+		KeepPreviousImages: -1,
+		API:                engine,
+		RegistryURL:        dockertest.RegistryURL(registry.URL),
+	}
+	for _, option := range options {
+		option(&p)
+	}
+	dc, err := delixir.NewDockerClient(p)
+	if err != nil {
+		t.Fatalf("NewDockerClient: %v", err)
+	}
+	return dc, notifier
+}
+
+// addContainer adds the container with the settings of the client created by newTestClient with default options
+func addContainer(engine *dockertest.Engine, state string) {
+	engine.AddContainer(testContainerName, testImage, state)
+	port := nat.Port("17690/tcp")
+	engine.SetContainerConfig(testContainerName, container.Config{
+		Image:        testImage,
+		Env:          []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=test"},
+		ExposedPorts: nat.PortSet{port: struct{}{}},
+		Labels:       map[string]string{delixir.LabelManagedBy: delixir.ManagedBy},
+	}, container.HostConfig{
+		PortBindings:  nat.PortMap{port: []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "17690"}}},
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyUnlessStopped},
+	})
+}
+
+func requireContainer(t *testing.T, engine *dockertest.Engine, imageID, state string) dockertest.Container {
+	t.Helper()
+	cont, ok := engine.Container(testContainerName)
+	if !ok {
+		t.Fatalf("container %q not found", testContainerName)
+	}
+	if cont.ImageID != imageID {
+		t.Errorf("container image ID is %q, expected %q", cont.ImageID, imageID)
+	}
+	if cont.State != state {
+		t.Errorf("container state is %q, expected %q", cont.State, state)
+	}
+	return cont
+}
+
+func TestCheckAndUpdateContainerFirstInstall(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if cont.HostConfig.RestartPolicy.Name != "unless-stopped" {
+		t.Errorf("restart policy is %q", cont.HostConfig.RestartPolicy.Name)
+	}
+	if len(cont.Config.Env) != 1 || cont.Config.Env[0] != "STRATEGY_EXECUTOR_DISPLAY_NAME=test" {
+		t.Errorf("container env is %v", cont.Config.Env)
+	}
+	if !notifier.Contains("updated image") {
+		t.Errorf("update notification was not sent: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerUpToDate(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateRunning)
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ImagePull"); n != 0 {
+		t.Errorf("image was pulled %d times, expected no pulls", n)
+	}
+	if n := engine.CallCount("ContainerCreate"); n != 0 {
+		t.Errorf("container was created %d times, expected none", n)
+	}
+	if len(notifier.Messages()) != 0 {
+		t.Errorf("unexpected notifications: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerNewImage(t *testing.T) {
+	engine := dockertest.NewEngine()
+	old := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateRunning)
+	remote := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := len(engine.Containers()); n != 1 {
+		t.Errorf("there are %d containers, expected 1", n)
+	}
+	if !notifier.Contains(old.ID) || !notifier.Contains(remote.ID) {
+		t.Errorf("update notification doesn't mention image IDs: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerExited(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateExited)
+	dc, _ := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ContainerCreate"); n != 0 {
+		t.Errorf("container was created %d times, expected to be started only", n)
+	}
+}
+
+func TestCheckAndUpdateContainerPullFailure(t *testing.T) {
+	engine := dockertest.NewEngine()
+	old := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateRunning)
+	engine.Publish(testImage)
+	engine.FailOn("ImagePull", errors.New("connection reset by peer"))
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, old.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ContainerStop"); n != 0 {
+		t.Errorf("container was stopped %d times, expected to keep running", n)
+	}
+	if notifier.Contains("updated image") {
+		t.Errorf("unexpected update notification: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerCreateFailure(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateRunning)
+	engine.Publish(testImage)
+	engine.FailOn("ContainerCreate", errors.New("port is already allocated"))
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	if _, ok := engine.Container(testContainerName); ok {
+		t.Errorf("container exists after failed creation")
+	}
+	if n := engine.CallCount("ContainerStart"); n != 0 {
+		t.Errorf("container was started %d times, expected none", n)
+	}
+	if !notifier.Contains("failed to update container") || notifier.Contains("updated image") {
+		t.Errorf("expected failure notification only: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerRegistryUnavailable(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	engine.FailOn("RegistryHEAD", errors.New("registry is down"))
+	dc, _ := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ImagePull"); n != 1 {
+		t.Errorf("image was pulled %d times, expected to pull once without manifest check", n)
+	}
+}
+
+func TestCheckAndUpdateContainerDoesNotOverlap(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	release := engine.Block("ImagePull")
+	dc, _ := newTestClient(t, engine)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dc.CheckAndUpdateContainer(context.Background())
+	}()
+	harness.WaitFor(t, time.Second, func() bool { return engine.CallCount("ImagePull") == 1 }, "the first pull")
+
+	dc.CheckAndUpdateContainer(context.Background()) // returns immediately
+	if n := engine.CallCount("ImagePull"); n != 1 {
+		t.Errorf("image was pulled %d times, expected the second check to be skipped", n)
+	}
+
+	release()
+	<-done
+	if _, ok := engine.Container(testContainerName); !ok {
+		t.Errorf("container was not created by the first check")
+	}
+}
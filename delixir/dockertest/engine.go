@@ -0,0 +1,893 @@
+// Package dockertest provides an in-memory fake Docker engine and registry for testing
+package dockertest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// APIVersion is the API version reported by the fake engine
+const APIVersion = "1.47"
+
+// container states
+const (
+	StateCreated = "created"
+	StateRunning = "running"
+	StateExited  = "exited"
+)
+
+// Image represents an image stored in the fake engine
+type Image struct {
+	ID          string
+	RepoTags    []string
+	RepoDigests []string
+	Created     int64
+	Size        int64
+	// Config is the image configuration merged into containers created from it, see SetImageConfig
+	Config *container.Config
+}
+
+// RemoteImage represents an image published to the fake registry
+type RemoteImage struct {
+	ID     string // image ID, which is the image config digest, empty for manifest lists
+	Digest string // manifest digest
+}
+
+// PlatformImage represents a platform image of a manifest list published to the fake registry
+type PlatformImage struct {
+	Platform ocispec.Platform
+	RemoteImage
+}
+
+// Container represents a container stored in the fake engine
+type Container struct {
+	ID         string
+	Name       string
+	Image      string
+	ImageID    string
+	State      string
+	Config     container.Config
+	HostConfig container.HostConfig
+	Logs       []string
+	Health     string // Docker health status, empty if the container has no health check
+}
+
+// Engine is an in-memory fake Docker engine implementing delixir.DockerAPI.
+// It also serves a fake registry over HTTP, see ServeHTTP
+type Engine struct {
+	mu         sync.Mutex
+	seq        int
+	images     map[string]*Image
+	remote     map[string]RemoteImage
+	indexes    map[string][]PlatformImage // platform images by manifest list digest
+	pullAuth   map[string]string
+	containers map[string]*Container
+	failures   map[string]error
+	blocked    map[string]chan struct{}
+	calls      []string
+	rateLimit  *int
+	auth       registryAuth
+	events     []*subscription
+	eventTime  int64
+
+	// OSType and Architecture are reported by Info
+	OSType       string
+	Architecture string
+	// FullNames makes image names in RepoTags and RepoDigests fully qualified, e.g.
+	// "docker.io/elixirprotocol/validator:latest", as Podman shows them
+	FullNames bool
+	// RuntimeEnv is added to the environment of created containers, as Podman adds "container=podman"
+	RuntimeEnv []string
+}
+
+// NewEngine creates new empty fake engine
+func NewEngine() *Engine {
+	return &Engine{
+		images:       make(map[string]*Image),
+		remote:       make(map[string]RemoteImage),
+		indexes:      make(map[string][]PlatformImage),
+		pullAuth:     make(map[string]string),
+		containers:   make(map[string]*Container),
+		failures:     make(map[string]error),
+		blocked:      make(map[string]chan struct{}),
+		OSType:       "linux",
+		Architecture: "x86_64",
+	}
+}
+
+// normalize returns the normalized tagged image reference
+func normalize(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+// familiar returns the tagged image reference as the engine shows it in RepoTags:
+// familiar like Docker does, or fully qualified with FullNames
+func (e *Engine) familiar(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	if e.FullNames {
+		return reference.TagNameOnly(named).String()
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
+
+// repository returns the repository name of the image reference as the engine shows it in RepoDigests
+func (e *Engine) repository(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	if e.FullNames {
+		return named.Name()
+	}
+	return reference.FamiliarName(named)
+}
+
+// nextID returns new unique identifier with the given prefix
+func (e *Engine) nextID(prefix string) string {
+	e.seq++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", prefix, e.seq)))
+	return hex.EncodeToString(sum[:])
+}
+
+// call records the API call and returns the injected failure for it, if any.
+// If the method is blocked, it waits for the release or ctx cancellation with e.mu temporarily unlocked
+func (e *Engine) call(ctx context.Context, method string, args ...string) error {
+	e.calls = append(e.calls, strings.TrimSpace(method+" "+strings.Join(args, " ")))
+	if blocked, ok := e.blocked[method]; ok {
+		e.mu.Unlock()
+		select {
+		case <-blocked:
+		case <-ctx.Done():
+		}
+		e.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return e.failures[method]
+}
+
+// Block makes calls of the API method wait until the returned release function is called
+// or the call context is done
+func (e *Engine) Block(method string) (release func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ch := make(chan struct{})
+	e.blocked[method] = ch
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			if e.blocked[method] == ch {
+				delete(e.blocked, method)
+			}
+			close(ch)
+		})
+	}
+}
+
+// FailOn makes the API method fail with err. Nil err removes the failure
+func (e *Engine) FailOn(method string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err == nil {
+		delete(e.failures, method)
+		return
+	}
+	e.failures[method] = err
+}
+
+// Calls returns API calls made so far, formatted as "Method args..."
+func (e *Engine) Calls() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.calls...)
+}
+
+// CallCount returns the number of calls of the API method
+func (e *Engine) CallCount(method string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var n int
+	for _, c := range e.calls {
+		if c == method || strings.HasPrefix(c, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// Publish pushes a new image version to the fake registry under ref and returns it
+func (e *Engine) Publish(ref string) RemoteImage {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	remote := RemoteImage{
+		ID:     "sha256:" + e.nextID("image"),
+		Digest: "sha256:" + e.nextID("manifest"),
+	}
+	e.remote[normalize(ref)] = remote
+	return remote
+}
+
+// PublishIndex pushes a new multi-platform image version to the fake registry under ref as a manifest list.
+// It returns the manifest list digest and the platform images. Platform images without ID get new ones,
+// so platforms which didn't change may be published again with the images returned before
+func (e *Engine) PublishIndex(ref string, platforms ...PlatformImage) (string, []PlatformImage) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	images := make([]PlatformImage, 0, len(platforms))
+	for _, p := range platforms {
+		if p.ID == "" {
+			p.RemoteImage = RemoteImage{
+				ID:     "sha256:" + e.nextID("image"),
+				Digest: "sha256:" + e.nextID("manifest"),
+			}
+		}
+		images = append(images, p)
+	}
+	digest := "sha256:" + e.nextID("index")
+	e.indexes[digest] = images
+	e.remote[normalize(ref)] = RemoteImage{Digest: digest}
+	return digest, append([]PlatformImage(nil), images...)
+}
+
+// platformImage returns the image of the manifest list for the platform in format "os/arch[/variant]"
+func (e *Engine) platformImage(index RemoteImage, platform string) (RemoteImage, bool) {
+	osType, arch, _ := strings.Cut(platform, "/")
+	arch, variant, _ := strings.Cut(arch, "/")
+	for _, p := range e.indexes[index.Digest] {
+		if p.Platform.OS == osType && p.Platform.Architecture == arch && (variant == "" || p.Platform.Variant == variant) {
+			return RemoteImage{ID: p.ID, Digest: index.Digest}, true
+		}
+	}
+	return RemoteImage{}, false
+}
+
+// Remote returns the image published under ref
+func (e *Engine) Remote(ref string) (RemoteImage, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	remote, ok := e.remote[normalize(ref)]
+	return remote, ok
+}
+
+// PullAuth returns the registry authentication passed with the last pull of ref,
+// nil if the pull was made without it
+func (e *Engine) PullAuth(ref string) (*registry.AuthConfig, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	encoded := e.pullAuth[normalize(ref)]
+	if encoded == "" {
+		return nil, nil
+	}
+	return registry.DecodeAuthConfig(encoded)
+}
+
+// PullLocal makes the image published under ref present locally, as if it was pulled
+func (e *Engine) PullLocal(ref string) *Image {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pull(ref, e.remote[normalize(ref)])
+}
+
+// pull stores the remote image locally, moving the tag from the previous image
+func (e *Engine) pull(ref string, remote RemoteImage) *Image {
+	tag := e.familiar(ref)
+	for _, img := range e.images {
+		img.RepoTags = removeString(img.RepoTags, tag)
+	}
+
+	img, ok := e.images[remote.ID]
+	if !ok {
+		e.seq++
+		img = &Image{ID: remote.ID, Created: int64(e.seq), Size: 100 << 20}
+		e.images[remote.ID] = img
+	}
+	img.RepoTags = appendUnique(img.RepoTags, tag)
+	img.RepoDigests = appendUnique(img.RepoDigests, e.repository(ref)+"@"+remote.Digest)
+	return img
+}
+
+// Images returns local images sorted by creation order
+func (e *Engine) Images() []Image {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	images := make([]Image, 0, len(e.images))
+	for _, img := range e.images {
+		images = append(images, *img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Created < images[j].Created })
+	return images
+}
+
+// AddDanglingImage stores a local image without tags and digests with the labels, like an untagged locally
+// built one
+func (e *Engine) AddDanglingImage(labels map[string]string) *Image {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	img := &Image{ID: "sha256:" + e.nextID("image"), Created: int64(e.seq), Size: 10 << 20}
+	if labels != nil {
+		img.Config = &container.Config{Labels: labels}
+	}
+	e.images[img.ID] = img
+	return img
+}
+
+// AddContainer stores a container created from the local image ref with the given state
+func (e *Engine) AddContainer(name, ref, state string) *Container {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cont := &Container{
+		ID:     e.nextID("container"),
+		Name:   name,
+		Image:  ref,
+		State:  state,
+		Config: container.Config{Image: ref},
+	}
+	if img := e.findImage(ref); img != nil {
+		cont.ImageID = img.ID
+	}
+	e.containers[cont.ID] = cont
+	return cont
+}
+
+// Container returns a copy of the container with the name
+func (e *Engine) Container(name string) (Container, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cont := e.findContainer(name); cont != nil {
+		return *cont, true
+	}
+	return Container{}, false
+}
+
+// Containers returns copies of all containers
+func (e *Engine) Containers() []Container {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	containers := make([]Container, 0, len(e.containers))
+	for _, cont := range e.containers {
+		containers = append(containers, *cont)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	return containers
+}
+
+// AppendLogs adds lines to the output of the container with the name
+func (e *Engine) AppendLogs(name string, lines ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cont := e.findContainer(name); cont != nil {
+		cont.Logs = append(cont.Logs, lines...)
+	}
+}
+
+// SetHealth changes Docker health status of the container with the name, emitting health_status event
+func (e *Engine) SetHealth(name, status string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cont := e.findContainer(name); cont != nil {
+		cont.Health = status
+		e.emit(cont, events.ActionHealthStatus+events.Action(": "+status), nil)
+	}
+}
+
+// SetContainerState changes the state of the container with the name
+func (e *Engine) SetContainerState(name, state string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cont := e.findContainer(name); cont != nil {
+		cont.State = state
+	}
+}
+
+// SetImageConfig sets the configuration of the local image ref, e.g. its environment and health check
+func (e *Engine) SetImageConfig(ref string, config container.Config) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if img := e.findImage(ref); img != nil {
+		img.Config = &config
+	}
+}
+
+// SetContainerConfig replaces the configuration of the container with the name,
+// as if it was created with these settings
+func (e *Engine) SetContainerConfig(name string, config container.Config, hostConfig container.HostConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cont := e.findContainer(name); cont != nil {
+		cont.Config, cont.HostConfig = config, hostConfig
+	}
+}
+
+// findImage returns the local image by ID or tag
+func (e *Engine) findImage(ref string) *Image {
+	if img, ok := e.images[ref]; ok {
+		return img
+	}
+	tag := e.familiar(ref)
+	for _, img := range e.images {
+		for _, t := range img.RepoTags {
+			if t == tag {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+// findContainer returns the container by ID or name
+func (e *Engine) findContainer(idOrName string) *Container {
+	if cont, ok := e.containers[idOrName]; ok {
+		return cont
+	}
+	name := strings.TrimPrefix(idOrName, "/")
+	for _, cont := range e.containers {
+		if cont.Name == name {
+			return cont
+		}
+	}
+	return nil
+}
+
+func notFound(format string, args ...any) error {
+	return errdefs.NotFound(fmt.Errorf(format, args...))
+}
+
+// Ping implements delixir.DockerAPI
+func (e *Engine) Ping(ctx context.Context) (types.Ping, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "Ping"); err != nil {
+		return types.Ping{}, err
+	}
+	return types.Ping{APIVersion: APIVersion, OSType: e.OSType}, nil
+}
+
+// ClientVersion implements delixir.DockerAPI
+func (e *Engine) ClientVersion() string { return APIVersion }
+
+// Info implements delixir.DockerAPI
+func (e *Engine) Info(ctx context.Context) (system.Info, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "Info"); err != nil {
+		return system.Info{}, err
+	}
+	return system.Info{OSType: e.OSType, Architecture: e.Architecture}, nil
+}
+
+// ContainerList implements delixir.DockerAPI
+func (e *Engine) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerList"); err != nil {
+		return nil, err
+	}
+
+	var list []types.Container
+	for _, cont := range e.containers {
+		if !options.All && cont.State != StateRunning {
+			continue
+		}
+		if !hasLabels(cont.Config.Labels, options.Filters.Get("label")) {
+			continue
+		}
+		var ports []types.Port
+		if cont.State == StateRunning {
+			ports = publishedPorts(cont.HostConfig.PortBindings)
+		}
+		list = append(list, types.Container{
+			ID:      cont.ID,
+			Names:   []string{"/" + cont.Name},
+			Image:   cont.Image,
+			ImageID: cont.ImageID,
+			Labels:  cont.Config.Labels,
+			State:   cont.State,
+			Ports:   ports,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Names[0] < list[j].Names[0] })
+	return list, nil
+}
+
+// ContainerInspect implements delixir.DockerAPI
+func (e *Engine) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerInspect", containerID); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	cont := e.findContainer(containerID)
+	if cont == nil {
+		return types.ContainerJSON{}, notFound("no such container: %s", containerID)
+	}
+
+	state := &types.ContainerState{Status: cont.State, Running: cont.State == StateRunning}
+	if cont.Health != "" {
+		state.Health = &types.Health{Status: cont.Health}
+	}
+	config, hostConfig := cont.Config, cont.HostConfig
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         cont.ID,
+			Name:       "/" + cont.Name,
+			Image:      cont.ImageID,
+			State:      state,
+			HostConfig: &hostConfig,
+		},
+		Config: &config,
+	}, nil
+}
+
+// ContainerCreate implements delixir.DockerAPI
+func (e *Engine) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+	_ *network.NetworkingConfig, _ *ocispec.Platform, containerName string,
+) (container.CreateResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerCreate", containerName); err != nil {
+		return container.CreateResponse{}, err
+	}
+
+	if e.findContainer(containerName) != nil {
+		return container.CreateResponse{}, errdefs.Conflict(
+			fmt.Errorf("container name %q is already in use", "/"+containerName))
+	}
+	img := e.findImage(config.Image)
+	if img == nil {
+		return container.CreateResponse{}, notFound("no such image: %s", config.Image)
+	}
+
+	cont := &Container{
+		ID:      e.nextID("container"),
+		Name:    containerName,
+		Image:   config.Image,
+		ImageID: img.ID,
+		State:   StateCreated,
+		Config:  mergeImageConfig(*config, img.Config),
+	}
+	cont.Config.Env = append(slices.Clone(cont.Config.Env), e.RuntimeEnv...)
+	if hostConfig != nil {
+		cont.HostConfig = *hostConfig
+	}
+	e.containers[cont.ID] = cont
+	return container.CreateResponse{ID: cont.ID}, nil
+}
+
+// ContainerStart implements delixir.DockerAPI
+func (e *Engine) ContainerStart(ctx context.Context, containerID string, _ container.StartOptions) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerStart", containerID); err != nil {
+		return err
+	}
+	cont := e.findContainer(containerID)
+	if cont == nil {
+		return notFound("no such container: %s", containerID)
+	}
+	cont.State = StateRunning
+	if hc := cont.Config.Healthcheck; hc != nil && len(hc.Test) > 0 && hc.Test[0] != "NONE" {
+		cont.Health = types.Starting
+	}
+	e.emit(cont, events.ActionStart, nil)
+	return nil
+}
+
+// ContainerStop implements delixir.DockerAPI
+func (e *Engine) ContainerStop(ctx context.Context, containerID string, _ container.StopOptions) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerStop", containerID); err != nil {
+		return err
+	}
+	cont := e.findContainer(containerID)
+	if cont == nil {
+		return notFound("no such container: %s", containerID)
+	}
+	if cont.State == StateRunning {
+		cont.State = StateExited
+		e.emit(cont, events.ActionDie, map[string]string{"exitCode": "0"})
+		e.emit(cont, events.ActionStop, nil)
+	}
+	return nil
+}
+
+// ContainerRemove implements delixir.DockerAPI
+func (e *Engine) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerRemove", containerID); err != nil {
+		return err
+	}
+	cont := e.findContainer(containerID)
+	if cont == nil {
+		return notFound("no such container: %s", containerID)
+	}
+	if cont.State == StateRunning && !options.Force {
+		return errdefs.Conflict(fmt.Errorf("cannot remove running container %s", containerID))
+	}
+	delete(e.containers, cont.ID)
+	return nil
+}
+
+// ContainerRename implements delixir.DockerAPI
+func (e *Engine) ContainerRename(ctx context.Context, containerID, newContainerName string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerRename", containerID, newContainerName); err != nil {
+		return err
+	}
+	cont := e.findContainer(containerID)
+	if cont == nil {
+		return notFound("no such container: %s", containerID)
+	}
+	if other := e.findContainer(newContainerName); other != nil && other != cont {
+		return errdefs.Conflict(fmt.Errorf("container name %q is already in use", "/"+newContainerName))
+	}
+	cont.Name = newContainerName
+	return nil
+}
+
+// ContainerLogs implements delixir.DockerAPI. Only Tail option is supported, output is multiplexed as stdout
+func (e *Engine) ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ContainerLogs", containerID); err != nil {
+		return nil, err
+	}
+	cont := e.findContainer(containerID)
+	if cont == nil {
+		return nil, notFound("no such container: %s", containerID)
+	}
+
+	lines := cont.Logs
+	if tail, err := strconv.Atoi(options.Tail); err == nil && tail >= 0 && tail < len(lines) {
+		lines = lines[len(lines)-tail:]
+	}
+	var buf bytes.Buffer
+	w := stdcopy.NewStdWriter(&buf, stdcopy.Stdout)
+	for _, line := range lines {
+		_, _ = w.Write([]byte(line + "\n"))
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// ImagePull implements delixir.DockerAPI
+func (e *Engine) ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ImagePull", refStr); err != nil {
+		return nil, err
+	}
+	e.pullAuth[normalize(refStr)] = options.RegistryAuth
+	remote, ok := e.remote[normalize(refStr)]
+	if !ok {
+		return nil, notFound("manifest for %s not found: manifest unknown", refStr)
+	}
+	if remote.ID == "" {
+		// the image is pulled for the requested platform, as Docker does with manifest lists
+		if remote, ok = e.platformImage(remote, options.Platform); !ok {
+			return nil, notFound("no matching manifest for %s in the manifest list entries", options.Platform)
+		}
+	}
+	e.pull(refStr, remote)
+
+	var b strings.Builder
+	encoder := json.NewEncoder(&b)
+	_ = encoder.Encode(map[string]string{"status": "Pulling from " + e.repository(refStr)})
+	_ = encoder.Encode(map[string]string{"status": "Digest: " + remote.Digest})
+	_ = encoder.Encode(map[string]string{"status": "Status: Downloaded newer image for " + e.familiar(refStr)})
+	return io.NopCloser(strings.NewReader(b.String())), nil
+}
+
+// ImageList implements delixir.DockerAPI
+func (e *Engine) ImageList(ctx context.Context, _ image.ListOptions) ([]image.Summary, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ImageList"); err != nil {
+		return nil, err
+	}
+	list := make([]image.Summary, 0, len(e.images))
+	for _, img := range e.images {
+		list = append(list, image.Summary{
+			ID:          img.ID,
+			RepoTags:    append([]string(nil), img.RepoTags...),
+			RepoDigests: append([]string(nil), img.RepoDigests...),
+			Created:     img.Created,
+			Size:        img.Size,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created < list[j].Created })
+	return list, nil
+}
+
+// ImageInspectWithRaw implements delixir.DockerAPI
+func (e *Engine) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ImageInspectWithRaw", imageID); err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	img := e.findImage(imageID)
+	if img == nil {
+		return types.ImageInspect{}, nil, notFound("no such image: %s", imageID)
+	}
+	inspect := types.ImageInspect{
+		Config:      img.Config,
+		ID:          img.ID,
+		RepoTags:    append([]string(nil), img.RepoTags...),
+		RepoDigests: append([]string(nil), img.RepoDigests...),
+		Size:        img.Size,
+	}
+	raw, err := json.Marshal(inspect)
+	return inspect, raw, err
+}
+
+// ImageTag implements delixir.DockerAPI
+func (e *Engine) ImageTag(ctx context.Context, source, target string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ImageTag", source, target); err != nil {
+		return err
+	}
+	img := e.findImage(source)
+	if img == nil {
+		return notFound("no such image: %s", source)
+	}
+	tag := e.familiar(target)
+	for _, other := range e.images {
+		other.RepoTags = removeString(other.RepoTags, tag)
+	}
+	img.RepoTags = appendUnique(img.RepoTags, tag)
+	return nil
+}
+
+// ImageRemove implements delixir.DockerAPI
+func (e *Engine) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ImageRemove", imageID); err != nil {
+		return nil, err
+	}
+	img := e.findImage(imageID)
+	if img == nil {
+		return nil, notFound("no such image: %s", imageID)
+	}
+	for _, cont := range e.containers {
+		if cont.ImageID == img.ID && !options.Force {
+			return nil, errdefs.Conflict(fmt.Errorf("image %s is being used by container %s", img.ID, cont.ID))
+		}
+	}
+	delete(e.images, img.ID)
+	return []image.DeleteResponse{{Deleted: img.ID}}, nil
+}
+
+// ImagesPrune implements delixir.DockerAPI. Images without tags and digests are considered dangling,
+// "label" filters are applied
+func (e *Engine) ImagesPrune(ctx context.Context, pruneFilters filters.Args) (image.PruneReport, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.call(ctx, "ImagesPrune"); err != nil {
+		return image.PruneReport{}, err
+	}
+
+	inUse := make(map[string]bool)
+	for _, cont := range e.containers {
+		inUse[cont.ImageID] = true
+	}
+	var report image.PruneReport
+	for id, img := range e.images {
+		var labels map[string]string
+		if img.Config != nil {
+			labels = img.Config.Labels
+		}
+		if len(img.RepoTags) == 0 && len(img.RepoDigests) == 0 && !inUse[id] &&
+			hasLabels(labels, pruneFilters.Get("label")) {
+			delete(e.images, id)
+			report.ImagesDeleted = append(report.ImagesDeleted, image.DeleteResponse{Deleted: id})
+			report.SpaceReclaimed += uint64(img.Size)
+		}
+	}
+	return report, nil
+}
+
+// hasLabels returns whether labels match all label filters, either "key" or "key=value"
+func hasLabels(labels map[string]string, labelFilters []string) bool {
+	for _, f := range labelFilters {
+		key, value, withValue := strings.Cut(f, "=")
+		if v, ok := labels[key]; !ok || (withValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// publishedPorts lists host ports of the port bindings like Docker lists ports of running containers
+func publishedPorts(bindings nat.PortMap) []types.Port {
+	var ports []types.Port
+	for port, hostBindings := range bindings {
+		for _, b := range hostBindings {
+			hostPort, _ := strconv.ParseUint(b.HostPort, 10, 16)
+			ports = append(ports, types.Port{
+				IP:          b.HostIP,
+				PrivatePort: uint16(port.Int()),
+				PublicPort:  uint16(hostPort),
+				Type:        port.Proto(),
+			})
+		}
+	}
+	return ports
+}
+
+// mergeImageConfig adds environment variables and the health check of the image to the container configuration
+// like Docker does
+func mergeImageConfig(config container.Config, image *container.Config) container.Config {
+	if image == nil {
+		return config
+	}
+	env := make([]string, 0, len(image.Env)+len(config.Env))
+	for _, kv := range image.Env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.ContainsFunc(config.Env, func(s string) bool { return strings.HasPrefix(s, name+"=") }) {
+			env = append(env, kv)
+		}
+	}
+	config.Env = append(env, config.Env...)
+	if config.Healthcheck == nil {
+		config.Healthcheck = image.Healthcheck
+	}
+	return config
+}
+
+func removeString(values []string, s string) []string {
+	result := values[:0]
+	for _, v := range values {
+		if v != s {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func appendUnique(values []string, s string) []string {
+	for _, v := range values {
+		if v == s {
+			return values
+		}
+	}
+	return append(values, s)
+}
@@ -0,0 +1,131 @@
+package dockertest
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// subscription is an events stream opened by Events
+type subscription struct {
+	filters  filters.Args
+	messages chan events.Message
+	errs     chan error
+}
+
+// matches returns whether the container event passes subscription filters, like Docker daemon does
+func (sub *subscription) matches(msg events.Message) bool {
+	if !sub.filters.ExactMatch("type", string(msg.Type)) {
+		return false
+	}
+	if !sub.filters.ExactMatch("container", msg.Actor.ID) &&
+		!sub.filters.ExactMatch("container", msg.Actor.Attributes["name"]) {
+		return false
+	}
+	if sub.filters.FuzzyMatch("event", string(events.ActionHealthStatus)) {
+		return sub.filters.FuzzyMatch("event", string(msg.Action))
+	}
+	return sub.filters.ExactMatch("event", string(msg.Action))
+}
+
+// Events implements delixir.DockerAPI. Since and Until options are ignored: only new events are sent.
+// The stream ends with ctx error when ctx is done, or with the error passed to BreakEvents
+func (e *Engine) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sub := &subscription{
+		filters:  options.Filters,
+		messages: make(chan events.Message, 64),
+		errs:     make(chan error, 1),
+	}
+	if err := e.call(ctx, "Events"); err != nil {
+		sub.errs <- err
+		return sub.messages, sub.errs
+	}
+	e.events = append(e.events, sub)
+
+	go func() {
+		<-ctx.Done()
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.unsubscribe(sub) {
+			sub.errs <- ctx.Err()
+		}
+	}()
+	return sub.messages, sub.errs
+}
+
+// unsubscribe removes the subscription and returns whether it was active
+func (e *Engine) unsubscribe(sub *subscription) bool {
+	for i, s := range e.events {
+		if s == sub {
+			e.events = append(e.events[:i], e.events[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribers returns the number of active events streams
+func (e *Engine) Subscribers() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.events)
+}
+
+// BreakEvents ends all active events streams with err, like a lost daemon connection does
+func (e *Engine) BreakEvents(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, sub := range e.events {
+		sub.errs <- err
+	}
+	e.events = nil
+}
+
+// Emit sends the event of the container with the name to matching events streams
+func (e *Engine) Emit(name string, action events.Action, attributes map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cont := e.findContainer(name); cont != nil {
+		e.emit(cont, action, attributes)
+	}
+}
+
+// Crash makes the running container with the name exit with the code, emitting die event
+func (e *Engine) Crash(name string, exitCode int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cont := e.findContainer(name); cont != nil {
+		cont.State = StateExited
+		e.emit(cont, events.ActionDie, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+	}
+}
+
+// emit sends the container event to matching subscriptions, e.mu should be held.
+// Events are dropped if a subscriber doesn't keep up
+func (e *Engine) emit(cont *Container, action events.Action, attributes map[string]string) {
+	attrs := map[string]string{"name": cont.Name, "image": cont.Image}
+	for k, v := range attributes {
+		attrs[k] = v
+	}
+	e.eventTime++
+	msg := events.Message{
+		Type:     events.ContainerEventType,
+		Action:   action,
+		Actor:    events.Actor{ID: cont.ID, Attributes: attrs},
+		Scope:    "local",
+		TimeNano: e.eventTime,
+	}
+	for _, sub := range e.events {
+		if !sub.matches(msg) {
+			continue
+		}
+		select {
+		case sub.messages <- msg:
+		default:
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package dockertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// media types of the manifests served by the fake registry
+const (
+	manifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	indexMediaType    = "application/vnd.oci.image.index.v1+json"
+)
+
+// registryToken is the bearer token issued by the fake registry token endpoint
+const registryToken = "dockertest-token"
+
+// registryAuth represents the authentication the fake registry demands
+type registryAuth struct {
+	scheme             string
+	username, password string
+}
+
+// RequireAuth makes the fake registry demand authentication with the scheme, "basic" or "bearer".
+// Bearer tokens are issued at /token for the username and password, or anonymously if the username is empty.
+// Empty scheme disables authentication
+func (e *Engine) RequireAuth(scheme, username, password string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.auth = registryAuth{scheme: scheme, username: username, password: password}
+}
+
+// authorized returns whether the request carries the credentials the registry demands
+func (a registryAuth) authorized(r *http.Request) bool {
+	switch a.scheme {
+	case "basic":
+		username, password, ok := r.BasicAuth()
+		return ok && username == a.username && password == a.password
+	case "bearer":
+		return r.Header.Get("Authorization") == "Bearer "+registryToken
+	}
+	return true
+}
+
+// challenge sets WWW-Authenticate header for the repository and responds with 401 Unauthorized
+func (a registryAuth) challenge(w http.ResponseWriter, r *http.Request, repo string) {
+	if a.scheme == "basic" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dockertest"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="dockertest",scope="repository:%s:pull"`,
+			r.Host, repo))
+	}
+	http.Error(w, `{"errors":[{"code":"UNAUTHORIZED"}]}`, http.StatusUnauthorized)
+}
+
+// serveToken issues the bearer token like Docker Registry token authentication does
+func (e *Engine) serveToken(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := e.call(r.Context(), "RegistryToken", query.Get("service"), query.Get("scope")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if e.auth.username != "" {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != e.auth.username || password != e.auth.password {
+			http.Error(w, `{"details":"incorrect username or password"}`, http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": registryToken})
+}
+
+// SetRateLimit makes the fake registry report remaining pulls in RateLimit-Remaining header.
+// Negative value disables the header
+func (e *Engine) SetRateLimit(remaining int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rateLimit = &remaining
+	if remaining < 0 {
+		e.rateLimit = nil
+	}
+}
+
+// RegistryURL returns a function suitable for delixir.DockerClientParams.RegistryURL,
+// routing all registry hosts to the fake registry served at serverURL.
+// The host is passed as the first path element, so the registry serves only images published under it
+func RegistryURL(serverURL string) func(string) string {
+	return func(host string) string { return serverURL + "/" + host }
+}
+
+// ServeHTTP serves the manifests of published images like Docker Registry HTTP API V2 does
+// at /<host>/v2/<repository>/manifests/<reference>, and the token endpoint at /token
+func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		e.serveToken(w, r)
+		return
+	}
+	host, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/v2/")
+	repo, ref, ok := strings.Cut(path, "/manifests/")
+	if !ok || host == "" || (r.Method != http.MethodHead && r.Method != http.MethodGet) {
+		http.NotFound(w, r)
+		return
+	}
+	if err := e.call(r.Context(), "Registry"+r.Method, host+"/"+repo, ref); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !e.auth.authorized(r) {
+		e.auth.challenge(w, r, repo)
+		return
+	}
+	if e.rateLimit != nil {
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(*e.rateLimit)+";w=21600")
+	}
+
+	for key, remote := range e.remote {
+		named, err := reference.ParseNormalizedNamed(key)
+		if err != nil || reference.Domain(named) != host || reference.Path(named) != repo {
+			continue
+		}
+		platforms := e.indexes[remote.Digest]
+		tagged, isTagged := named.(reference.Tagged)
+		if ref == remote.Digest || isTagged && ref == tagged.Tag() {
+			if platforms == nil {
+				writeManifest(w, r, manifestMediaType, remote.Digest, imageManifest(remote.ID))
+				return
+			}
+			manifests := make([]map[string]any, 0, len(platforms))
+			for _, p := range platforms {
+				manifests = append(manifests, map[string]any{
+					"mediaType": manifestMediaType,
+					"digest":    p.Digest,
+					"platform":  p.Platform,
+				})
+			}
+			writeManifest(w, r, indexMediaType, remote.Digest, map[string]any{
+				"schemaVersion": 2,
+				"mediaType":     indexMediaType,
+				"manifests":     manifests,
+			})
+			return
+		}
+		for _, p := range platforms {
+			if ref == p.Digest {
+				writeManifest(w, r, manifestMediaType, p.Digest, imageManifest(p.ID))
+				return
+			}
+		}
+	}
+	http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+}
+
+// imageManifest returns the single-platform image manifest with the config digest
+func imageManifest(configDigest string) map[string]any {
+	return map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     manifestMediaType,
+		"config":        map[string]string{"digest": configDigest},
+	}
+}
+
+// writeManifest responds with the manifest, writing the body for GET requests only
+func writeManifest(w http.ResponseWriter, r *http.Request, mediaType, digest string, manifest map[string]any) {
+	body, _ := json.Marshal(manifest)
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(body)
+	}
+}
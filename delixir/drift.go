@@ -0,0 +1,103 @@
+package delixir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// reloadEnv re-reads the env file if it is configured, keeping the previous variables if it fails
+func (dc *DockerClient) reloadEnv() {
+	if dc.envFilePath == "" {
+		return
+	}
+	envVars, _, err := ParseEnvFile(dc.envFilePath)
+	if err != nil {
+		log.Printf("Error reading env file, using the previous variables: %v", err)
+		return
+	}
+	dc.envVars = envVars
+}
+
+// containerDrift returns differences of the container settings from the desired ones, see specChanges
+func (dc *DockerClient) containerDrift(ctx context.Context, current ContainerData) ([]string, error) {
+	info, err := dc.cli.ContainerInspect(ctx, current.ContainerID)
+	if err != nil {
+		return nil, fmt.Errorf("error inspecting container: %v", err)
+	}
+	var imageConfig *container.Config
+	if image, _, err := dc.cli.ImageInspectWithRaw(ctx, current.ImageID); err == nil {
+		imageConfig = image.Config
+	}
+	config, hostConfig, err := dc.containerSpec(dc.imageName, "")
+	if err != nil {
+		return nil, err
+	}
+	return specChanges(info, imageConfig, config, hostConfig), nil
+}
+
+// reconcileDrift recreates the container if its settings differ from the desired ones.
+// It returns false if the container has no drift, so nothing was done
+func (dc *DockerClient) reconcileDrift(ctx context.Context, current ContainerData) bool {
+	changes, err := dc.containerDrift(ctx, current)
+	if err != nil {
+		log.Printf("Error checking container configuration: %v", err)
+		return false
+	}
+	if len(changes) == 0 {
+		return false
+	}
+
+	fmt.Printf("Container configuration drifted, recreating it:\n  %s\n", strings.Join(changes, "\n  "))
+	if err := dc.reconcile(ctx, current); errors.Is(err, ErrVetoed) {
+		log.Printf("Not recreating container: %v", err)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("applying configuration to container %q was vetoed: %v",
+			dc.containerName, err))
+		return true
+	} else if err != nil {
+		log.Printf("Error recreating container: %v", err)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("failed to apply configuration to container %q: %v\n%s",
+			dc.containerName, err, strings.Join(changes, "\n")))
+		return true
+	}
+	dc.notifier.SendBroadcastMessage(fmt.Sprintf("container %q was recreated to apply configuration changes:\n%s",
+		dc.containerName, strings.Join(changes, "\n")))
+	return true
+}
+
+// reconcile recreates the container from the same image with the desired settings and waits for it
+// to become healthy. There is no rollback: the previous settings are not desired anymore
+func (dc *DockerClient) reconcile(ctx context.Context, current ContainerData) error {
+	event := HookEvent{
+		Point:          HookBeforeStop,
+		ContainerID:    current.ContainerID,
+		CurrentImageID: current.ImageID,
+		NewImage:       current.ImageID,
+	}
+	if err := dc.runPreHooks(ctx, event); err != nil {
+		return err
+	}
+	defer dc.beginSwap()()
+
+	containerID, err := dc.updateContainer(ctx, dc.imageName)
+	if err != nil {
+		return err
+	}
+	event.Point, event.ContainerID = HookAfterStart, containerID
+	dc.runPostHooks(ctx, event)
+	err = dc.waitHealthy(ctx, containerID)
+	if err == nil {
+		event.Point = HookAfterHealthy
+		dc.runPostHooks(ctx, event)
+		return nil
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+	dc.alert(ctx, containerID, fmt.Sprintf("container is not healthy after applying configuration changes: %v", err))
+	return err
+}
@@ -0,0 +1,167 @@
+package delixir_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+func TestCheckAndUpdateContainerDrift(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	first, _ := newTestClient(t, engine)
+	first.CheckAndUpdateContainer(context.Background())
+	old := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+
+	dc, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) {
+		p.EnvVars = []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=renamed"}
+		p.Port = "17691"
+		p.RestartPolicy = "always"
+	})
+	dc.CheckAndUpdateContainer(context.Background())
+
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if cont.ID == old.ID {
+		t.Fatalf("container was not recreated")
+	}
+	if !slices.Equal(cont.Config.Env, []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=renamed"}) {
+		t.Errorf("container env is %v", cont.Config.Env)
+	}
+	if cont.HostConfig.RestartPolicy.Name != "always" {
+		t.Errorf("restart policy is %q", cont.HostConfig.RestartPolicy.Name)
+	}
+	for _, expected := range []string{
+		"recreated to apply configuration changes",
+		`env STRATEGY_EXECUTOR_DISPLAY_NAME: "test" -> "renamed"`,
+		"ports: 0.0.0.0:17690->17690/tcp -> 0.0.0.0:17691->17691/tcp",
+		"restart policy: unless-stopped -> always",
+	} {
+		if !notifier.Contains(expected) {
+			t.Errorf("notification doesn't contain %q: %v", expected, notifier.Messages())
+		}
+	}
+
+	notifier.Reset()
+	dc.CheckAndUpdateContainer(context.Background())
+	if n := engine.CallCount("ContainerCreate"); n != 2 {
+		t.Errorf("container was created %d times, expected 2", n)
+	}
+	if len(notifier.Messages()) != 0 {
+		t.Errorf("unexpected notifications: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerImageConfigIsNotDrift(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	engine.SetImageConfig(testImage, container.Config{
+		Env:         []string{"PATH=/usr/local/bin:/usr/bin", "NODE_ENV=production", "STRATEGY_EXECUTOR_DISPLAY_NAME=image"},
+		Healthcheck: &container.HealthConfig{Test: []string{"CMD", "true"}},
+	})
+	dc, notifier := newTestClient(t, engine)
+	dc.CheckAndUpdateContainer(context.Background())
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ContainerCreate"); n != 1 {
+		t.Errorf("container was created %d times, expected once", n)
+	}
+	if notifier.Contains("configuration") {
+		t.Errorf("unexpected drift notification: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerEnvFileChange(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "validator.env")
+	writeEnv := func(content string) {
+		if err := os.WriteFile(envFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeEnv("STRATEGY_EXECUTOR_DISPLAY_NAME=test\nSIGNER_PRIVATE_KEY=0xold\n")
+
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) { p.EnvFilePath = envFile })
+	dc.CheckAndUpdateContainer(context.Background())
+
+	writeEnv("STRATEGY_EXECUTOR_DISPLAY_NAME=test\nSIGNER_PRIVATE_KEY=0xnew\n")
+	notifier.Reset()
+	dc.CheckAndUpdateContainer(context.Background())
+
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if !slices.Contains(cont.Config.Env, "SIGNER_PRIVATE_KEY=0xnew") {
+		t.Errorf("container env is %v", cont.Config.Env)
+	}
+	if !notifier.Contains("env SIGNER_PRIVATE_KEY: (hidden) -> (hidden)") {
+		t.Errorf("env change is not notified: %v", notifier.Messages())
+	}
+	if notifier.Contains("0xnew") || notifier.Contains("0xold") {
+		t.Errorf("notification reveals the key: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerRuntimeEnvIsNotDrift(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.RuntimeEnv = []string{"container=podman", "HOSTNAME=validator"}
+	remote := engine.Publish(testImage)
+	envFile := filepath.Join(t.TempDir(), "validator.env")
+	if err := os.WriteFile(envFile, []byte("STRATEGY_EXECUTOR_DISPLAY_NAME=test\nEXTRA=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dc, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) { p.EnvFilePath = envFile })
+	dc.CheckAndUpdateContainer(context.Background())
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ContainerCreate"); n != 1 {
+		t.Errorf("container was created %d times, expected once: %v", n, notifier.Messages())
+	}
+
+	// variables removed from the env file are still drift
+	if err := os.WriteFile(envFile, []byte("STRATEGY_EXECUTOR_DISPLAY_NAME=test\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	notifier.Reset()
+	dc.CheckAndUpdateContainer(context.Background())
+	if !notifier.Contains("env EXTRA: removed") {
+		t.Errorf("removed variable is not notified: %v", notifier.Messages())
+	}
+	if notifier.Contains("env container") || notifier.Contains("env HOSTNAME") {
+		t.Errorf("runtime variables are reported: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerLegacyRuntimeEnvIsNotDrift(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	// created by an earlier version without the env names label, published on all interfaces without the explicit
+	// host IP
+	engine.AddContainer(testContainerName, testImage, dockertest.StateRunning)
+	port := nat.Port("17690/tcp")
+	engine.SetContainerConfig(testContainerName, container.Config{
+		Image:        testImage,
+		Env:          []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=test", "container=podman"},
+		ExposedPorts: nat.PortSet{port: struct{}{}},
+	}, container.HostConfig{
+		PortBindings:  nat.PortMap{port: []nat.PortBinding{{HostPort: "17690"}}},
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyUnlessStopped},
+	})
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ContainerCreate"); n != 0 {
+		t.Errorf("container was created %d times, expected none: %v", n, notifier.Messages())
+	}
+}
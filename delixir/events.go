@@ -0,0 +1,250 @@
+package delixir
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// crash policies
+const (
+	CrashNotify  = "notify"
+	CrashRestart = "restart"
+)
+
+// default crash loop detection parameters
+const (
+	DefaultCrashLoopLimit  = 3
+	DefaultCrashLoopWindow = 10 * time.Minute
+)
+
+// CrashParams represents reaction to validator container crashes
+type CrashParams struct {
+	// Policy is CrashNotify or CrashRestart, the latter also starts the exited container. Defaults to CrashNotify
+	Policy string
+	// LoopLimit crashes within LoopWindow are treated as a crash loop, which stops automatic restarts
+	LoopLimit  int
+	LoopWindow time.Duration
+}
+
+// crashState tracks validator container crashes and health status reported by Docker events
+type crashState struct {
+	mu           sync.Mutex
+	crashes      []time.Time
+	loopReported bool
+	unhealthy    bool
+	// stopping contains IDs of containers stopped by the updater itself, their exits are not crashes
+	stopping map[string]bool
+}
+
+// expectStop marks the container as being stopped by the updater
+func (dc *DockerClient) expectStop(containerID string) {
+	dc.crash.mu.Lock()
+	defer dc.crash.mu.Unlock()
+	if dc.crash.stopping == nil {
+		dc.crash.stopping = make(map[string]bool)
+	}
+	dc.crash.stopping[containerID] = true
+}
+
+// recordCrash registers the crash and returns the number of crashes within the loop window,
+// and whether the crash loop was detected just now
+func (dc *DockerClient) recordCrash() (int, bool) {
+	dc.crash.mu.Lock()
+	defer dc.crash.mu.Unlock()
+	dc.crash.crashes = append(dc.crash.crashes, dc.clock.Now())
+	n := dc.recentCrashesLocked()
+	if n < dc.crashParams.LoopLimit {
+		dc.crash.loopReported = false
+		return n, false
+	}
+	detected := !dc.crash.loopReported
+	dc.crash.loopReported = true
+	return n, detected
+}
+
+// recentCrashesLocked drops crashes outside the loop window and returns the number of remaining ones
+func (dc *DockerClient) recentCrashesLocked() int {
+	since := dc.clock.Now().Add(-dc.crashParams.LoopWindow)
+	recent := dc.crash.crashes[:0]
+	for _, t := range dc.crash.crashes {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+	dc.crash.crashes = recent
+	return len(recent)
+}
+
+// CrashLooping returns whether the validator container crashed at least the loop limit times within the loop window
+func (dc *DockerClient) CrashLooping() bool {
+	dc.crash.mu.Lock()
+	defer dc.crash.mu.Unlock()
+	return dc.recentCrashesLocked() >= dc.crashParams.LoopLimit
+}
+
+// WatchEvents subscribes to Docker events of the validator container and reacts to crashes, OOM kills,
+// restarts and health status changes until ctx is done. The subscription is renewed with backoff after errors
+func (dc *DockerClient) WatchEvents(ctx context.Context) {
+	var since string
+	var lastEvent int64
+	backoff := daemonBackoffMin
+	for {
+		if since == "" {
+			since = unixNano(dc.clock.Now().UnixNano())
+		}
+		messages, errs := dc.cli.Events(ctx, events.ListOptions{
+			Since: since,
+			Filters: filters.NewArgs(
+				filters.Arg("type", string(events.ContainerEventType)),
+				filters.Arg("container", dc.containerName),
+				filters.Arg("event", string(events.ActionDie)),
+				filters.Arg("event", string(events.ActionOOM)),
+				filters.Arg("event", string(events.ActionRestart)),
+				filters.Arg("event", string(events.ActionHealthStatus)),
+			),
+		})
+
+		var err error
+	receive:
+		for {
+			select {
+			case msg := <-messages:
+				backoff = daemonBackoffMin
+				if msg.TimeNano != 0 && msg.TimeNano <= lastEvent {
+					continue // replayed after resubscription
+				}
+				lastEvent = msg.TimeNano
+				since = unixNano(lastEvent)
+				dc.handleEvent(ctx, msg)
+			case err = <-errs:
+				break receive
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Docker events stream failed, resubscribing in %s: %v", backoff, err)
+		select {
+		case <-dc.clock.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, daemonBackoffMax)
+	}
+}
+
+// unixNano formats Unix time in nanoseconds as Docker API timestamp
+func unixNano(ns int64) string {
+	return fmt.Sprintf("%d.%09d", ns/int64(time.Second), ns%int64(time.Second))
+}
+
+// handleEvent reacts to the validator container event
+func (dc *DockerClient) handleEvent(ctx context.Context, msg events.Message) {
+	name := dc.containerName
+	switch {
+	case msg.Action == events.ActionDie:
+		dc.handleDie(ctx, msg)
+	case msg.Action == events.ActionOOM:
+		log.Printf("Container %q was killed by OOM killer", name)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("container %q was killed: out of memory", name))
+	case msg.Action == events.ActionRestart:
+		log.Printf("Container %q was restarted", name)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("container %q was restarted", name))
+	case strings.HasPrefix(string(msg.Action), string(events.ActionHealthStatus)):
+		dc.handleHealthStatus(ctx, msg)
+	}
+}
+
+// handleDie notifies about the container exit, unless it was stopped by the updater,
+// and restarts the container according to the crash policy
+func (dc *DockerClient) handleDie(ctx context.Context, msg events.Message) {
+	dc.crash.mu.Lock()
+	expected := dc.crash.stopping[msg.Actor.ID]
+	delete(dc.crash.stopping, msg.Actor.ID)
+	dc.crash.mu.Unlock()
+	if expected {
+		return
+	}
+
+	exitCode := msg.Actor.Attributes["exitCode"]
+	crashes, loopDetected := dc.recordCrash()
+	log.Printf("Container %q exited with code %s, %d crashes within %s",
+		dc.containerName, exitCode, crashes, dc.crashParams.LoopWindow)
+
+	dc.alert(ctx, msg.Actor.ID, fmt.Sprintf("container %q exited with code %s", dc.containerName, exitCode))
+
+	if dc.crashParams.Policy != CrashRestart {
+		return
+	}
+	if crashes >= dc.crashParams.LoopLimit {
+		if loopDetected {
+			dc.notifier.SendBroadcastMessage(fmt.Sprintf(
+				"container %q is crash looping: %d crashes within %s, automatic restarts are stopped",
+				dc.containerName, crashes, dc.crashParams.LoopWindow))
+		}
+		return
+	}
+	if err := dc.restartCrashed(ctx, msg.Actor.ID); err != nil {
+		log.Printf("Error restarting crashed container: %v", err)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("failed to restart container %q: %v", dc.containerName, err))
+	}
+}
+
+// restartCrashed starts the crashed container if it is still exited and no update operation is in progress
+func (dc *DockerClient) restartCrashed(ctx context.Context, containerID string) error {
+	if !dc.opMu.TryLock() {
+		log.Println("Update operation is in progress, not restarting the crashed container")
+		return nil
+	}
+	defer dc.opMu.Unlock()
+
+	current, err := dc.getCurrentContainerData(ctx)
+	if err != nil {
+		return err
+	}
+	if current.ContainerID != containerID || current.State != containerStateExited {
+		log.Printf("Container is %q now, not restarting it", current.State)
+		return nil
+	}
+
+	defer dc.beginSwap()()
+	if err := dc.containerStart(ctx, containerID); err != nil {
+		return err
+	}
+	dc.notifier.SendBroadcastMessage(fmt.Sprintf("container %q was restarted after crash", dc.containerName))
+	return nil
+}
+
+// handleHealthStatus notifies when the container becomes unhealthy and when it recovers.
+// Changes during update are tracked but not notified
+func (dc *DockerClient) handleHealthStatus(ctx context.Context, msg events.Message) {
+	unhealthy := msg.Action == events.ActionHealthStatusUnhealthy
+	dc.crash.mu.Lock()
+	changed := dc.crash.unhealthy != unhealthy
+	dc.crash.unhealthy = unhealthy
+	dc.crash.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	status := "healthy again"
+	if unhealthy {
+		status = "unhealthy"
+	}
+	log.Printf("Container %q is %s", dc.containerName, status)
+	switch {
+	case dc.UpdateInProgress():
+	case unhealthy:
+		dc.alert(ctx, msg.Actor.ID, fmt.Sprintf("container %q is %s", dc.containerName, status))
+	default:
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("container %q is %s", dc.containerName, status))
+	}
+}
@@ -0,0 +1,158 @@
+package delixir_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+)
+
+// watchEvents installs the validator container and watches its events until the test ends
+func watchEvents(t *testing.T, engine *dockertest.Engine, clock *harness.Clock,
+	options ...func(*delixir.DockerClientParams),
+) (*delixir.DockerClient, *harness.Recorder, dockertest.RemoteImage) {
+	t.Helper()
+	remote := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine, append(options, func(p *delixir.DockerClientParams) {
+		p.Clock = clock
+	})...)
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	notifier.Reset()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dc.WatchEvents(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	harness.WaitFor(t, time.Second, func() bool { return engine.Subscribers() == 1 }, "events subscription")
+	return dc, notifier, remote
+}
+
+func TestWatchEventsCrashNotify(t *testing.T) {
+	engine := dockertest.NewEngine()
+	_, notifier, remote := watchEvents(t, engine, harness.NewClock(harness.Start),
+		func(p *delixir.DockerClientParams) { p.Logs = delixir.LogsParams{Lines: 2} })
+
+	engine.AppendLogs(testContainerName, "starting validator", "connecting to RPC", "synced block 42")
+	engine.Crash(testContainerName, 2)
+	harness.WaitFor(t, time.Second, func() bool { return notifier.Contains("exited with code 2") },
+		"crash notification")
+
+	msg := notifier.Messages()[0]
+	for _, want := range []string{"last log lines:", "connecting to RPC", "synced block 42"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("crash notification doesn't contain %q: %q", want, msg)
+		}
+	}
+	if strings.Contains(msg, "starting validator") {
+		t.Errorf("crash notification contains more log lines than configured: %q", msg)
+	}
+	requireContainer(t, engine, remote.ID, dockertest.StateExited)
+}
+
+func TestWatchEventsCrashRestart(t *testing.T) {
+	engine := dockertest.NewEngine()
+	clock := harness.NewClock(harness.Start)
+	dc, notifier, remote := watchEvents(t, engine, clock, func(p *delixir.DockerClientParams) {
+		p.Crash = delixir.CrashParams{Policy: delixir.CrashRestart, LoopLimit: 3, LoopWindow: 10 * time.Minute}
+	})
+
+	for i := 1; i <= 2; i++ {
+		engine.Crash(testContainerName, 1)
+		harness.WaitFor(t, time.Second, func() bool { return notifier.Count("restarted after crash") == i },
+			"restart #%d", i)
+		requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+		clock.Advance(time.Minute)
+	}
+
+	engine.Crash(testContainerName, 1)
+	harness.WaitFor(t, time.Second, func() bool { return notifier.Contains("crash looping: 3 crashes") },
+		"crash loop notification")
+	requireContainer(t, engine, remote.ID, dockertest.StateExited)
+	if !dc.CrashLooping() {
+		t.Errorf("expected crash loop to be reported")
+	}
+
+	// the periodic check doesn't start the crash looping container too
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, remote.ID, dockertest.StateExited)
+
+	clock.Advance(10 * time.Minute)
+	if dc.CrashLooping() {
+		t.Errorf("expected crash loop to end after the loop window")
+	}
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+}
+
+func TestWatchEventsIgnoresUpdates(t *testing.T) {
+	engine := dockertest.NewEngine()
+	dc, notifier, _ := watchEvents(t, engine, harness.NewClock(harness.Start), func(p *delixir.DockerClientParams) {
+		p.Crash = delixir.CrashParams{Policy: delixir.CrashRestart}
+	})
+
+	second := engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, second.ID, dockertest.StateRunning)
+
+	engine.Emit(testContainerName, events.ActionOOM, nil)
+	harness.WaitFor(t, time.Second, func() bool { return notifier.Contains("out of memory") }, "OOM notification")
+	if notifier.Contains("exited with code") || notifier.Contains("restarted after crash") {
+		t.Errorf("container stop by the updater was treated as a crash: %v", notifier.Messages())
+	}
+}
+
+func TestWatchEventsHealthStatus(t *testing.T) {
+	engine := dockertest.NewEngine()
+	clock := harness.NewClock(harness.Start)
+	_, notifier, _ := watchEvents(t, engine, clock)
+	clock.Advance(delixir.DefaultUpdateGracePeriod)
+
+	engine.Emit(testContainerName, events.ActionHealthStatusHealthy, nil)
+	engine.Emit(testContainerName, events.ActionHealthStatusUnhealthy, nil)
+	engine.Emit(testContainerName, events.ActionHealthStatusUnhealthy, nil)
+	engine.Emit(testContainerName, events.ActionHealthStatusHealthy, nil)
+	harness.WaitFor(t, time.Second, func() bool { return notifier.Contains("is healthy again") },
+		"recovery notification")
+	if n := notifier.Count("is unhealthy"); n != 1 {
+		t.Errorf("expected 1 unhealthy notification, got: %v", notifier.Messages())
+	}
+}
+
+func TestWatchEventsResubscribes(t *testing.T) {
+	engine := dockertest.NewEngine()
+	clock := harness.NewClock(harness.Start)
+	_, notifier, _ := watchEvents(t, engine, clock)
+
+	engine.FailOn("Events", errors.New("connection refused"))
+	engine.BreakEvents(errors.New("unexpected EOF"))
+	if !clock.WaitForWaiters(1, time.Second) {
+		t.Fatalf("resubscription backoff was not scheduled")
+	}
+	clock.Advance(time.Second)
+	if !clock.WaitForWaiters(1, time.Second) {
+		t.Fatalf("resubscription backoff was not scheduled after failed attempt")
+	}
+	if engine.Subscribers() != 0 {
+		t.Fatalf("expected failed resubscription")
+	}
+	engine.FailOn("Events", nil)
+	clock.Advance(2 * time.Second)
+	harness.WaitFor(t, time.Second, func() bool { return engine.Subscribers() == 1 }, "events resubscription")
+
+	engine.Emit(testContainerName, events.ActionRestart, nil)
+	harness.WaitFor(t, time.Second, func() bool { return notifier.Contains("was restarted") },
+		"restart notification after resubscription")
+}
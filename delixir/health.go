@@ -0,0 +1,116 @@
+package delixir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// default Docker health check parameters of the validator container
+const (
+	DefaultHealthcheckInterval    = 30 * time.Second
+	DefaultHealthcheckTimeout     = 10 * time.Second
+	DefaultHealthcheckStartPeriod = time.Minute
+	DefaultHealthcheckRetries     = 3
+)
+
+// healthPollInterval is the interval of container health polling while waiting for it after update
+const healthPollInterval = 5 * time.Second
+
+// HealthcheckParams represents Docker health check of the validator container
+type HealthcheckParams struct {
+	// Test is the health check command in Docker format, e.g. {"CMD-SHELL", "curl -f ..."}. Empty disables it
+	Test        []string
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+	// Wait is the time to wait for the container to become healthy after update before rolling it back,
+	// zero disables waiting
+	Wait time.Duration
+}
+
+// DefaultHealthcheckTest returns the health check command requesting the validator health endpoint on the port
+// with curl or wget, whichever is available in the image
+func DefaultHealthcheckTest(port string) []string {
+	url := fmt.Sprintf("http://localhost:%s/health", port)
+	return []string{"CMD-SHELL", fmt.Sprintf("curl -fsS %[1]s >/dev/null || wget -qO /dev/null %[1]s || exit 1", url)}
+}
+
+// healthConfig returns container health check configuration, nil if it is disabled
+func (dc *DockerClient) healthConfig() *container.HealthConfig {
+	hc := dc.healthcheck
+	if len(hc.Test) == 0 {
+		return nil
+	}
+	return &container.HealthConfig{
+		Test:        hc.Test,
+		Interval:    hc.Interval,
+		Timeout:     hc.Timeout,
+		StartPeriod: hc.StartPeriod,
+		Retries:     hc.Retries,
+	}
+}
+
+// containerHealth returns Docker health status of the container, types.NoHealthcheck if it has no health check
+func (dc *DockerClient) containerHealth(ctx context.Context, containerID string) (string, error) {
+	info, err := dc.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+	if info.State == nil || info.State.Health == nil || info.State.Health.Status == "" {
+		return types.NoHealthcheck, nil
+	}
+	return info.State.Health.Status, nil
+}
+
+// ContainerHealth returns Docker health status of the validator container: starting, healthy, unhealthy,
+// or none if the container has no health check
+func (dc *DockerClient) ContainerHealth(ctx context.Context) (string, error) {
+	containerID, err := dc.containerExists(ctx)
+	if err != nil {
+		return "", err
+	}
+	if containerID == "" {
+		return "", fmt.Errorf("container %s not found", dc.containerName)
+	}
+	return dc.containerHealth(ctx, containerID)
+}
+
+// errUnhealthy is returned by waitHealthy if the container health check fails
+var errUnhealthy = errors.New("health check failed")
+
+// waitHealthy waits for Docker health check of the container to pass, no longer than configured.
+// It returns immediately if waiting is disabled or the container has no health check
+func (dc *DockerClient) waitHealthy(ctx context.Context, containerID string) error {
+	if dc.healthcheck.Wait <= 0 {
+		return nil
+	}
+	deadline := dc.clock.Now().Add(dc.healthcheck.Wait)
+	for {
+		health, err := dc.containerHealth(ctx, containerID)
+		if err != nil {
+			return fmt.Errorf("error inspecting container: %v", err)
+		}
+		switch health {
+		case types.NoHealthcheck, types.Healthy:
+			return nil
+		case types.Unhealthy:
+			return errUnhealthy
+		}
+
+		if !dc.clock.Now().Before(deadline) {
+			return fmt.Errorf("container is not healthy after %s", dc.healthcheck.Wait)
+		}
+		fmt.Printf("Container health is %q, waiting...\n", health)
+		select {
+		case <-dc.clock.After(healthPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package delixir_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+)
+
+func newHealthcheckClient(t *testing.T, engine *dockertest.Engine, clock *harness.Clock,
+	options ...func(*delixir.DockerClientParams),
+) (*delixir.DockerClient, *harness.Recorder) {
+	t.Helper()
+	return newTestClient(t, engine, append([]func(*delixir.DockerClientParams){func(p *delixir.DockerClientParams) {
+		p.Clock = clock
+		p.Healthcheck = delixir.HealthcheckParams{
+			Test:        delixir.DefaultHealthcheckTest("17690"),
+			Interval:    30 * time.Second,
+			Timeout:     10 * time.Second,
+			StartPeriod: time.Minute,
+			Retries:     3,
+			Wait:        time.Minute,
+		}
+	}}, options...)...)
+}
+
+// checkWithHealth runs the update check, reporting the health status when the new container is polled
+func checkWithHealth(t *testing.T, dc *delixir.DockerClient, engine *dockertest.Engine, clock *harness.Clock,
+	status string,
+) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dc.CheckAndUpdateContainer(context.Background())
+	}()
+	if !clock.WaitForWaiters(1, time.Second) {
+		t.Fatalf("container health was not polled")
+	}
+	if status != types.Starting {
+		engine.SetHealth(testContainerName, status)
+		clock.Advance(5 * time.Second)
+	} else {
+		for i := 0; i < 20 && clock.WaitForWaiters(1, time.Second); i++ {
+			clock.Advance(5 * time.Second)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("update check didn't finish")
+	}
+}
+
+func TestCheckAndUpdateContainerHealthcheck(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	clock := harness.NewClock(harness.Start)
+	dc, notifier := newHealthcheckClient(t, engine, clock)
+
+	checkWithHealth(t, dc, engine, clock, types.Healthy)
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if hc := cont.Config.Healthcheck; hc == nil || len(hc.Test) != 2 || hc.Test[0] != "CMD-SHELL" || hc.Retries != 3 {
+		t.Errorf("unexpected container health check: %+v", hc)
+	}
+	if !notifier.Contains("updated image") {
+		t.Errorf("expected update notification, got: %v", notifier.Messages())
+	}
+
+	health, err := dc.ContainerHealth(context.Background())
+	if err != nil || health != types.Healthy {
+		t.Errorf("ContainerHealth returned %q, %v", health, err)
+	}
+}
+
+func TestCheckAndUpdateContainerUnhealthyRollback(t *testing.T) {
+	for name, status := range map[string]string{
+		"unhealthy": types.Unhealthy,
+		"timeout":   types.Starting,
+	} {
+		t.Run(name, func(t *testing.T) {
+			engine := dockertest.NewEngine()
+			first := engine.Publish(testImage)
+			clock := harness.NewClock(harness.Start)
+			dc, notifier := newHealthcheckClient(t, engine, clock)
+			checkWithHealth(t, dc, engine, clock, types.Healthy)
+
+			notifier.Reset()
+			second := engine.Publish(testImage)
+			checkWithHealth(t, dc, engine, clock, status)
+			requireContainer(t, engine, first.ID, dockertest.StateRunning)
+			for _, want := range []string{"container is not healthy after update to image", "rolled back to image"} {
+				if !notifier.Contains(want) {
+					t.Errorf("expected %q notification, got: %v", want, notifier.Messages())
+				}
+			}
+			if notifier.Contains("updated image") {
+				t.Errorf("unhealthy update was reported as successful: %v", notifier.Messages())
+			}
+
+			// the rejected image is not installed again
+			dc.CheckAndUpdateContainer(context.Background())
+			requireContainer(t, engine, first.ID, dockertest.StateRunning)
+			if calls := engine.CallCount("ContainerCreate"); calls != 3 {
+				t.Errorf("expected 3 containers created, got %d", calls)
+			}
+
+			third := engine.Publish(testImage)
+			checkWithHealth(t, dc, engine, clock, types.Healthy)
+			requireContainer(t, engine, third.ID, dockertest.StateRunning)
+			if second.ID == third.ID {
+				t.Fatalf("expected distinct image IDs")
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package delixir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// points of the update at which hooks run
+const (
+	HookBeforePull   = "before-pull"
+	HookBeforeStop   = "before-stop"
+	HookAfterStart   = "after-start"
+	HookAfterHealthy = "after-healthy"
+	HookRollback     = "rollback"
+)
+
+// HookPoints lists all hook points in the order of the update
+var HookPoints = []string{HookBeforePull, HookBeforeStop, HookAfterStart, HookAfterHealthy, HookRollback}
+
+// HookEvent describes the update at the hook point
+type HookEvent struct {
+	Point         string `json:"point"`
+	ContainerName string `json:"container_name"`
+	ImageName     string `json:"image_name"`
+	// ContainerID is the current container before it is replaced, and the new one after
+	ContainerID    string `json:"container_id,omitempty"`
+	CurrentImageID string `json:"current_image_id,omitempty"`
+	// NewImage is the ID of the new image, or its registry digest before it is pulled
+	NewImage string `json:"new_image,omitempty"`
+	// Error is the reason of the rollback, or the rollback error
+	Error string `json:"error,omitempty"`
+}
+
+// Hooks runs custom actions at points of the update
+type Hooks interface {
+	// Run the hooks of the event point. An error of a hook running before the container is changed
+	// vetoes the update
+	Run(ctx context.Context, event HookEvent) error
+}
+
+// HookDescriber is implemented by Hooks which can describe the hooks of the point without running them,
+// the plan lists them
+type HookDescriber interface {
+	Describe(point string) []string
+}
+
+// ErrVetoed is returned when a hook vetoes the update
+var ErrVetoed = errors.New("update vetoed by hook")
+
+// runPreHooks runs the hooks before the container is changed, their error vetoes the update
+func (dc *DockerClient) runPreHooks(ctx context.Context, event HookEvent) error {
+	if dc.hooks == nil {
+		return nil
+	}
+	event.ContainerName, event.ImageName = dc.containerName, dc.imageName
+	if err := dc.hooks.Run(ctx, event); err != nil {
+		return fmt.Errorf("%w at %s: %v", ErrVetoed, event.Point, err)
+	}
+	return nil
+}
+
+// planHooks plans running the hooks of the point, if the hooks can be described
+func (dc *DockerClient) planHooks(plan *Plan, point string) {
+	describer, ok := dc.hooks.(HookDescriber)
+	if !ok {
+		return
+	}
+	for _, hook := range describer.Describe(point) {
+		plan.action("run %s hook %s", point, hook)
+	}
+}
+
+// pullAllowed runs the before-pull hooks for the registry digest of the new image. A veto is notified once
+// per digest and reason
+func (dc *DockerClient) pullAllowed(ctx context.Context, current ContainerData, digest string) bool {
+	err := dc.runPreHooks(ctx, HookEvent{
+		Point:          HookBeforePull,
+		ContainerID:    current.ContainerID,
+		CurrentImageID: current.ImageID,
+		NewImage:       digest,
+	})
+	if err == nil {
+		dc.vetoedPull = ""
+		return true
+	}
+	log.Printf("Not pulling the image: %v", err)
+	if veto := digest + " " + err.Error(); dc.vetoedPull != veto {
+		dc.vetoedPull = veto
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("pull of image %s was vetoed: %v", dc.imageName, err))
+	}
+	return false
+}
+
+// runPostHooks runs the hooks after the container is changed, their errors are only notified
+func (dc *DockerClient) runPostHooks(ctx context.Context, event HookEvent) {
+	if dc.hooks == nil {
+		return
+	}
+	event.ContainerName, event.ImageName = dc.containerName, dc.imageName
+	if err := dc.hooks.Run(ctx, event); err != nil {
+		log.Printf("Hook %s failed: %v", event.Point, err)
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("hook %s failed: %v", event.Point, err))
+	}
+}
@@ -0,0 +1,219 @@
+package delixir_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+)
+
+// hooksRecorder records hook events, hooks of points in fail return an error
+type hooksRecorder struct {
+	mu     sync.Mutex
+	events []delixir.HookEvent
+	fail   map[string]bool
+}
+
+func (r *hooksRecorder) Run(_ context.Context, event delixir.HookEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	if r.fail[event.Point] {
+		return errors.New("exit status 1")
+	}
+	return nil
+}
+
+func (r *hooksRecorder) points() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	points := make([]string, 0, len(r.events))
+	for _, event := range r.events {
+		points = append(points, event.Point)
+	}
+	return points
+}
+
+func (r *hooksRecorder) event(point string) (delixir.HookEvent, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, event := range r.events {
+		if event.Point == point {
+			return event, true
+		}
+	}
+	return delixir.HookEvent{}, false
+}
+
+func (r *hooksRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
+
+func withHooks(hooks delixir.Hooks) func(*delixir.DockerClientParams) {
+	return func(p *delixir.DockerClientParams) { p.Hooks = hooks }
+}
+
+func TestCheckAndUpdateContainerHooks(t *testing.T) {
+	engine := dockertest.NewEngine()
+	first := engine.Publish(testImage)
+	hooks := &hooksRecorder{}
+	dc, _ := newTestClient(t, engine, withHooks(hooks))
+	dc.CheckAndUpdateContainer(context.Background())
+	if points := strings.Join(hooks.points(), " "); points != "before-pull after-start after-healthy" {
+		t.Errorf("hooks of the installation ran at %q", points)
+	}
+	old := requireContainer(t, engine, first.ID, dockertest.StateRunning)
+
+	hooks.reset()
+	remote := engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if points := strings.Join(hooks.points(), " "); points != "before-pull before-stop after-start after-healthy" {
+		t.Errorf("hooks of the update ran at %q", points)
+	}
+
+	pull, _ := hooks.event(delixir.HookBeforePull)
+	if pull.NewImage != remote.Digest || pull.CurrentImageID != first.ID {
+		t.Errorf("unexpected before-pull event: %+v", pull)
+	}
+	stop, _ := hooks.event(delixir.HookBeforeStop)
+	if stop.ContainerID != old.ID || stop.NewImage != remote.ID || stop.ContainerName != testContainerName ||
+		stop.ImageName != testImage {
+		t.Errorf("unexpected before-stop event: %+v", stop)
+	}
+	if started, _ := hooks.event(delixir.HookAfterStart); started.ContainerID != cont.ID {
+		t.Errorf("after-start event has container %q, expected %q", started.ContainerID, cont.ID)
+	}
+
+	hooks.reset()
+	dc.CheckAndUpdateContainer(context.Background())
+	if points := hooks.points(); len(points) != 0 {
+		t.Errorf("hooks ran without update at %v", points)
+	}
+}
+
+func TestCheckAndUpdateContainerHookVeto(t *testing.T) {
+	for _, point := range []string{delixir.HookBeforePull, delixir.HookBeforeStop} {
+		t.Run(point, func(t *testing.T) {
+			engine := dockertest.NewEngine()
+			first := engine.Publish(testImage)
+			hooks := &hooksRecorder{}
+			dc, notifier := newTestClient(t, engine, withHooks(hooks))
+			dc.CheckAndUpdateContainer(context.Background())
+			pulls := engine.CallCount("ImagePull")
+
+			hooks.fail = map[string]bool{point: true}
+			notifier.Reset()
+			engine.Publish(testImage)
+			dc.CheckAndUpdateContainer(context.Background())
+
+			requireContainer(t, engine, first.ID, dockertest.StateRunning)
+			if n := engine.CallCount("ContainerStop"); n != 0 {
+				t.Errorf("container was stopped %d times", n)
+			}
+			if point == delixir.HookBeforePull && engine.CallCount("ImagePull") != pulls {
+				t.Errorf("image was pulled after the veto")
+			}
+			if !notifier.Contains("vetoed") {
+				t.Errorf("veto is not notified: %v", notifier.Messages())
+			}
+			if notifier.Contains("failed to update") {
+				t.Errorf("veto is reported as a failure: %v", notifier.Messages())
+			}
+		})
+	}
+}
+
+func TestCheckAndUpdateContainerHookVetoNotifiedOnce(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	hooks := &hooksRecorder{}
+	dc, notifier := newTestClient(t, engine, withHooks(hooks))
+	dc.CheckAndUpdateContainer(context.Background())
+
+	hooks.fail = map[string]bool{delixir.HookBeforePull: true}
+	notifier.Reset()
+	engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+	dc.CheckAndUpdateContainer(context.Background())
+	if n := notifier.Count("was vetoed"); n != 1 {
+		t.Errorf("veto of the same image was notified %d times, expected once: %v", n, notifier.Messages())
+	}
+
+	engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+	if n := notifier.Count("was vetoed"); n != 2 {
+		t.Errorf("veto of a newer image was notified %d times in total, expected 2: %v", n, notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerHooksRegistryUnavailable(t *testing.T) {
+	engine := dockertest.NewEngine()
+	first := engine.Publish(testImage)
+	hooks := &hooksRecorder{}
+	dc, _ := newTestClient(t, engine, withHooks(hooks))
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, first.ID, dockertest.StateRunning)
+
+	hooks.reset()
+	engine.FailOn("RegistryHEAD", errors.New("registry is down"))
+	remote := engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if points := strings.Join(hooks.points(), " "); points != "before-stop after-start after-healthy" {
+		t.Errorf("hooks of the update without the registry digest ran at %q", points)
+	}
+	if stop, _ := hooks.event(delixir.HookBeforeStop); stop.NewImage != remote.ID {
+		t.Errorf("before-stop event has new image %q, expected %q", stop.NewImage, remote.ID)
+	}
+}
+
+func TestCheckAndUpdateContainerPostHookFailure(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	hooks := &hooksRecorder{fail: map[string]bool{delixir.HookAfterStart: true}}
+	dc, notifier := newTestClient(t, engine, withHooks(hooks))
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if !notifier.Contains("hook after-start failed") {
+		t.Errorf("hook failure is not notified: %v", notifier.Messages())
+	}
+	if _, ok := hooks.event(delixir.HookAfterHealthy); !ok {
+		t.Errorf("after-healthy hook didn't run after the failed after-start one")
+	}
+}
+
+func TestCheckAndUpdateContainerRollbackHook(t *testing.T) {
+	engine := dockertest.NewEngine()
+	first := engine.Publish(testImage)
+	clock := harness.NewClock(harness.Start)
+	hooks := &hooksRecorder{}
+	dc, _ := newHealthcheckClient(t, engine, clock, withHooks(hooks))
+	checkWithHealth(t, dc, engine, clock, types.Healthy)
+
+	hooks.reset()
+	engine.Publish(testImage)
+	checkWithHealth(t, dc, engine, clock, types.Unhealthy)
+
+	cont := requireContainer(t, engine, first.ID, dockertest.StateRunning)
+	rollback, ok := hooks.event(delixir.HookRollback)
+	if !ok {
+		t.Fatalf("rollback hook didn't run, hooks ran at %v", hooks.points())
+	}
+	if rollback.ContainerID != cont.ID || !strings.Contains(rollback.Error, "rolled back to image") {
+		t.Errorf("unexpected rollback event: %+v", rollback)
+	}
+	if _, ok := hooks.event(delixir.HookAfterHealthy); ok {
+		t.Errorf("after-healthy hook ran for the unhealthy container")
+	}
+}
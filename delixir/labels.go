@@ -0,0 +1,132 @@
+package delixir
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// labels of the containers created by the updater
+const (
+	// LabelManagedBy marks containers owned by the updater, its value is ManagedBy
+	LabelManagedBy = "elixir-testnet-updater.managed-by"
+	// LabelVersion is the version of the updater which created the container
+	LabelVersion = "elixir-testnet-updater.version"
+	// LabelConfigHash is the hash of the container settings: the image name, ports, restart policy and health check
+	LabelConfigHash = "elixir-testnet-updater.config-hash"
+	// LabelEnvHash is the hash of the environment variables from the env file
+	LabelEnvHash = "elixir-testnet-updater.env-hash"
+	// LabelEnvNames is the comma-separated names of the environment variables set by the updater
+	LabelEnvNames = "elixir-testnet-updater.env-names"
+	// LabelInstanceID is the validator display name
+	LabelInstanceID = "elixir-testnet-updater.instance-id"
+	// LabelPreviousImage is the digest, or the ID if the digest is unknown, of the image of the replaced container
+	LabelPreviousImage = "elixir-testnet-updater.previous-image"
+
+	ManagedBy = "elixir-testnet-updater"
+)
+
+// containerLabels returns labels of the container with the configuration, previousImage may be empty
+func (dc *DockerClient) containerLabels(config *container.Config, hostConfig *container.HostConfig,
+	previousImage string,
+) map[string]string {
+	settings, _ := json.Marshal(struct {
+		Image         string
+		ExposedPorts  any
+		PortBindings  any
+		RestartPolicy container.RestartPolicy
+		Healthcheck   *container.HealthConfig
+	}{config.Image, config.ExposedPorts, hostConfig.PortBindings, hostConfig.RestartPolicy, config.Healthcheck})
+
+	labels := map[string]string{
+		LabelManagedBy:  ManagedBy,
+		LabelConfigHash: hash(settings),
+		LabelEnvHash:    hash([]byte(strings.Join(config.Env, "\n"))),
+		LabelEnvNames:   envNames(config.Env),
+	}
+	if dc.version != "" {
+		labels[LabelVersion] = dc.version
+	}
+	if instanceID := dc.instanceID(); instanceID != "" {
+		labels[LabelInstanceID] = instanceID
+	}
+	if previousImage != "" {
+		labels[LabelPreviousImage] = previousImage
+	}
+	return labels
+}
+
+// instanceID returns the validator display name from the environment variables
+func (dc *DockerClient) instanceID() string {
+	var instanceID string
+	for _, kv := range dc.envVars {
+		if name, value, _ := strings.Cut(kv, "="); strings.TrimSpace(name) == "STRATEGY_EXECUTOR_DISPLAY_NAME" {
+			instanceID = strings.TrimSpace(value)
+		}
+	}
+	return instanceID
+}
+
+// envNames returns the sorted comma-separated names of the environment variables
+func envNames(env []string) string {
+	names := make([]string, 0, len(env))
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(slices.Compact(names), ",")
+}
+
+// hash returns hex-encoded SHA-256 of data
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// findContainer returns the container managed by the updater, or nil if there is none.
+// Containers labelled as managed are looked up first: the one with the managed name, or the renamed one
+// of the same validator instance, as other updater instances may run on the host. Otherwise the unlabelled
+// container with the managed name, created by earlier versions, is returned
+func (dc *DockerClient) findContainer(ctx context.Context) (*types.Container, error) {
+	labelled, err := dc.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelManagedBy+"="+ManagedBy)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range labelled {
+		if containerName(labelled[i]) == dc.containerName {
+			return &labelled[i], nil
+		}
+	}
+	var ofInstance []*types.Container
+	for i := range labelled {
+		if instanceID := dc.instanceID(); instanceID != "" && labelled[i].Labels[LabelInstanceID] == instanceID {
+			ofInstance = append(ofInstance, &labelled[i])
+		}
+	}
+	if len(ofInstance) == 1 {
+		return ofInstance[0], nil
+	}
+
+	containers, err := dc.cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	for i := range containers {
+		if containerName(containers[i]) == dc.containerName {
+			return &containers[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,138 @@
+package delixir_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+func withVersion(version string) func(*delixir.DockerClientParams) {
+	return func(p *delixir.DockerClientParams) { p.Version = version }
+}
+
+func TestContainerLabels(t *testing.T) {
+	engine := dockertest.NewEngine()
+	old := engine.Publish(testImage)
+	dc, _ := newTestClient(t, engine, withVersion("v1.2.3"))
+	dc.CheckAndUpdateContainer(context.Background())
+
+	cont := requireContainer(t, engine, old.ID, dockertest.StateRunning)
+	labels := cont.Config.Labels
+	for label, expected := range map[string]string{
+		delixir.LabelManagedBy:  delixir.ManagedBy,
+		delixir.LabelVersion:    "v1.2.3",
+		delixir.LabelInstanceID: "test",
+	} {
+		if labels[label] != expected {
+			t.Errorf("label %s is %q, expected %q", label, labels[label], expected)
+		}
+	}
+	if len(labels[delixir.LabelConfigHash]) != 64 || len(labels[delixir.LabelEnvHash]) != 64 {
+		t.Errorf("hash labels are missing: %v", labels)
+	}
+	if _, ok := labels[delixir.LabelPreviousImage]; ok {
+		t.Errorf("first installed container has previous image label: %v", labels)
+	}
+
+	remote := engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+	cont = requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if previous := cont.Config.Labels[delixir.LabelPreviousImage]; previous != old.Digest {
+		t.Errorf("previous image label is %q, expected %q", previous, old.Digest)
+	}
+	if cont.Config.Labels[delixir.LabelConfigHash] != labels[delixir.LabelConfigHash] {
+		t.Errorf("config hash changed with the same settings")
+	}
+
+	// the version of the updater is not a setting of the container
+	updated, _ := newTestClient(t, engine, withVersion("v1.2.4"))
+	updated.CheckAndUpdateContainer(context.Background())
+	if n := engine.CallCount("ContainerCreate"); n != 2 {
+		t.Errorf("container was created %d times, expected 2", n)
+	}
+}
+
+func TestUnlabelledContainerIsNotRecreated(t *testing.T) {
+	engine := dockertest.NewEngine()
+	old := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	// created by an earlier version of the updater with the configured settings, but without labels
+	engine.AddContainer(testContainerName, testImage, dockertest.StateRunning)
+	port := nat.Port("17690/tcp")
+	engine.SetContainerConfig(testContainerName, container.Config{
+		Image:        testImage,
+		Env:          []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=test"},
+		ExposedPorts: nat.PortSet{port: struct{}{}},
+	}, container.HostConfig{
+		PortBindings:  nat.PortMap{port: []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "17690"}}},
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyUnlessStopped},
+	})
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, old.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ContainerCreate"); n != 0 {
+		t.Errorf("container was created %d times, expected none", n)
+	}
+	if len(notifier.Messages()) != 0 {
+		t.Errorf("unexpected notifications: %v", notifier.Messages())
+	}
+
+	remote := engine.Publish(testImage) // the labels come with the next update
+	dc.CheckAndUpdateContainer(context.Background())
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if cont.Config.Labels[delixir.LabelManagedBy] != delixir.ManagedBy {
+		t.Errorf("updated container labels are %v", cont.Config.Labels)
+	}
+}
+
+func TestContainerLookupByLabel(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine, withAdopt)
+	dc.CheckAndUpdateContainer(context.Background())
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if err := engine.ContainerRename(context.Background(), cont.ID, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	notifier.Reset()
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	if n := engine.CallCount("ContainerCreate"); n != 1 {
+		t.Errorf("container was created %d times, expected once", n)
+	}
+	if health, err := dc.ContainerHealth(context.Background()); err != nil || health != "none" {
+		t.Errorf("ContainerHealth returned %q, %v", health, err)
+	}
+	if len(notifier.Messages()) != 0 {
+		t.Errorf("unexpected notifications: %v", notifier.Messages())
+	}
+}
+
+func TestContainerLookupSeveralInstances(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	first, _ := newTestClient(t, engine)
+	first.CheckAndUpdateContainer(context.Background())
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+
+	second, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) {
+		p.ContainerName = "elixir-2"
+		p.EnvVars = []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=second"}
+		p.Port = "17691"
+	})
+	second.CheckAndUpdateContainer(context.Background())
+
+	if _, ok := engine.Container("elixir-2"); !ok {
+		t.Fatalf("second container was not created: %v", notifier.Messages())
+	}
+	if kept := requireContainer(t, engine, remote.ID, dockertest.StateRunning); kept.ID != cont.ID {
+		t.Errorf("container of the first instance was replaced")
+	}
+}
@@ -0,0 +1,42 @@
+package delixir
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultUpdateGracePeriod is the default time after a container swap during which it's considered in progress,
+// since the validator needs some time to start serving health requests
+const DefaultUpdateGracePeriod = 2 * time.Minute
+
+// swapState tracks container swaps (recreation or restart) of the validator
+type swapState struct {
+	mu          sync.Mutex
+	swapping    bool
+	endedAt     time.Time
+	gracePeriod time.Duration
+}
+
+// beginSwap marks the container swap as started. Call the returned function when it ends
+func (dc *DockerClient) beginSwap() (end func()) {
+	dc.swap.mu.Lock()
+	dc.swap.swapping = true
+	dc.swap.mu.Unlock()
+	return func() {
+		dc.swap.mu.Lock()
+		defer dc.swap.mu.Unlock()
+		dc.swap.swapping = false
+		dc.swap.endedAt = dc.clock.Now()
+	}
+}
+
+// UpdateInProgress returns whether the validator container is being swapped now
+// or was swapped less than the grace period ago
+func (dc *DockerClient) UpdateInProgress() bool {
+	dc.swap.mu.Lock()
+	defer dc.swap.mu.Unlock()
+	if dc.swap.swapping {
+		return true
+	}
+	return !dc.swap.endedAt.IsZero() && dc.clock.Now().Sub(dc.swap.endedAt) < dc.swap.gracePeriod
+}
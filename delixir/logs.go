@@ -0,0 +1,164 @@
+package delixir
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/mtfelian/elixir-testnet-updater/notifier"
+)
+
+// default container logs capture parameters
+const (
+	DefaultLogLines        = 100
+	DefaultLogExcerptLines = 10
+)
+
+// maxLogLineLength limits log lines included into notification text
+const maxLogLineLength = 300
+
+// DefaultLogPatterns match known validator errors in container logs
+var DefaultLogPatterns = []string{
+	`(?i)panic:`,
+	`(?i)\bfatal\b`,
+	`(?i)out of memory`,
+	`(?i)unhandled.*rejection`,
+	`ECONNREFUSED|ECONNRESET|ETIMEDOUT|ENOTFOUND`,
+	`(?i)\berror\b`,
+}
+
+// LogsParams represents container logs capture for alerts
+type LogsParams struct {
+	// Lines is a number of last container log lines captured on alerts, zero disables the capture
+	Lines int
+	// ExcerptLines limits log lines included into notification text, defaults to DefaultLogExcerptLines
+	ExcerptLines int
+	// Attach makes all captured lines sent as a file, if the notifier supports it
+	Attach bool
+	// Patterns are regular expressions of known errors, in addition to DefaultLogPatterns
+	Patterns []string
+}
+
+// compileLogPatterns compiles default and additional known error patterns
+func compileLogPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(DefaultLogPatterns)+len(patterns))
+	for _, pattern := range append(append([]string(nil), DefaultLogPatterns...), patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log pattern %q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// LogExcerpt represents container logs captured for an alert
+type LogExcerpt struct {
+	Lines   []string // all captured lines
+	Matches []string // captured lines matching known error patterns
+}
+
+// Text returns up to n last lines matching known error patterns, or just last n lines if nothing matched.
+// Long lines are trimmed
+func (e LogExcerpt) Text(n int) string {
+	title, lines := "last log lines", e.Lines
+	if len(e.Matches) > 0 {
+		title, lines = fmt.Sprintf("known errors (%d lines)", len(e.Matches)), e.Matches
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	var b strings.Builder
+	b.WriteString(title + ":")
+	for _, line := range lines {
+		if len(line) > maxLogLineLength {
+			line = line[:maxLogLineLength] + "…"
+		}
+		b.WriteString("\n" + line)
+	}
+	return b.String()
+}
+
+// captureLogs returns last lines of the container stdout and stderr, with lines matching known error patterns
+func (dc *DockerClient) captureLogs(ctx context.Context, containerID string) (LogExcerpt, error) {
+	var excerpt LogExcerpt
+	rc, err := dc.cli.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(dc.logs.Lines),
+	})
+	if err != nil {
+		return excerpt, err
+	}
+	defer rc.Close()
+
+	// the validator container has no TTY, so its output is multiplexed
+	var buf bytes.Buffer
+	if _, err := stdcopy.StdCopy(&buf, &buf, rc); err != nil {
+		return excerpt, err
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		excerpt.Lines = append(excerpt.Lines, line)
+		for _, re := range dc.logPatterns {
+			if re.MatchString(line) {
+				excerpt.Matches = append(excerpt.Matches, line)
+				break
+			}
+		}
+	}
+	return excerpt, scanner.Err()
+}
+
+// Alert notifies with the message, adding an excerpt of the validator container logs
+func (dc *DockerClient) Alert(ctx context.Context, message string) {
+	dc.alert(ctx, "", message)
+}
+
+// alert notifies with the message, adding an excerpt of the container logs and attaching captured logs
+// if configured. The current validator container is used if containerID is empty
+func (dc *DockerClient) alert(ctx context.Context, containerID, message string) {
+	if dc.logs.Lines <= 0 {
+		dc.notifier.SendBroadcastMessage(message)
+		return
+	}
+
+	var excerpt LogExcerpt
+	var err error
+	if containerID == "" {
+		containerID, err = dc.containerExists(ctx)
+	}
+	if err == nil && containerID != "" {
+		excerpt, err = dc.captureLogs(ctx, containerID)
+	}
+	if err != nil {
+		log.Printf("Error getting container logs: %v", err)
+	}
+
+	text := message
+	if s := excerpt.Text(dc.logs.ExcerptLines); s != "" {
+		text += "\n" + s
+	}
+	dc.notifier.SendBroadcastMessage(text)
+
+	fileSender, ok := dc.notifier.(notifier.FileSender)
+	if !dc.logs.Attach || !ok || len(excerpt.Lines) == 0 {
+		return
+	}
+	name := fmt.Sprintf("%s-%s.log", dc.containerName, dc.clock.Now().UTC().Format("20060102-150405"))
+	fileSender.SendBroadcastFile(name, []byte(strings.Join(excerpt.Lines, "\n")+"\n"),
+		fmt.Sprintf("last %d log lines of container %q", len(excerpt.Lines), dc.containerName))
+}
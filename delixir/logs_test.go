@@ -0,0 +1,87 @@
+package delixir_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+func TestAlertWithLogs(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) {
+		p.Logs = delixir.LogsParams{Lines: 50, ExcerptLines: 2, Attach: true, Patterns: []string{`nonce too low`}}
+	})
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	notifier.Reset()
+
+	engine.AppendLogs(testContainerName,
+		"starting validator",
+		"Error: connect ECONNREFUSED 127.0.0.1:8545",
+		"proposal 17 signed",
+		"tx failed: nonce too low",
+		"proposal 18 signed",
+		"Error: request failed: "+strings.Repeat("x", 1000),
+	)
+	dc.Alert(context.Background(), "validator is down")
+
+	messages := notifier.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 notification, got: %v", messages)
+	}
+	msg := messages[0]
+	for _, want := range []string{"validator is down", "known errors (3 lines):", "nonce too low", "request failed: xxx"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("alert doesn't contain %q: %q", want, msg)
+		}
+	}
+	for _, unwanted := range []string{"ECONNREFUSED", "proposal 18 signed"} {
+		if strings.Contains(msg, unwanted) {
+			t.Errorf("alert contains %q beyond excerpt limit or not matching patterns: %q", unwanted, msg)
+		}
+	}
+	if len(msg) > 1000 {
+		t.Errorf("long log line was not trimmed, alert length is %d", len(msg))
+	}
+
+	files := notifier.Files()
+	if len(files) != 1 {
+		t.Fatalf("expected 1 attached file, got %d", len(files))
+	}
+	if !strings.HasPrefix(files[0].Name, testContainerName+"-") || !strings.HasSuffix(files[0].Name, ".log") {
+		t.Errorf("unexpected log file name %q", files[0].Name)
+	}
+	if lines := strings.Count(string(files[0].Content), "\n"); lines != 6 {
+		t.Errorf("expected 6 lines in the attached file, got %d", lines)
+	}
+}
+
+func TestAlertWithoutContainer(t *testing.T) {
+	engine := dockertest.NewEngine()
+	dc, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) {
+		p.Logs = delixir.LogsParams{Lines: 50, Attach: true}
+	})
+
+	dc.Alert(context.Background(), "validator is down")
+	if messages := notifier.Messages(); len(messages) != 1 || messages[0] != "validator is down" {
+		t.Errorf("expected plain alert, got: %v", messages)
+	}
+	if files := notifier.Files(); len(files) != 0 {
+		t.Errorf("expected no attached files, got %d", len(files))
+	}
+}
+
+func TestInvalidLogPattern(t *testing.T) {
+	_, err := delixir.NewDockerClient(delixir.DockerClientParams{
+		ImageName: testImage,
+		API:       dockertest.NewEngine(),
+		Logs:      delixir.LogsParams{Patterns: []string{"("}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid log pattern") {
+		t.Errorf("expected invalid log pattern error, got: %v", err)
+	}
+}
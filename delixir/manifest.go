@@ -0,0 +1,296 @@
+package delixir
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+)
+
+// manifestMediaTypes are accepted manifest media types, manifest lists go first
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// maxManifestSize limits the size of the downloaded manifest
+const maxManifestSize = 4 << 20
+
+// rateLimitUnknown means the registry didn't report the rate limit
+const rateLimitUnknown = -1
+
+// manifestInfo represents the result of the manifest request
+type manifestInfo struct {
+	Digest             string
+	MediaType          string
+	RateLimitRemaining int // rateLimitUnknown if the registry doesn't report it
+}
+
+// registryClient is a minimal Docker Registry HTTP API V2 client
+type registryClient struct {
+	httpClient *http.Client
+	params     RegistryParams
+	// baseURL returns registry API base URL for the registry host
+	baseURL func(host string) string
+}
+
+func newRegistryClient(params RegistryParams) *registryClient {
+	return &registryClient{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		params:     params,
+		baseURL:    registryBaseURL,
+	}
+}
+
+// registryBaseURL returns Registry API base URL for the host.
+// Docker Hub images are served from registry-1.docker.io, localhost registries are accessed over plain HTTP
+func registryBaseURL(host string) string {
+	if host == dockerHubDomain {
+		return "https://registry-1.docker.io"
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if ip := net.ParseIP(hostname); hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// headManifest requests the manifest digest of the tagged image reference without downloading it
+func (rc *registryClient) headManifest(ctx context.Context, imageRef string) (manifestInfo, error) {
+	info, _, err := rc.requestManifest(ctx, http.MethodHead, imageRef, "")
+	return info, err
+}
+
+// platformConfigDigest resolves the manifest list with the given digest to the manifest for the platform
+// and returns the digest of its image config, which is the image ID of the pulled image.
+// For single-platform manifests the config digest is returned directly
+func (rc *registryClient) platformConfigDigest(ctx context.Context, imageRef, digest string, platform Platform) (string, error) {
+	_, body, err := rc.requestManifest(ctx, http.MethodGet, imageRef, digest)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Manifests []struct {
+			Digest   string   `json:"digest"`
+			Platform Platform `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return "", fmt.Errorf("error decoding manifest %s: %v", digest, err)
+	}
+	if manifest.Config.Digest != "" {
+		return manifest.Config.Digest, nil
+	}
+
+	for _, m := range manifest.Manifests {
+		if platform.Matches(m.Platform) {
+			return rc.platformConfigDigest(ctx, imageRef, m.Digest, platform)
+		}
+	}
+	return "", fmt.Errorf("manifest list %s has no image for platform %s", digest, platform)
+}
+
+// requestManifest requests the manifest by digest, or by the image reference tag if digest is empty
+func (rc *registryClient) requestManifest(ctx context.Context, method, imageRef, digest string) (manifestInfo, []byte, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return manifestInfo{}, nil, err
+	}
+	named = reference.TagNameOnly(named)
+	manifestRef := digest
+	if manifestRef == "" {
+		tagged, ok := named.(reference.Tagged)
+		if !ok {
+			return manifestInfo{}, nil, fmt.Errorf("image reference %q has no tag", imageRef)
+		}
+		manifestRef = tagged.Tag()
+	}
+
+	host, repository := reference.Domain(named), reference.Path(named)
+	endpoint := fmt.Sprintf("%s/v2/%s/manifests/%s", rc.baseURL(host), repository, manifestRef)
+	resp, err := rc.do(ctx, method, endpoint, host, repository)
+	if err != nil {
+		return manifestInfo{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	info := manifestInfo{
+		Digest:             resp.Header.Get("Docker-Content-Digest"),
+		MediaType:          resp.Header.Get("Content-Type"),
+		RateLimitRemaining: parseRateLimit(resp.Header.Get("RateLimit-Remaining")),
+	}
+	if resp.StatusCode != http.StatusOK {
+		return info, nil, fmt.Errorf("registry %s responded with status %q for %s", host, resp.Status, imageRef)
+	}
+	if info.Digest == "" {
+		info.Digest = digest
+	}
+	if info.Digest == "" {
+		return info, nil, fmt.Errorf("registry %s did not return a digest for %s", host, imageRef)
+	}
+
+	var body []byte
+	if method != http.MethodHead {
+		if body, err = io.ReadAll(io.LimitReader(resp.Body, maxManifestSize)); err != nil {
+			return info, nil, fmt.Errorf("error reading manifest: %v", err)
+		}
+	}
+	return info, body, nil
+}
+
+// do performs the request, authenticating with the registry if it demands so
+func (rc *registryClient) do(ctx context.Context, method, endpoint, host, repository string) (*http.Response, error) {
+	newRequest := func(authorization string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest("")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	authorization, err := rc.authorize(ctx, resp.Header.Get("WWW-Authenticate"), host, repository)
+	if err != nil {
+		return nil, err
+	}
+	if req, err = newRequest(authorization); err != nil {
+		return nil, err
+	}
+	return rc.httpClient.Do(req)
+}
+
+// authorize returns Authorization header value answering the registry challenge
+func (rc *registryClient) authorize(ctx context.Context, challenge, host, repository string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	creds, err := rc.params.credentials(host)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if creds.Username == "" {
+			return "", fmt.Errorf("registry %s requires credentials", host)
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		if params["realm"] == "" {
+			return "", fmt.Errorf("registry %s sent bearer challenge without realm", host)
+		}
+		tokenURL, err := url.Parse(params["realm"])
+		if err != nil {
+			return "", fmt.Errorf("invalid token realm %q: %v", params["realm"], err)
+		}
+		query := tokenURL.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		scope := params["scope"]
+		if scope == "" {
+			scope = fmt.Sprintf("repository:%s:pull", repository)
+		}
+		query.Set("scope", scope)
+		tokenURL.RawQuery = query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if creds.Username != "" {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+		resp, err := rc.httpClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("error requesting registry token: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("registry token endpoint responded with status %q", resp.Status)
+		}
+
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return "", fmt.Errorf("error decoding registry token: %v", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		return "Bearer " + token.Token, nil
+	default:
+		return "", fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+}
+
+// parseChallenge parses WWW-Authenticate header value like `Bearer realm="...",service="..."`
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key], rest = value[1:end+1], value[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return scheme, params
+}
+
+// parseRateLimit parses RateLimit-Remaining header value like "76;w=21600"
+func parseRateLimit(s string) int {
+	s, _, _ = strings.Cut(s, ";")
+	remaining, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return rateLimitUnknown
+	}
+	return remaining
+}
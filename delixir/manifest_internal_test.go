@@ -0,0 +1,71 @@
+package delixir
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	for _, tc := range []struct {
+		challenge string
+		scheme    string
+		params    map[string]string
+	}{
+		{
+			challenge: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:elixirprotocol/validator:pull"`,
+			scheme:    "Bearer",
+			params: map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:elixirprotocol/validator:pull",
+			},
+		},
+		{
+			challenge: `Basic realm="Registry Realm"`,
+			scheme:    "Basic",
+			params:    map[string]string{"realm": "Registry Realm"},
+		},
+		{
+			challenge: `  bearer Realm="https://ghcr.io/token", service=ghcr.io ,scope="repository:a/b:pull,push"`,
+			scheme:    "bearer",
+			params:    map[string]string{"realm": "https://ghcr.io/token", "service": "ghcr.io", "scope": "repository:a/b:pull,push"},
+		},
+		{
+			challenge: `Bearer realm="unterminated`,
+			scheme:    "Bearer",
+			params:    map[string]string{"realm": "unterminated"},
+		},
+		{
+			challenge: `Basic`,
+			scheme:    "Basic",
+			params:    map[string]string{},
+		},
+		{
+			challenge: ``,
+			scheme:    "",
+			params:    map[string]string{},
+		},
+	} {
+		scheme, params := parseChallenge(tc.challenge)
+		if scheme != tc.scheme || !maps.Equal(params, tc.params) {
+			t.Errorf("parseChallenge(%q) = %q, %v, expected %q, %v", tc.challenge, scheme, params, tc.scheme, tc.params)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for _, tc := range []struct {
+		header    string
+		remaining int
+	}{
+		{"76;w=21600", 76},
+		{"0;w=21600", 0},
+		{" 5 ", 5},
+		{"", rateLimitUnknown},
+		{"many;w=21600", rateLimitUnknown},
+	} {
+		if remaining := parseRateLimit(tc.header); remaining != tc.remaining {
+			t.Errorf("parseRateLimit(%q) = %d, expected %d", tc.header, remaining, tc.remaining)
+		}
+	}
+}
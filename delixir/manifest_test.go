@@ -0,0 +1,135 @@
+package delixir_test
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+func TestCheckAndUpdateContainerRegistryAuth(t *testing.T) {
+	hubConfig := `{"auths":{"docker.io":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("hub:secret")) + `"}}}`
+	for _, tc := range []struct {
+		name               string
+		scheme             string
+		username, password string // demanded by the registry
+		registry           delixir.RegistryParams
+		config             string
+		authorized         bool
+		token              bool // whether the token endpoint is requested
+	}{
+		{
+			name:       "basic",
+			scheme:     "basic",
+			username:   "user",
+			password:   "secret",
+			registry:   delixir.RegistryParams{Username: "user", Password: "secret"},
+			authorized: true,
+		},
+		{
+			name:     "basic without credentials",
+			scheme:   "basic",
+			username: "user",
+			password: "secret",
+		},
+		{
+			name:     "basic with wrong password",
+			scheme:   "basic",
+			username: "user",
+			password: "secret",
+			registry: delixir.RegistryParams{Username: "user", Password: "wrong"},
+		},
+		{
+			name:       "bearer",
+			scheme:     "bearer",
+			username:   "user",
+			password:   "secret",
+			registry:   delixir.RegistryParams{Username: "user", Password: "secret"},
+			authorized: true,
+			token:      true,
+		},
+		{
+			name:       "anonymous bearer",
+			scheme:     "bearer",
+			authorized: true,
+			token:      true,
+		},
+		{
+			name:       "bearer with docker config credentials",
+			scheme:     "bearer",
+			username:   "hub",
+			password:   "secret",
+			config:     hubConfig,
+			authorized: true,
+			token:      true,
+		},
+		{
+			name:     "bearer with wrong password",
+			scheme:   "bearer",
+			username: "user",
+			password: "secret",
+			registry: delixir.RegistryParams{Username: "user", Password: "wrong"},
+			token:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			engine := dockertest.NewEngine()
+			remote := engine.Publish(testImage)
+			engine.PullLocal(testImage)
+			addContainer(engine, dockertest.StateRunning)
+			engine.RequireAuth(tc.scheme, tc.username, tc.password)
+			registry := tc.registry
+			config := tc.config
+			if config == "" {
+				config = "{}"
+			}
+			registry.DockerConfigPath = writeDockerConfig(t, config)
+			dc, _ := newTestClient(t, engine, withRegistry(registry))
+
+			dc.CheckAndUpdateContainer(context.Background())
+
+			requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+			// the image is pulled without the manifest check only if the registry refused it
+			if n := engine.CallCount("ImagePull"); tc.authorized && n != 0 {
+				t.Errorf("image was pulled %d times, expected the authorized manifest check to match", n)
+			} else if !tc.authorized && n != 1 {
+				t.Errorf("image was pulled %d times, expected the pull after the refused manifest check", n)
+			}
+			if n := engine.CallCount("RegistryHEAD"); tc.authorized && n != 2 {
+				t.Errorf("manifest was requested %d times, expected the challenge and the authorized request", n)
+			}
+			n := engine.CallCount("RegistryToken dockertest repository:elixirprotocol/validator:pull")
+			if tc.token && n != 1 {
+				t.Errorf("token was requested %d times, expected once: %v", n, engine.Calls())
+			} else if !tc.token && n != 0 {
+				t.Errorf("token was requested %d times for %s authentication", n, tc.scheme)
+			}
+		})
+	}
+}
+
+func TestCheckAndUpdateContainerRateLimited(t *testing.T) {
+	engine := dockertest.NewEngine()
+	old := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateRunning)
+	remote := engine.Publish(testImage)
+	engine.SetRateLimit(0)
+	dc, notifier := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, old.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ImagePull"); n != 0 {
+		t.Errorf("image was pulled %d times with exhausted rate limit, expected the pull to be postponed", n)
+	}
+	if len(notifier.Messages()) != 0 {
+		t.Errorf("unexpected notifications: %v", notifier.Messages())
+	}
+
+	engine.SetRateLimit(10)
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+}
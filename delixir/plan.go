@@ -0,0 +1,239 @@
+package delixir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// Plan represents actions CheckAndUpdateContainer would take, see DockerClient.Plan
+type Plan struct {
+	// Actions are the planned steps in the order of execution, empty if nothing would be done
+	Actions []string
+	// Changes describe differences of the container to be created from the current one
+	Changes []string
+	// Notes explain the decisions, e.g. why the update would not happen
+	Notes []string
+}
+
+// Print writes the plan in human-readable form
+func (p Plan) Print(w io.Writer) {
+	if len(p.Actions) == 0 {
+		fmt.Fprintln(w, "No actions planned.")
+	} else {
+		fmt.Fprintln(w, "Planned actions:")
+		for i, action := range p.Actions {
+			fmt.Fprintf(w, "  %d. %s\n", i+1, action)
+		}
+	}
+	if len(p.Changes) > 0 {
+		fmt.Fprintln(w, "Container changes:")
+		for _, change := range p.Changes {
+			fmt.Fprintf(w, "  ~ %s\n", change)
+		}
+	}
+	for _, note := range p.Notes {
+		fmt.Fprintf(w, "Note: %s\n", note)
+	}
+}
+
+func (p *Plan) action(format string, args ...any) {
+	p.Actions = append(p.Actions, fmt.Sprintf(format, args...))
+}
+
+func (p *Plan) note(format string, args ...any) {
+	p.Notes = append(p.Notes, fmt.Sprintf(format, args...))
+}
+
+// Plan checks the registry and the current container like CheckAndUpdateContainer does and returns
+// the actions it would take. It makes no changes: the image is not pulled and the container is not touched
+func (dc *DockerClient) Plan(ctx context.Context) (Plan, error) {
+	var plan Plan
+	if !dc.opMu.TryLock() {
+		return plan, errors.New("another update operation is in progress")
+	}
+	defer dc.opMu.Unlock()
+
+	if err := dc.CheckDaemon(ctx); err != nil {
+		return plan, fmt.Errorf("Docker daemon is unreachable: %v", err)
+	}
+	dc.reloadEnv()
+
+	containerID, err := dc.containerExists(ctx)
+	if err != nil {
+		return plan, fmt.Errorf("error checking container for existence: %v", err)
+	}
+	found, err := dc.adoptionCandidate(ctx)
+	if err != nil {
+		plan.note("the container would not be managed: %v", err)
+		return plan, nil
+	}
+	var current ContainerData
+	switch {
+	case found != nil:
+		plan.action("rename container %s (%s) to %s to adopt it", containerName(*found), shortID(found.ID),
+			dc.containerName)
+		current = ContainerData{ContainerID: found.ID, ImageID: found.ImageID, State: found.State}
+	case containerID != "":
+		if current, err = dc.getCurrentContainerData(ctx); err != nil {
+			return plan, fmt.Errorf("error getting current container: %v", err)
+		}
+	}
+
+	remote, err := dc.checkRemoteImage(ctx)
+	if err != nil {
+		plan.note("registry check failed, the image would be pulled anyway: %v", err)
+	}
+	if remote.RateLimited {
+		plan.note("registry pull rate limit is exhausted, the pull of %s would be postponed", remote.Digest)
+	}
+
+	newImageID := remote.ImageID
+	if remote.Pull {
+		if remote.Digest != "" {
+			dc.planHooks(&plan, HookBeforePull)
+			plan.action("pull image %s (digest %s)", dc.imageName, remote.Digest)
+		} else {
+			plan.action("pull image %s", dc.imageName)
+		}
+	} else if newImageID, err = dc.getImageID(ctx); err != nil {
+		return plan, fmt.Errorf("error getting image ID: %v", err)
+	}
+
+	replaced := current
+	switch {
+	case current.ImageID != "" && current.ImageID == newImageID:
+		replaced = ContainerData{} // recreated from the same image
+		changes, err := dc.containerDrift(ctx, current)
+		if err != nil {
+			return plan, err
+		}
+		if len(changes) == 0 {
+			dc.planStart(&plan, current)
+			break
+		}
+		plan.note("container %s configuration drifted, it would be recreated from the same image", dc.containerName)
+		dc.planRecreate(&plan, current, changes, false)
+	case newImageID != "" && newImageID == dc.rejectedImageID:
+		replaced = ContainerData{}
+		plan.note("image %q failed the health check after update, a newer one is awaited", newImageID)
+	default:
+		if current.ImageID != "" && dc.rolloutGate != nil {
+			plan.note("the update would be made only if the rollout coordinator allows it")
+		}
+		var changes []string
+		if current.ContainerID != "" {
+			newImage := newImageID
+			if newImage == "" {
+				newImage = "the pulled image"
+			}
+			if changes, err = dc.containerDrift(ctx, current); err != nil {
+				return plan, err
+			}
+			changes = append([]string{fmt.Sprintf("image: %s -> %s", current.ImageID, newImage)}, changes...)
+		}
+		dc.planRecreate(&plan, current, changes, true)
+	}
+	if err := dc.planCleanup(ctx, &plan, newImageID, remote.Pull, replaced); err != nil {
+		return plan, fmt.Errorf("error planning images cleanup: %v", err)
+	}
+	return plan, nil
+}
+
+// planCleanup plans the removal of superseded images after the current container is replaced, and pruning
+// of dangling ones, see cleanupImages. newImageID may be unknown or not local yet if the image would be pulled
+func (dc *DockerClient) planCleanup(ctx context.Context, plan *Plan, newImageID string, pull bool,
+	replaced ContainerData,
+) error {
+	if dc.keepPreviousImages < 0 {
+		return nil
+	}
+	remove, _, err := dc.supersededImages(ctx, newImageID, dc.keepPreviousImages, replaced)
+	if err != nil {
+		return err
+	}
+	for _, img := range remove {
+		plan.action("remove superseded image %s", shortID(img.ID))
+	}
+
+	labelled := newImageID
+	if pull {
+		labelled = replaced.ImageID // the labels of the image to pull are unknown, the current one is alike
+	}
+	if labelled == "" {
+		return nil
+	}
+	pruneFilters, ok, err := dc.danglingImagesFilters(ctx, labelled)
+	if err != nil || !ok {
+		return err
+	}
+	plan.action("prune dangling images with label %s", strings.Join(pruneFilters.Get("label"), ", "))
+	return nil
+}
+
+// planStart plans starting the up-to-date container if it is exited
+func (dc *DockerClient) planStart(plan *Plan, current ContainerData) {
+	switch {
+	case current.State != containerStateExited:
+		plan.note("container %s is up to date and %s", dc.containerName, current.State)
+	case dc.CrashLooping():
+		plan.note("container %s is crash looping, it would not be started", dc.containerName)
+	default:
+		plan.action("start container %s (%s)", dc.containerName, shortID(current.ContainerID))
+	}
+}
+
+// planRecreate plans replacing the current container with the new one having the changes.
+// With rollback an unhealthy new container is replaced back by the one from the current image
+func (dc *DockerClient) planRecreate(plan *Plan, current ContainerData, changes []string, rollback bool) {
+	config, hostConfig, _ := dc.containerSpec(dc.imageName, "") // the port is validated by config
+
+	if current.ContainerID != "" {
+		dc.planHooks(plan, HookBeforeStop)
+		plan.action("stop container %s (%s)", dc.containerName, shortID(current.ContainerID))
+		plan.action("remove container %s (%s)", dc.containerName, shortID(current.ContainerID))
+	}
+	plan.Changes = changes
+	plan.action("create container %s from %s with %s", dc.containerName, dc.imageName, specSummary(config, hostConfig))
+	plan.action("start container %s", dc.containerName)
+	dc.planHooks(plan, HookAfterStart)
+	if dc.healthcheck.Wait > 0 {
+		if rollback && current.ImageID != "" {
+			plan.action("wait up to %s for the container to become healthy, roll back to image %s otherwise",
+				dc.healthcheck.Wait, current.ImageID)
+		} else {
+			plan.action("wait up to %s for the container to become healthy", dc.healthcheck.Wait)
+		}
+	}
+	dc.planHooks(plan, HookAfterHealthy)
+	if describer, ok := dc.hooks.(HookDescriber); ok && rollback && current.ImageID != "" {
+		if hooks := describer.Describe(HookRollback); len(hooks) > 0 {
+			plan.note("after a rollback the %s hooks would run: %s", HookRollback, strings.Join(hooks, ", "))
+		}
+	}
+}
+
+// specSummary describes the container configuration briefly, values of environment variables are omitted
+func specSummary(config *container.Config, hostConfig *container.HostConfig) string {
+	names := make([]string, 0, len(config.Env))
+	for _, kv := range config.Env {
+		name, _, _ := strings.Cut(kv, "=")
+		names = append(names, name)
+	}
+	return fmt.Sprintf("env [%s], ports %s, restart policy %s, healthcheck %s",
+		strings.Join(names, " "), portBindings(hostConfig.PortBindings),
+		orNone(string(hostConfig.RestartPolicy.Name)), healthcheckString(config.Healthcheck))
+}
+
+// shortID returns the short form of the Docker object ID
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
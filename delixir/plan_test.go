@@ -0,0 +1,230 @@
+package delixir_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	"github.com/mtfelian/elixir-testnet-updater/hooks"
+)
+
+func requireNoChanges(t *testing.T, engine *dockertest.Engine) {
+	t.Helper()
+	for _, method := range []string{"ImagePull", "ImageTag", "ContainerStop", "ContainerRemove", "ContainerCreate",
+		"ContainerStart", "ImageRemove", "ImagesPrune"} {
+		if n := engine.CallCount(method); n != 0 {
+			t.Errorf("%s was called %d times during the dry run", method, n)
+		}
+	}
+}
+
+// requireNoChangesSince checks that the engine was not changed by the calls made after the first ones
+func requireNoChangesSince(t *testing.T, engine *dockertest.Engine, first int) {
+	t.Helper()
+	for _, call := range engine.Calls()[first:] {
+		for _, method := range []string{"ImagePull", "ContainerStop", "ContainerRemove", "ContainerCreate",
+			"ContainerStart", "ImageRemove", "ImagesPrune"} {
+			if strings.HasPrefix(call, method) {
+				t.Errorf("%s was called during the dry run", call)
+			}
+		}
+	}
+}
+
+func requireActions(t *testing.T, plan delixir.Plan, prefixes ...string) {
+	t.Helper()
+	if len(plan.Actions) != len(prefixes) {
+		t.Fatalf("planned actions are %q, expected %d actions", plan.Actions, len(prefixes))
+	}
+	for i, prefix := range prefixes {
+		if !strings.HasPrefix(plan.Actions[i], prefix) {
+			t.Errorf("action %d is %q, expected it to start with %q", i+1, plan.Actions[i], prefix)
+		}
+	}
+}
+
+func TestPlanFirstInstall(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	dc, _ := newTestClient(t, engine)
+
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	requireActions(t, plan, "pull image", "create container", "start container")
+	if !strings.Contains(plan.Actions[0], remote.Digest) {
+		t.Errorf("pull action doesn't mention the digest: %q", plan.Actions[0])
+	}
+	requireNoChanges(t, engine)
+}
+
+func TestPlanNewImage(t *testing.T) {
+	engine := dockertest.NewEngine()
+	old := engine.Publish(testImage)
+	updater, _ := newTestClient(t, engine)
+	updater.CheckAndUpdateContainer(context.Background())
+	cont := requireContainer(t, engine, old.ID, dockertest.StateRunning)
+	remote := engine.Publish(testImage)
+	initialCalls := len(engine.Calls())
+
+	dc, _ := newTestClient(t, engine, func(p *delixir.DockerClientParams) {
+		p.EnvVars = []string{"STRATEGY_EXECUTOR_DISPLAY_NAME=renamed", "SIGNER_PRIVATE_KEY=0xsecret"}
+		p.RestartPolicy = "always"
+		p.Healthcheck = delixir.HealthcheckParams{Test: delixir.DefaultHealthcheckTest("17690"), Wait: time.Minute}
+	})
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	requireActions(t, plan, "pull image", "stop container", "remove container", "create container",
+		"start container", "wait up to 1m0s")
+	if !strings.Contains(plan.Actions[1], cont.ID[:12]) {
+		t.Errorf("stop action doesn't mention the container ID: %q", plan.Actions[1])
+	}
+	if !strings.Contains(plan.Actions[5], old.ID) {
+		t.Errorf("wait action doesn't mention the rollback image: %q", plan.Actions[5])
+	}
+
+	changes := strings.Join(plan.Changes, "\n")
+	for _, expected := range []string{
+		"image: " + old.ID + " -> " + remote.ID,
+		`env STRATEGY_EXECUTOR_DISPLAY_NAME: "test" -> "renamed"`,
+		"env SIGNER_PRIVATE_KEY: added (hidden)",
+		"restart policy: unless-stopped -> always",
+		"healthcheck: none -> ",
+	} {
+		if !strings.Contains(changes, expected) {
+			t.Errorf("changes don't contain %q:\n%s", expected, changes)
+		}
+	}
+	if strings.Contains(changes, "0xsecret") {
+		t.Errorf("changes reveal the secret:\n%s", changes)
+	}
+	if strings.Contains(changes, "ports:") {
+		t.Errorf("unchanged ports are reported:\n%s", changes)
+	}
+
+	requireNoChangesSince(t, engine, initialCalls)
+	requireContainer(t, engine, old.ID, dockertest.StateRunning)
+}
+
+func TestPlanUpToDate(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateRunning)
+	dc, _ := newTestClient(t, engine)
+
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	requireActions(t, plan)
+	if len(plan.Notes) != 1 || !strings.Contains(plan.Notes[0], "up to date") {
+		t.Errorf("notes are %q", plan.Notes)
+	}
+	requireNoChanges(t, engine)
+}
+
+func TestPlanExited(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateExited)
+	dc, _ := newTestClient(t, engine)
+
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	requireActions(t, plan, "start container")
+	requireNoChanges(t, engine)
+}
+
+func TestPlanDrift(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	addContainer(engine, dockertest.StateRunning)
+	dc, _ := newTestClient(t, engine, func(p *delixir.DockerClientParams) { p.RestartPolicy = "always" })
+
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	requireActions(t, plan, "stop container", "remove container", "create container", "start container")
+	if len(plan.Changes) != 1 || plan.Changes[0] != "restart policy: unless-stopped -> always" {
+		t.Errorf("changes are %q", plan.Changes)
+	}
+	requireNoChanges(t, engine)
+}
+
+func TestPlanHooks(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	updater, _ := newTestClient(t, engine)
+	updater.CheckAndUpdateContainer(context.Background())
+	engine.Publish(testImage)
+	initialCalls := len(engine.Calls())
+
+	marker := filepath.Join(t.TempDir(), "ran")
+	dc, _ := newTestClient(t, engine, withHooks(hooks.New([]hooks.Hook{
+		{Point: delixir.HookBeforePull, Command: "touch " + marker},
+		{Point: delixir.HookBeforeStop, URL: "http://backup.local/snapshot"},
+		{Point: delixir.HookAfterStart, Command: "touch " + marker},
+		{Point: delixir.HookAfterHealthy, URL: "http://monitoring.local/register"},
+		{Point: delixir.HookRollback, Command: "touch " + marker},
+	})))
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	requireActions(t, plan, "run before-pull hook command", "pull image",
+		"run before-stop hook webhook http://backup.local/snapshot", "stop container", "remove container",
+		"create container", "start container", "run after-start hook command",
+		"run after-healthy hook webhook http://monitoring.local/register")
+	if notes := strings.Join(plan.Notes, "\n"); !strings.Contains(notes, "after a rollback the rollback hooks would run") {
+		t.Errorf("rollback hooks are not noted: %q", plan.Notes)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("hook was run during the dry run")
+	}
+	requireNoChangesSince(t, engine, initialCalls)
+}
+
+func TestPlanImageCleanup(t *testing.T) {
+	const source = "org.opencontainers.image.source"
+	engine := dockertest.NewEngine()
+	oldest := engine.Publish(testImage)
+	updater, _ := newTestClient(t, engine)
+	updater.CheckAndUpdateContainer(context.Background())
+	previous := engine.Publish(testImage)
+	updater.CheckAndUpdateContainer(context.Background())
+	engine.SetImageConfig(testImage, container.Config{Labels: map[string]string{source: "https://github.com/elixir"}})
+	engine.AddDanglingImage(map[string]string{source: "https://github.com/elixir"})
+	engine.Publish(testImage)
+	initialCalls := len(engine.Calls())
+
+	dc, _ := newTestClient(t, engine, withKeepPreviousImages(1))
+	plan, err := dc.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	// the replaced image is kept for rollback, the older one is removed
+	requireActions(t, plan, "pull image", "stop container", "remove container", "create container",
+		"start container", "remove superseded image "+strings.TrimPrefix(oldest.ID, "sha256:")[:12],
+		"prune dangling images with label "+source+"=https://github.com/elixir")
+	if strings.Contains(strings.Join(plan.Actions, "\n"), strings.TrimPrefix(previous.ID, "sha256:")[:12]) {
+		t.Errorf("image kept for rollback is planned for removal: %q", plan.Actions)
+	}
+	requireNoChangesSince(t, engine, initialCalls)
+}
@@ -0,0 +1,79 @@
+package delixir
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Platform represents an image platform
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses platform string in format "os/arch[/variant]", e.g. "linux/arm64/v8"
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected format is OS/ARCH[/VARIANT]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: normalizeArchitecture(parts[1])}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// String implements fmt.Stringer
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// Matches returns whether the other platform, e.g. from a manifest list, suits p.
+// Empty variant of p matches any variant
+func (p Platform) Matches(other Platform) bool {
+	return p.OS == other.OS &&
+		p.Architecture == normalizeArchitecture(other.Architecture) &&
+		(p.Variant == "" || p.Variant == other.Variant)
+}
+
+// normalizeArchitecture converts kernel architecture names to Go/OCI ones
+func normalizeArchitecture(arch string) string {
+	switch arch {
+	case "x86_64", "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "armhf", "armv7l", "armv7":
+		return "arm"
+	case "i386", "i686":
+		return "386"
+	}
+	return arch
+}
+
+// platform returns configured platform, or detects it from the Docker daemon once
+func (dc *DockerClient) platform(ctx context.Context) (Platform, error) {
+	dc.platformMu.Lock()
+	defer dc.platformMu.Unlock()
+	if dc.detectedPlatform != nil {
+		return *dc.detectedPlatform, nil
+	}
+
+	info, err := dc.cli.Info(ctx)
+	if err != nil {
+		return Platform{}, fmt.Errorf("error detecting platform from docker daemon: %v", err)
+	}
+	p := Platform{OS: info.OSType, Architecture: normalizeArchitecture(info.Architecture)}
+	if strings.HasPrefix(info.Architecture, "armv7") || info.Architecture == "armhf" {
+		p.Variant = "v7"
+	}
+	fmt.Printf("Detected Docker daemon platform %s\n", p)
+	dc.detectedPlatform = &p
+	return p, nil
+}
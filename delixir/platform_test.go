@@ -0,0 +1,136 @@
+package delixir_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		platform delixir.Platform
+		err      bool
+	}{
+		{s: "linux/amd64", platform: delixir.Platform{OS: "linux", Architecture: "amd64"}},
+		{s: "linux/arm64/v8", platform: delixir.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{s: " Linux/X86_64 ", platform: delixir.Platform{OS: "linux", Architecture: "amd64"}},
+		{s: "linux/aarch64", platform: delixir.Platform{OS: "linux", Architecture: "arm64"}},
+		{s: "linux/armv7l/v7", platform: delixir.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{s: "linux/i686", platform: delixir.Platform{OS: "linux", Architecture: "386"}},
+		{s: "linux", err: true},
+		{s: "linux/", err: true},
+		{s: "/amd64", err: true},
+		{s: "linux/arm/v7/extra", err: true},
+		{s: "", err: true},
+	} {
+		platform, err := delixir.ParsePlatform(tc.s)
+		if tc.err {
+			if err == nil {
+				t.Errorf("ParsePlatform(%q) = %v, expected an error", tc.s, platform)
+			}
+			continue
+		}
+		if err != nil || platform != tc.platform {
+			t.Errorf("ParsePlatform(%q) = %v, %v, expected %v", tc.s, platform, err, tc.platform)
+		}
+	}
+}
+
+func TestPlatformMatches(t *testing.T) {
+	amd64 := delixir.Platform{OS: "linux", Architecture: "amd64"}
+	armv7 := delixir.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	for _, tc := range []struct {
+		platform, other delixir.Platform
+		matches         bool
+	}{
+		{amd64, delixir.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{amd64, delixir.Platform{OS: "linux", Architecture: "x86_64"}, true},
+		{amd64, delixir.Platform{OS: "linux", Architecture: "arm64"}, false},
+		{amd64, delixir.Platform{OS: "windows", Architecture: "amd64"}, false},
+		{delixir.Platform{OS: "linux", Architecture: "arm"}, armv7, true}, // any variant
+		{armv7, armv7, true},
+		{armv7, delixir.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{armv7, delixir.Platform{OS: "linux", Architecture: "arm"}, false},
+	} {
+		if matches := tc.platform.Matches(tc.other); matches != tc.matches {
+			t.Errorf("%v.Matches(%v) = %v, expected %v", tc.platform, tc.other, matches, tc.matches)
+		}
+	}
+}
+
+func withPlatform(platform string) func(*delixir.DockerClientParams) {
+	return func(p *delixir.DockerClientParams) { p.Platform = platform }
+}
+
+func TestCheckAndUpdateContainerManifestList(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	engine := dockertest.NewEngine() // the daemon platform linux/amd64 is detected
+	_, images := engine.PublishIndex(testImage, dockertest.PlatformImage{Platform: arm64},
+		dockertest.PlatformImage{Platform: amd64})
+	dc, _ := newTestClient(t, engine)
+
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, images[1].ID, dockertest.StateRunning)
+
+	// the manifest list changed for the other platform only
+	_, updated := engine.PublishIndex(testImage, dockertest.PlatformImage{Platform: arm64}, images[1])
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, images[1].ID, dockertest.StateRunning)
+	if n := engine.CallCount("ImagePull"); n != 1 {
+		t.Errorf("image was pulled %d times, expected no pull for the other platform update", n)
+	}
+	if n := engine.CallCount("RegistryGET docker.io/elixirprotocol/validator " + images[1].Digest); n != 1 {
+		t.Errorf("platform manifest was requested %d times, expected once: %v", n, engine.Calls())
+	}
+
+	_, updated = engine.PublishIndex(testImage, updated[0], dockertest.PlatformImage{Platform: amd64})
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, updated[1].ID, dockertest.StateRunning)
+}
+
+func TestCheckAndUpdateContainerManifestListVariant(t *testing.T) {
+	armv6 := ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}
+	armv7 := ocispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	engine := dockertest.NewEngine()
+	_, images := engine.PublishIndex(testImage, dockertest.PlatformImage{Platform: armv6},
+		dockertest.PlatformImage{Platform: armv7})
+	dc, _ := newTestClient(t, engine, withPlatform("linux/arm/v7"))
+
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, images[1].ID, dockertest.StateRunning)
+
+	engine.PublishIndex(testImage, dockertest.PlatformImage{Platform: armv6}, images[1])
+	dc.CheckAndUpdateContainer(context.Background())
+	if n := engine.CallCount("ImagePull"); n != 1 {
+		t.Errorf("image was pulled %d times, expected no pull for the other variant update", n)
+	}
+
+	_, updated := engine.PublishIndex(testImage, images[0], dockertest.PlatformImage{Platform: armv7})
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, updated[1].ID, dockertest.StateRunning)
+}
+
+func TestCheckAndUpdateContainerManifestListMissingPlatform(t *testing.T) {
+	s390x := ocispec.Platform{OS: "linux", Architecture: "s390x"}
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	engine := dockertest.NewEngine()
+	_, images := engine.PublishIndex(testImage, dockertest.PlatformImage{Platform: amd64},
+		dockertest.PlatformImage{Platform: s390x})
+	dc, _ := newTestClient(t, engine, withPlatform("linux/s390x"))
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, images[1].ID, dockertest.StateRunning)
+
+	// the new version is not built for the platform, the running image must be kept
+	engine.PublishIndex(testImage, dockertest.PlatformImage{Platform: amd64})
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, images[1].ID, dockertest.StateRunning)
+	if n := engine.CallCount("ContainerStop"); n != 0 {
+		t.Errorf("container was stopped %d times", n)
+	}
+}
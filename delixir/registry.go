@@ -0,0 +1,208 @@
+package delixir
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// dockerHubDomain is a domain of normalized Docker Hub image references
+const dockerHubDomain = "docker.io"
+
+// dockerHubConfigKey is a key under which Docker CLI stores Docker Hub credentials
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// RegistryParams represents container registry parameters
+type RegistryParams struct {
+	// Mirror is a registry host to pull the image from first, e.g. "registry.local:5000"
+	Mirror string
+	// DisableFallback disables pulling from the original registry if pull from the mirror fails
+	DisableFallback bool
+	// Username and Password are used for the mirror if it is set, otherwise for the image registry
+	Username string
+	Password string
+	// DockerConfigPath is a path to Docker CLI config, defaults to ~/.docker/config.json
+	DockerConfigPath string
+}
+
+// dockerConfigFile represents the part of Docker CLI config file containing credentials
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// registryHost returns the registry domain of the image reference
+func registryHost(imageRef string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+	return reference.Domain(named), nil
+}
+
+// mirrorReference returns imageRef with its registry domain replaced with mirror
+func mirrorReference(imageRef, mirror string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+	named = reference.TagNameOnly(named)
+	mirrored := strings.TrimSuffix(mirror, "/") + "/" + reference.Path(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		mirrored += ":" + tagged.Tag()
+	}
+	return mirrored, nil
+}
+
+// credentials returns authentication for the registry host.
+// Explicitly configured credentials take precedence over Docker CLI config.
+// Empty AuthConfig is returned if there are no credentials for the host
+func (rp RegistryParams) credentials(host string) (registry.AuthConfig, error) {
+	// without a mirror the only registry used is the image one
+	if rp.Username != "" && (rp.Mirror == "" || host == rp.mirrorHost()) {
+		return registry.AuthConfig{
+			Username:      rp.Username,
+			Password:      rp.Password,
+			ServerAddress: host,
+		}, nil
+	}
+	return rp.dockerConfigCredentials(host)
+}
+
+// mirrorHost returns the registry domain of the mirror
+func (rp RegistryParams) mirrorHost() string {
+	host, _, _ := strings.Cut(rp.Mirror, "/")
+	return host
+}
+
+// encodedAuth returns base64-encoded authentication for the image reference registry,
+// suitable for RegistryAuth pull option
+func (rp RegistryParams) encodedAuth(imageRef string) (string, error) {
+	host, err := registryHost(imageRef)
+	if err != nil {
+		return "", err
+	}
+	authConfig, err := rp.credentials(host)
+	if err != nil {
+		return "", err
+	}
+	if authConfig == (registry.AuthConfig{}) {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(authConfig)
+}
+
+// dockerConfigPath returns path to Docker CLI config file
+func (rp RegistryParams) dockerConfigPath() string {
+	if rp.DockerConfigPath != "" {
+		return rp.DockerConfigPath
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// dockerConfigCredentials reads credentials for the registry host from Docker CLI config,
+// including credential helpers
+func (rp RegistryParams) dockerConfigCredentials(host string) (registry.AuthConfig, error) {
+	path := rp.dockerConfigPath()
+	if path == "" {
+		return registry.AuthConfig{}, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry.AuthConfig{}, nil
+	}
+	if err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("error reading docker config: %v", err)
+	}
+
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("error parsing docker config %s: %v", path, err)
+	}
+
+	keys := []string{host}
+	if host == dockerHubDomain {
+		keys = []string{dockerHubConfigKey, "index.docker.io", dockerHubDomain}
+	}
+
+	for _, key := range keys {
+		if helper := cfg.CredHelpers[key]; helper != "" {
+			return credentialHelperGet(helper, key)
+		}
+	}
+	if cfg.CredsStore != "" {
+		return credentialHelperGet(cfg.CredsStore, keys[0])
+	}
+
+	for _, key := range keys {
+		entry, ok := cfg.Auths[key]
+		if !ok {
+			continue
+		}
+		authConfig := registry.AuthConfig{ServerAddress: key, IdentityToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return registry.AuthConfig{}, fmt.Errorf("error decoding auth for %s: %v", key, err)
+			}
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return registry.AuthConfig{}, fmt.Errorf("invalid auth for %s", key)
+			}
+			authConfig.Username, authConfig.Password = username, password
+		}
+		return authConfig, nil
+	}
+	return registry.AuthConfig{}, nil
+}
+
+// credentialHelperGet calls docker-credential-<helper> to get credentials for serverURL
+func credentialHelperGet(helper, serverURL string) (registry.AuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, "credentials not found") {
+			return registry.AuthConfig{}, nil
+		}
+		return registry.AuthConfig{}, fmt.Errorf("credential helper %q failed: %v: %s", helper, err, output)
+	}
+
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("error parsing credential helper %q output: %v", helper, err)
+	}
+
+	authConfig := registry.AuthConfig{ServerAddress: serverURL}
+	if creds.Username == "<token>" {
+		authConfig.IdentityToken = creds.Secret
+	} else {
+		authConfig.Username, authConfig.Password = creds.Username, creds.Secret
+	}
+	return authConfig, nil
+}
@@ -0,0 +1,267 @@
+package delixir_test
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+const (
+	testMirror      = "registry.local:5000"
+	testMirrorImage = testMirror + "/elixirprotocol/validator:latest"
+)
+
+// credentialHelper is a docker-credential-dockertest script answering with the requested server
+// as the secret, or with "credentials not found" for the mirror
+const credentialHelper = `#!/bin/sh
+read -r server
+case "$server" in
+  ` + testMirror + `) echo "credentials not found in native keychain"; exit 1;;
+  token.local) printf '{"ServerURL":"%s","Username":"<token>","Secret":"identity"}' "$server";;
+  *) printf '{"ServerURL":"%s","Username":"helper","Secret":"%s"}' "$server" "$server";;
+esac
+`
+
+func withRegistry(registry delixir.RegistryParams) func(*delixir.DockerClientParams) {
+	return func(p *delixir.DockerClientParams) { p.Registry = registry }
+}
+
+// writeDockerConfig writes Docker CLI config and puts the credential helper to PATH, returning the config path
+func writeDockerConfig(t *testing.T, config string) string {
+	t.Helper()
+	dir := t.TempDir()
+	helper := filepath.Join(dir, "docker-credential-dockertest")
+	if err := os.WriteFile(helper, []byte(credentialHelper), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckAndUpdateContainerMirror(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	mirrored := engine.Publish(testMirrorImage)
+	dc, notifier := newTestClient(t, engine, withRegistry(delixir.RegistryParams{
+		Mirror:   testMirror,
+		Username: "mirror-user",
+		Password: "mirror-password",
+	}))
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	cont := requireContainer(t, engine, mirrored.ID, dockertest.StateRunning)
+	if cont.Image != testImage {
+		t.Errorf("container is created from %q, expected the original name %q", cont.Image, testImage)
+	}
+	if calls := engine.Calls(); !slices.Contains(calls, "ImagePull "+testMirrorImage) ||
+		slices.Contains(calls, "ImagePull "+testImage) {
+		t.Errorf("image is not pulled from the mirror only: %v", calls)
+	}
+	auth, err := engine.PullAuth(testMirrorImage)
+	if err != nil || auth == nil || auth.Username != "mirror-user" || auth.Password != "mirror-password" {
+		t.Errorf("mirror is pulled with auth %+v, error %v", auth, err)
+	}
+	if !notifier.Contains("updated image") {
+		t.Errorf("update notification was not sent: %v", notifier.Messages())
+	}
+
+	engine.Publish(testImage) // the original registry is not consulted while the mirror is up to date
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, mirrored.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ImagePull"); n != 1 {
+		t.Errorf("image was pulled %d times, expected no pulls while the mirror has the same image", n)
+	}
+
+	updated := engine.Publish(testMirrorImage)
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, updated.ID, dockertest.StateRunning)
+}
+
+func TestCheckAndUpdateContainerMirrorFallback(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine, withRegistry(delixir.RegistryParams{Mirror: testMirror}))
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	if n := engine.CallCount("ImagePull " + testImage); n != 1 {
+		t.Errorf("image was pulled from the original registry %d times, expected once: %v", n, engine.Calls())
+	}
+	if n := engine.CallCount("RegistryHEAD docker.io/elixirprotocol/validator"); n != 1 {
+		t.Errorf("manifest was checked on the original registry %d times, expected once: %v", n, engine.Calls())
+	}
+	if notifier.Contains("failed to update") {
+		t.Errorf("fallback is reported as a failure: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerMirrorDisableFallback(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	dc, _ := newTestClient(t, engine, withRegistry(delixir.RegistryParams{
+		Mirror:          testMirror,
+		DisableFallback: true,
+	}))
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	if _, ok := engine.Container(testContainerName); ok {
+		t.Errorf("container is created although the mirror has no image")
+	}
+	if n := engine.CallCount("ImagePull " + testImage); n != 0 {
+		t.Errorf("image was pulled from the original registry %d times, expected none", n)
+	}
+	if n := engine.CallCount("RegistryHEAD docker.io/elixirprotocol/validator"); n != 0 {
+		t.Errorf("manifest was checked on the original registry %d times, expected none", n)
+	}
+	if n := engine.CallCount("ImagePull " + testMirrorImage); n != 1 {
+		t.Errorf("image was pulled from the mirror %d times, expected once", n)
+	}
+}
+
+func TestCheckAndUpdateContainerCredentials(t *testing.T) {
+	basic := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+	for _, tc := range []struct {
+		name         string
+		image        string
+		config       string
+		registry     delixir.RegistryParams
+		username     string
+		password     string
+		token        string
+		unauthorized bool
+	}{
+		{
+			name:     "docker hub auths",
+			image:    testImage,
+			config:   `{"auths":{"https://index.docker.io/v1/":{"auth":"` + basic("hub", "secret") + `"}}}`,
+			username: "hub",
+			password: "secret",
+		},
+		{
+			name:     "short docker hub key",
+			image:    testImage,
+			config:   `{"auths":{"docker.io":{"auth":"` + basic("hub", "short") + `"}}}`,
+			username: "hub",
+			password: "short",
+		},
+		{
+			name:   "identity token",
+			image:  "ghcr.io/elixir/validator:latest",
+			config: `{"auths":{"ghcr.io":{"identitytoken":"refresh"},"docker.io":{"auth":"` + basic("hub", "secret") + `"}}}`,
+			token:  "refresh",
+		},
+		{
+			name:         "other registry",
+			image:        "ghcr.io/elixir/validator:latest",
+			config:       `{"auths":{"docker.io":{"auth":"` + basic("hub", "secret") + `"}}}`,
+			unauthorized: true,
+		},
+		{
+			name:     "credential helper",
+			image:    "ghcr.io/elixir/validator:latest",
+			config:   `{"credHelpers":{"ghcr.io":"dockertest"},"auths":{"ghcr.io":{"auth":"` + basic("ignored", "x") + `"}}}`,
+			username: "helper",
+			password: "ghcr.io",
+		},
+		{
+			name:     "credential store for docker hub",
+			image:    testImage,
+			config:   `{"credsStore":"dockertest"}`,
+			username: "helper",
+			password: "https://index.docker.io/v1/",
+		},
+		{
+			name:   "credential store token",
+			image:  "token.local/elixir/validator:latest",
+			config: `{"credsStore":"dockertest"}`,
+			token:  "identity",
+		},
+		{
+			name:         "credentials not found",
+			image:        testMirror + "/elixir/validator:latest",
+			config:       `{"credsStore":"dockertest"}`,
+			unauthorized: true,
+		},
+		{
+			name:     "explicit credentials override config",
+			image:    testImage,
+			config:   `{"credsStore":"dockertest"}`,
+			registry: delixir.RegistryParams{Username: "explicit", Password: "password"},
+			username: "explicit",
+			password: "password",
+		},
+		{
+			name:     "config for the original registry behind the mirror",
+			image:    testImage,
+			config:   `{"auths":{"docker.io":{"auth":"` + basic("hub", "secret") + `"}}}`,
+			registry: delixir.RegistryParams{Mirror: testMirror, Username: "explicit", Password: "password"},
+			username: "hub",
+			password: "secret",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			engine := dockertest.NewEngine()
+			engine.Publish(tc.image)
+			registry := tc.registry
+			registry.DockerConfigPath = writeDockerConfig(t, tc.config)
+			dc, notifier := newTestClient(t, engine, withRegistry(registry), func(p *delixir.DockerClientParams) {
+				p.ImageName = tc.image
+			})
+
+			dc.CheckAndUpdateContainer(context.Background())
+
+			if _, ok := engine.Container(testContainerName); !ok {
+				t.Fatalf("container is not created: %v", notifier.Messages())
+			}
+			auth, err := engine.PullAuth(tc.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.unauthorized {
+				if auth != nil {
+					t.Errorf("image is pulled with unexpected auth %+v", auth)
+				}
+				return
+			}
+			if auth == nil {
+				t.Fatalf("image is pulled without auth")
+			}
+			if auth.Username != tc.username || auth.Password != tc.password || auth.IdentityToken != tc.token {
+				t.Errorf("image is pulled with auth %+v", auth)
+			}
+		})
+	}
+}
+
+func TestCheckAndUpdateContainerInvalidDockerConfig(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish(testImage)
+	dc, _ := newTestClient(t, engine, withRegistry(delixir.RegistryParams{
+		DockerConfigPath: writeDockerConfig(t, `{"auths":`),
+	}))
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	if n := engine.CallCount("ImagePull"); n != 0 {
+		t.Errorf("image was pulled %d times with unreadable credentials", n)
+	}
+	if _, ok := engine.Container(testContainerName); ok {
+		t.Errorf("container is created with unreadable credentials")
+	}
+}
@@ -0,0 +1,168 @@
+package delixir
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/go-units"
+)
+
+// CleanupReport represents the result of superseded images cleanup
+type CleanupReport struct {
+	RemovedImages  []string
+	SpaceReclaimed uint64
+}
+
+// String implements fmt.Stringer
+func (r CleanupReport) String() string {
+	return fmt.Sprintf("removed %d old images, reclaimed %s",
+		len(r.RemovedImages), units.HumanSize(float64(r.SpaceReclaimed)))
+}
+
+// imageSourceLabels are the labels identifying the project the image is built from, the first one the validator
+// image has scopes pruning of dangling images
+var imageSourceLabels = []string{"org.opencontainers.image.source", "org.opencontainers.image.title"}
+
+// imageRepositories returns familiar repository names the validator image may be stored under
+func (dc *DockerClient) imageRepositories() map[string]bool {
+	repos := make(map[string]bool)
+	refs := []string{dc.imageName}
+	if dc.registry.Mirror != "" {
+		if mirrorRef, err := mirrorReference(dc.imageName, dc.registry.Mirror); err == nil {
+			refs = append(refs, mirrorRef)
+		}
+	}
+	for _, ref := range refs {
+		if named, err := reference.ParseNormalizedNamed(ref); err == nil {
+			repos[reference.FamiliarName(named)] = true
+		}
+	}
+	return repos
+}
+
+// isSupersededImage returns whether the image is an untagged image of one of repos
+func isSupersededImage(img image.Summary, repos map[string]bool) bool {
+	for _, tag := range img.RepoTags {
+		if tag != "<none>:<none>" {
+			return false
+		}
+	}
+	for _, repoDigest := range img.RepoDigests {
+		named, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if repos[reference.FamiliarName(named)] {
+			return true
+		}
+	}
+	return false
+}
+
+// supersededImages returns superseded validator images to remove: all except the current one and keepPrevious
+// most recent ones, which are left for rollback, and the kept ones. The image of the replaced container, if set,
+// is treated as superseded and not used by it, as it becomes after the update.
+// Images used by any container and images of other repositories are never removed
+func (dc *DockerClient) supersededImages(ctx context.Context, currentImageID string, keepPrevious int,
+	replaced ContainerData,
+) (remove, keep []image.Summary, err error) {
+	containers, err := dc.cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	inUse := map[string]bool{currentImageID: true}
+	for _, cont := range containers {
+		if cont.ID != replaced.ContainerID {
+			inUse[cont.ImageID] = true
+		}
+	}
+
+	images, err := dc.cli.ImageList(ctx, image.ListOptions{All: true})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repos := dc.imageRepositories()
+	var superseded []image.Summary
+	for _, img := range images {
+		if img.ID == replaced.ImageID && img.ID != currentImageID {
+			img.RepoTags = nil // the tag moves to the pulled image
+		}
+		if !inUse[img.ID] && isSupersededImage(img, repos) {
+			superseded = append(superseded, img)
+		}
+	}
+	sort.Slice(superseded, func(i, j int) bool { return superseded[i].Created > superseded[j].Created })
+
+	if keepPrevious > len(superseded) {
+		keepPrevious = len(superseded)
+	}
+	return superseded[keepPrevious:], superseded[:keepPrevious], nil
+}
+
+// cleanupImages removes superseded validator images, see supersededImages, then prunes dangling images
+// of the validator, see pruneDanglingImages
+func (dc *DockerClient) cleanupImages(ctx context.Context, currentImageID string, keepPrevious int) (CleanupReport, error) {
+	var report CleanupReport
+
+	remove, keep, err := dc.supersededImages(ctx, currentImageID, keepPrevious, ContainerData{})
+	if err != nil {
+		return report, err
+	}
+	for _, img := range keep {
+		fmt.Printf("Keeping previous image %s for rollback\n", img.ID)
+	}
+	for _, img := range remove {
+		fmt.Printf("Removing superseded image %s...\n", img.ID)
+		if _, err := dc.cli.ImageRemove(ctx, img.ID, image.RemoveOptions{PruneChildren: true}); err != nil {
+			log.Printf("Error removing image %s: %v", img.ID, err)
+			continue
+		}
+		report.RemovedImages = append(report.RemovedImages, img.ID)
+		report.SpaceReclaimed += uint64(img.Size)
+	}
+
+	pruneReport, err := dc.pruneDanglingImages(ctx, currentImageID)
+	if err != nil {
+		return report, fmt.Errorf("error pruning dangling images: %v", err)
+	}
+	for _, deleted := range pruneReport.ImagesDeleted {
+		if deleted.Deleted != "" {
+			report.RemovedImages = append(report.RemovedImages, deleted.Deleted)
+		}
+	}
+	report.SpaceReclaimed += pruneReport.SpaceReclaimed
+
+	return report, nil
+}
+
+// pruneDanglingImages prunes dangling images of the validator, see danglingImagesFilters
+func (dc *DockerClient) pruneDanglingImages(ctx context.Context, currentImageID string) (image.PruneReport, error) {
+	pruneFilters, ok, err := dc.danglingImagesFilters(ctx, currentImageID)
+	if err != nil || !ok {
+		return image.PruneReport{}, err
+	}
+	return dc.cli.ImagesPrune(ctx, pruneFilters)
+}
+
+// danglingImagesFilters returns filters of dangling images having the same source label as the validator image,
+// i.e. layers of its earlier builds. It returns false if the image has none of imageSourceLabels,
+// as dangling images of other projects can't be told apart then
+func (dc *DockerClient) danglingImagesFilters(ctx context.Context, imageID string) (filters.Args, bool, error) {
+	img, _, err := dc.cli.ImageInspectWithRaw(ctx, imageID)
+	if err != nil || img.Config == nil {
+		return filters.Args{}, false, err
+	}
+	for _, label := range imageSourceLabels {
+		if value, ok := img.Config.Labels[label]; ok {
+			return filters.NewArgs(filters.Arg("dangling", "true"), filters.Arg("label", label+"="+value)), true, nil
+		}
+	}
+	return filters.Args{}, false, nil
+}
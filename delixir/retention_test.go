@@ -0,0 +1,109 @@
+package delixir_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+func withKeepPreviousImages(n int) func(*delixir.DockerClientParams) {
+	return func(p *delixir.DockerClientParams) { p.KeepPreviousImages = n }
+}
+
+// imageIDs returns IDs of the local images
+func imageIDs(engine *dockertest.Engine) []string {
+	var ids []string
+	for _, img := range engine.Images() {
+		ids = append(ids, img.ID)
+	}
+	return ids
+}
+
+func TestCheckAndUpdateContainerKeepsPreviousImages(t *testing.T) {
+	engine := dockertest.NewEngine()
+	dc, notifier := newTestClient(t, engine, withKeepPreviousImages(1))
+	var versions []dockertest.RemoteImage
+	for range 3 {
+		versions = append(versions, engine.Publish(testImage))
+		dc.CheckAndUpdateContainer(context.Background())
+	}
+
+	requireContainer(t, engine, versions[2].ID, dockertest.StateRunning)
+	if ids := imageIDs(engine); !slices.Equal(ids, []string{versions[1].ID, versions[2].ID}) {
+		t.Errorf("local images are %v, expected the current one and the previous one kept for rollback", ids)
+	}
+	if !notifier.Contains("images cleanup: removed 1 old images") {
+		t.Errorf("cleanup is not notified: %v", notifier.Messages())
+	}
+
+	notifier.Reset()
+	dc.CheckAndUpdateContainer(context.Background())
+	if n := engine.CallCount("ImageRemove"); n != 1 {
+		t.Errorf("images were removed %d times, expected once", n)
+	}
+	if messages := notifier.Messages(); len(messages) != 0 {
+		t.Errorf("check without removed images sent notifications: %v", messages)
+	}
+}
+
+func TestCheckAndUpdateContainerKeepsOtherImages(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.Publish("nginx:latest")
+	otherOld := engine.PullLocal("nginx:latest")
+	engine.Publish("nginx:latest")
+	otherCurrent := engine.PullLocal("nginx:latest")
+	dangling := engine.AddDanglingImage(nil)
+	first := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine, withKeepPreviousImages(0))
+	dc.CheckAndUpdateContainer(context.Background())
+
+	second := engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, second.ID, dockertest.StateRunning)
+	ids := imageIDs(engine)
+	for _, id := range []string{otherOld.ID, otherCurrent.ID, dangling.ID} {
+		if !slices.Contains(ids, id) {
+			t.Errorf("image %s of another repository is removed", id)
+		}
+	}
+	if slices.Contains(ids, first.ID) {
+		t.Errorf("superseded validator image %s is not removed", first.ID)
+	}
+	if !notifier.Contains("images cleanup: removed 1 old images") {
+		t.Errorf("cleanup is not notified: %v", notifier.Messages())
+	}
+}
+
+func TestCheckAndUpdateContainerPrunesDanglingValidatorImages(t *testing.T) {
+	const source = "org.opencontainers.image.source"
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	engine.PullLocal(testImage)
+	engine.SetImageConfig(testImage, container.Config{Labels: map[string]string{source: "https://github.com/elixir"}})
+	addContainer(engine, dockertest.StateRunning)
+	validatorLayer := engine.AddDanglingImage(map[string]string{source: "https://github.com/elixir"})
+	otherLayer := engine.AddDanglingImage(map[string]string{source: "https://github.com/other"})
+	unlabelled := engine.AddDanglingImage(nil)
+	dc, notifier := newTestClient(t, engine, withKeepPreviousImages(0))
+
+	dc.CheckAndUpdateContainer(context.Background())
+
+	requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	ids := imageIDs(engine)
+	if slices.Contains(ids, validatorLayer.ID) {
+		t.Errorf("dangling validator image %s is not pruned", validatorLayer.ID)
+	}
+	for _, id := range []string{otherLayer.ID, unlabelled.ID} {
+		if !slices.Contains(ids, id) {
+			t.Errorf("dangling image %s of another project is pruned", id)
+		}
+	}
+	if !notifier.Contains("images cleanup: removed 1 old images, reclaimed 10.49MB") {
+		t.Errorf("cleanup is not notified: %v", notifier.Messages())
+	}
+}
@@ -0,0 +1,62 @@
+package delixir
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// RolloutGate coordinates container updates across a fleet, e.g. to update canary instances first
+type RolloutGate interface {
+	// Allow returns whether the container may be updated to the image now, and the reason if it may not.
+	// The image is identified by its registry digest, or by its ID if the digest is unknown
+	Allow(ctx context.Context, image string) (bool, string, error)
+	// Report the update result, updateErr is nil on success
+	Report(ctx context.Context, image string, updateErr error) error
+}
+
+// rolloutImage returns the registry digest of the image, or its ID if the digest is unknown
+func (dc *DockerClient) rolloutImage(ctx context.Context, imageID string) string {
+	info, _, err := dc.cli.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		log.Printf("Error inspecting image %s: %v", imageID, err)
+		return imageID
+	}
+	if digest := dc.repoDigest(info.RepoDigests); digest != "" {
+		return digest
+	}
+	return imageID
+}
+
+// rolloutAllowed asks the rollout gate whether the container may be updated to the image.
+// Updates are held while the gate is unavailable. A held update is notified once per image
+func (dc *DockerClient) rolloutAllowed(ctx context.Context, imageID string) bool {
+	if dc.rolloutGate == nil {
+		return true
+	}
+	allowed, reason, err := dc.rolloutGate.Allow(ctx, dc.rolloutImage(ctx, imageID))
+	if err != nil {
+		log.Printf("Rollout coordination is unavailable: %v", err)
+		reason = "rollout coordination is unavailable"
+	}
+	if allowed && err == nil {
+		dc.heldImageID = ""
+		return true
+	}
+	log.Printf("Update to image %q is held: %s", imageID, reason)
+	if dc.heldImageID != imageID {
+		dc.heldImageID = imageID
+		dc.notifier.SendBroadcastMessage(fmt.Sprintf("update to image %q is held: %s", imageID, reason))
+	}
+	return false
+}
+
+// reportRollout reports the update result to the rollout gate
+func (dc *DockerClient) reportRollout(ctx context.Context, imageID string, updateErr error) {
+	if dc.rolloutGate == nil {
+		return
+	}
+	if err := dc.rolloutGate.Report(ctx, dc.rolloutImage(ctx, imageID), updateErr); err != nil {
+		log.Printf("Failed to report the update result: %v", err)
+	}
+}
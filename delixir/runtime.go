@@ -0,0 +1,98 @@
+package delixir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// container runtimes, see DockerClientParams.Runtime
+const (
+	RuntimeAuto   = "auto"
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+)
+
+// Runtimes lists the supported container runtimes
+var Runtimes = []string{RuntimeAuto, RuntimeDocker, RuntimePodman}
+
+// dockerSocket is the default Docker daemon socket
+const dockerSocket = "/var/run/docker.sock"
+
+// dockerSockets returns Docker daemon sockets in the order of preference: the rootless one of the current user,
+// then the rootful one
+func dockerSockets() []string {
+	var sockets []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "docker.sock"))
+	}
+	if uid := os.Getuid(); uid > 0 {
+		sockets = append(sockets, fmt.Sprintf("/run/user/%d/docker.sock", uid))
+	}
+	return slices.Compact(append(sockets, dockerSocket))
+}
+
+// podmanSockets returns Podman API sockets in the order of preference: the rootless one of the current user,
+// then the rootful one
+func podmanSockets() []string {
+	var sockets []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	if uid := os.Getuid(); uid > 0 {
+		sockets = append(sockets, fmt.Sprintf("/run/user/%d/podman/podman.sock", uid))
+	}
+	return slices.Compact(append(sockets, "/run/podman/podman.sock"))
+}
+
+// DetectHost returns the API host URL of the container runtime: the explicit host, or the DOCKER_HOST
+// (or CONTAINER_HOST for Podman) environment variable, or the first existing socket of the runtime.
+// Auto runtime prefers Docker to Podman. If no socket exists yet, the rootful Docker one, or the preferred Podman
+// one for Podman runtime, is returned to wait for it
+func DetectHost(runtime, host string) (string, error) {
+	if !slices.Contains(Runtimes, runtime) {
+		return "", fmt.Errorf("unknown container runtime %q, supported are: %s", runtime, strings.Join(Runtimes, ", "))
+	}
+	if host != "" {
+		return host, nil
+	}
+	if env := os.Getenv("DOCKER_HOST"); env != "" {
+		return env, nil
+	}
+	if env := os.Getenv("CONTAINER_HOST"); env != "" && runtime != RuntimeDocker && strings.HasPrefix(env, "unix://") {
+		return env, nil
+	}
+
+	var sockets []string
+	if runtime != RuntimePodman {
+		sockets = append(sockets, dockerSockets()...)
+	}
+	if runtime != RuntimeDocker {
+		sockets = append(sockets, podmanSockets()...)
+	}
+	for _, socket := range sockets {
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return "unix://" + socket, nil
+		}
+	}
+	if runtime == RuntimePodman {
+		return "unix://" + sockets[0], nil
+	}
+	return "unix://" + dockerSocket, nil
+}
+
+// sameTag returns whether the image references name the same tagged image, e.g. Docker shows
+// "elixirprotocol/validator:latest" while Podman shows "docker.io/elixirprotocol/validator:latest"
+func sameTag(a, b string) bool {
+	if a == b {
+		return true
+	}
+	namedA, errA := reference.ParseNormalizedNamed(a)
+	namedB, errB := reference.ParseNormalizedNamed(b)
+	return errA == nil && errB == nil &&
+		reference.TagNameOnly(namedA).String() == reference.TagNameOnly(namedB).String()
+}
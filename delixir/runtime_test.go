@@ -0,0 +1,99 @@
+package delixir_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+func TestCheckAndUpdateContainerFullImageNames(t *testing.T) {
+	engine := dockertest.NewEngine()
+	engine.FullNames = true
+	first := engine.Publish(testImage)
+	dc, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) { p.KeepPreviousImages = 0 })
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, first.ID, dockertest.StateRunning)
+
+	second := engine.Publish(testImage)
+	dc.CheckAndUpdateContainer(context.Background())
+	requireContainer(t, engine, second.ID, dockertest.StateRunning)
+	dc.CheckAndUpdateContainer(context.Background())
+	if n := engine.CallCount("ImagePull"); n != 2 {
+		t.Errorf("image was pulled %d times, expected 2", n)
+	}
+	if n := engine.CallCount("ContainerCreate"); n != 2 {
+		t.Errorf("container was created %d times, expected 2", n)
+	}
+	for _, img := range engine.Images() {
+		if img.ID == first.ID {
+			t.Errorf("superseded image was not removed")
+		}
+	}
+	if len(notifier.Messages()) == 0 {
+		t.Errorf("update was not notified")
+	}
+}
+
+// listenUnix listens on the unix socket at the path, creating its directory
+func listenUnix(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+}
+
+func TestDetectHost(t *testing.T) {
+	runtimeDir := t.TempDir()
+	socket := filepath.Join(runtimeDir, "podman", "podman.sock")
+	listenUnix(t, socket)
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("CONTAINER_HOST", "")
+
+	for _, tc := range []struct {
+		name, runtime, host, env, expected string
+	}{
+		{name: "podman socket", runtime: delixir.RuntimePodman, expected: "unix://" + socket},
+		{name: "explicit host", runtime: delixir.RuntimePodman, host: "tcp://10.0.0.1:2375", expected: "tcp://10.0.0.1:2375"},
+		{name: "environment", runtime: delixir.RuntimeAuto, env: "unix:///tmp/docker.sock", expected: "unix:///tmp/docker.sock"},
+		{name: "docker default", runtime: delixir.RuntimeDocker, expected: "unix:///var/run/docker.sock"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("DOCKER_HOST", tc.env)
+			host, err := delixir.DetectHost(tc.runtime, tc.host)
+			if err != nil || host != tc.expected {
+				t.Errorf("DetectHost returned %q, %v, expected %q", host, err, tc.expected)
+			}
+		})
+	}
+
+	if _, err := delixir.DetectHost("containerd", ""); err == nil {
+		t.Errorf("DetectHost accepted unknown runtime")
+	}
+}
+
+func TestDetectHostRootlessDocker(t *testing.T) {
+	runtimeDir := t.TempDir()
+	socket := filepath.Join(runtimeDir, "docker.sock")
+	listenUnix(t, socket)
+	listenUnix(t, filepath.Join(runtimeDir, "podman", "podman.sock"))
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	t.Setenv("DOCKER_HOST", "")
+	t.Setenv("CONTAINER_HOST", "")
+
+	for _, runtime := range []string{delixir.RuntimeDocker, delixir.RuntimeAuto} {
+		if host, err := delixir.DetectHost(runtime, ""); err != nil || host != "unix://"+socket {
+			t.Errorf("DetectHost(%q) returned %q, %v, expected the rootless Docker socket", runtime, host, err)
+		}
+	}
+}
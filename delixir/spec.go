@@ -0,0 +1,236 @@
+package delixir
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+)
+
+// sensitiveEnvRegexp matches names of environment variables which values are not shown in changes
+var sensitiveEnvRegexp = regexp.MustCompile(`(?i)key|secret|password|token|mnemonic`)
+
+// containerSpec returns the configuration of the validator container created from imageRef
+// to replace the container of previousImage, which is empty on the first installation
+func (dc *DockerClient) containerSpec(imageRef, previousImage string) (*container.Config, *container.HostConfig, error) {
+	exposedPorts, portBindings, err := dc.portMappings()
+	if err != nil {
+		return nil, nil, err
+	}
+	config := &container.Config{
+		Image:        imageRef,
+		Env:          dc.envVars,
+		ExposedPorts: exposedPorts,
+		Healthcheck:  dc.healthConfig(),
+	}
+	hostConfig := &container.HostConfig{
+		PortBindings: portBindings,
+		RestartPolicy: container.RestartPolicy{
+			Name: container.RestartPolicyMode(dc.restartPolicy),
+		},
+	}
+	config.Labels = dc.containerLabels(config, hostConfig, previousImage)
+	return config, hostConfig, nil
+}
+
+// portMappings returns exposed ports and their bindings: the validator port published on the host IP and port,
+// and the extra port mappings
+func (dc *DockerClient) portMappings() (nat.PortSet, nat.PortMap, error) {
+	natPort, err := nat.NewPort("tcp", dc.port)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating NatPort: %v", err)
+	}
+	exposedPorts := nat.PortSet{natPort: struct{}{}}
+	portBindings := nat.PortMap{natPort: {{HostIP: dc.hostIP, HostPort: dc.hostPort}}}
+
+	for _, spec := range dc.extraPorts {
+		mappings, err := nat.ParsePortSpec(spec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid port mapping %q: %v", spec, err)
+		}
+		for _, m := range mappings {
+			exposedPorts[m.Port] = struct{}{}
+			portBindings[m.Port] = append(portBindings[m.Port], m.Binding)
+		}
+	}
+	return exposedPorts, portBindings, nil
+}
+
+// hostPorts returns host ports published by the container in "PORT/PROTOCOL" format
+func (dc *DockerClient) hostPorts() map[string]bool {
+	_, portBindings, _ := dc.portMappings() // validated on creation of the client
+	ports := make(map[string]bool)
+	for port, bindings := range portBindings {
+		for _, b := range bindings {
+			if b.HostPort != "" {
+				ports[b.HostPort+"/"+port.Proto()] = true
+			}
+		}
+	}
+	return ports
+}
+
+// specChanges describes differences of the container managed settings from the desired ones.
+// imageConfig is the configuration of the container image, which Docker merges into the container configuration,
+// it may be nil
+func specChanges(current types.ContainerJSON, imageConfig *container.Config,
+	config *container.Config, hostConfig *container.HostConfig,
+) []string {
+	var currentConfig, image container.Config
+	var currentHostConfig container.HostConfig
+	if current.Config != nil {
+		currentConfig = *current.Config
+	}
+	if current.ContainerJSONBase != nil && current.HostConfig != nil {
+		currentHostConfig = *current.HostConfig
+	}
+	if imageConfig != nil {
+		image = *imageConfig
+	}
+
+	changes := envChanges(currentConfig.Env, image.Env, config.Env, managedEnvNames(currentConfig.Labels))
+	if currentPorts, ports := portBindings(currentHostConfig.PortBindings), portBindings(hostConfig.PortBindings); currentPorts != ports {
+		changes = append(changes, fmt.Sprintf("ports: %s -> %s", currentPorts, ports))
+	}
+	if currentPolicy, policy := restartPolicy(currentHostConfig.RestartPolicy), restartPolicy(hostConfig.RestartPolicy); currentPolicy != policy {
+		changes = append(changes, fmt.Sprintf("restart policy: %s -> %s", currentPolicy, policy))
+	}
+	currentCheck, check := healthcheckString(currentConfig.Healthcheck), healthcheckString(config.Healthcheck)
+	if config.Healthcheck == nil && currentCheck == healthcheckString(image.Healthcheck) {
+		currentCheck = check // the health check of the image is inherited
+	}
+	if currentCheck != check {
+		changes = append(changes, fmt.Sprintf("healthcheck: %s -> %s", currentCheck, check))
+	}
+	return changes
+}
+
+// runtimeEnv are the names of environment variables the container runtime sets itself, e.g. Podman
+// adds container=podman
+var runtimeEnv = map[string]bool{"container": true, "HOSTNAME": true, "HOME": true}
+
+// managedEnvNames returns names of environment variables the updater set in the container with the labels,
+// or nil if the container was created without the LabelEnvNames label
+func managedEnvNames(labels map[string]string) map[string]bool {
+	value, ok := labels[LabelEnvNames]
+	if !ok {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// envChanges describes changes of environment variables, values of sensitive ones are hidden.
+// Only the desired variables and the managed ones, set by the updater before, are compared. If managed is nil,
+// as the container was created without knowing it, others except the ones inherited from imageEnv or set
+// by the runtime are reported as removed
+func envChanges(current, imageEnv, desired []string, managed map[string]bool) []string {
+	desiredVars := make(map[string]string, len(desired))
+	for _, kv := range desired {
+		name, value, _ := strings.Cut(kv, "=")
+		desiredVars[name] = value
+	}
+	inherited := make(map[string]bool, len(imageEnv))
+	for _, kv := range imageEnv {
+		inherited[kv] = true
+	}
+	currentVars := make(map[string]string, len(current))
+	for _, kv := range current {
+		name, value, _ := strings.Cut(kv, "=")
+		if _, ok := desiredVars[name]; !ok && !managed[name] && (managed != nil || inherited[kv] || runtimeEnv[name]) {
+			continue
+		}
+		currentVars[name] = value
+	}
+
+	names := make([]string, 0, len(currentVars)+len(desiredVars))
+	for name := range currentVars {
+		names = append(names, name)
+	}
+	for name := range desiredVars {
+		if _, ok := currentVars[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+		currentValue, inCurrent := currentVars[name]
+		value, inDesired := desiredVars[name]
+		switch {
+		case !inDesired:
+			changes = append(changes, fmt.Sprintf("env %s: removed", name))
+		case !inCurrent:
+			changes = append(changes, fmt.Sprintf("env %s: added %s", name, envValue(name, value)))
+		case currentValue != value:
+			changes = append(changes, fmt.Sprintf("env %s: %s -> %s", name, envValue(name, currentValue), envValue(name, value)))
+		}
+	}
+	return changes
+}
+
+// restartPolicy formats the restart policy, Docker reports the empty one as "no"
+func restartPolicy(policy container.RestartPolicy) string {
+	name := string(policy.Name)
+	if name == "" {
+		name = string(container.RestartPolicyDisabled)
+	}
+	if policy.MaximumRetryCount > 0 {
+		return fmt.Sprintf("%s:%d", name, policy.MaximumRetryCount)
+	}
+	return name
+}
+
+// envValue returns the quoted value of the environment variable, or a placeholder if it's sensitive
+func envValue(name, value string) string {
+	if sensitiveEnvRegexp.MatchString(name) {
+		return "(hidden)"
+	}
+	return fmt.Sprintf("%q", value)
+}
+
+// portBindings formats port bindings like "0.0.0.0:17690->17690/tcp"
+func portBindings(bindings nat.PortMap) string {
+	var parts []string
+	for port, hostBindings := range bindings {
+		for _, b := range hostBindings {
+			hostIP := b.HostIP
+			if hostIP == "" {
+				hostIP = "0.0.0.0" // Docker publishes on all interfaces either way
+			}
+			parts = append(parts, fmt.Sprintf("%s:%s->%s", hostIP, b.HostPort, port))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// healthcheckString formats the health check configuration
+func healthcheckString(hc *container.HealthConfig) string {
+	if hc == nil || len(hc.Test) == 0 || reflect.DeepEqual(hc.Test, []string{"NONE"}) {
+		return "none"
+	}
+	return fmt.Sprintf("%q every %s, timeout %s, start period %s, %d retries",
+		strings.Join(hc.Test, " "), hc.Interval, hc.Timeout, hc.StartPeriod, hc.Retries)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package delixir_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+)
+
+func TestContainerPortMappings(t *testing.T) {
+	engine := dockertest.NewEngine()
+	remote := engine.Publish(testImage)
+	dc, _ := newTestClient(t, engine, func(p *delixir.DockerClientParams) {
+		p.HostIP = "127.0.0.1"
+		p.HostPort = "27690"
+		p.ExtraPorts = []string{"9000:9000/udp", "10.0.0.5:8080:80"}
+	})
+	dc.CheckAndUpdateContainer(context.Background())
+
+	cont := requireContainer(t, engine, remote.ID, dockertest.StateRunning)
+	expected := map[nat.Port]nat.PortBinding{
+		"17690/tcp": {HostIP: "127.0.0.1", HostPort: "27690"},
+		"9000/udp":  {HostPort: "9000"},
+		"80/tcp":    {HostIP: "10.0.0.5", HostPort: "8080"},
+	}
+	for port, binding := range expected {
+		bindings := cont.HostConfig.PortBindings[port]
+		if len(bindings) != 1 || bindings[0] != binding {
+			t.Errorf("bindings of %s are %v, expected %v", port, bindings, binding)
+		}
+		if _, ok := cont.Config.ExposedPorts[port]; !ok {
+			t.Errorf("port %s is not exposed", port)
+		}
+	}
+	if n := len(cont.HostConfig.PortBindings); n != len(expected) {
+		t.Errorf("there are %d port bindings, expected %d", n, len(expected))
+	}
+}
+
+func TestContainerPortConflictUDP(t *testing.T) {
+	for proto, conflict := range map[string]bool{"udp": true, "tcp": false} {
+		t.Run(proto, func(t *testing.T) {
+			engine := dockertest.NewEngine()
+			engine.Publish(testImage)
+			engine.Publish("dns:latest")
+			engine.PullLocal("dns:latest")
+			engine.AddContainer("dns", "dns:latest", dockertest.StateRunning)
+			engine.SetContainerConfig("dns", container.Config{Image: "dns:latest"}, container.HostConfig{
+				PortBindings: nat.PortMap{"53/udp": {{HostPort: "9000"}}},
+			})
+			dc, notifier := newTestClient(t, engine, func(p *delixir.DockerClientParams) {
+				p.ExtraPorts = []string{"9000:9000/" + proto}
+			})
+
+			dc.CheckAndUpdateContainer(context.Background())
+
+			if _, ok := engine.Container(testContainerName); ok == conflict {
+				t.Errorf("container exists: %v, notifications: %v", ok, notifier.Messages())
+			}
+			if conflict && !notifier.Contains(`ports are already published by container "dns"`) {
+				t.Errorf("conflict is not notified: %v", notifier.Messages())
+			}
+		})
+	}
+}
+
+func TestInvalidPortMapping(t *testing.T) {
+	_, err := delixir.NewDockerClient(delixir.DockerClientParams{
+		Port:       "17690",
+		ExtraPorts: []string{"9000:abc"},
+		API:        dockertest.NewEngine(),
+	})
+	if err == nil || !strings.Contains(err.Error(), `invalid port mapping "9000:abc"`) {
+		t.Errorf("NewDockerClient returned %v", err)
+	}
+}
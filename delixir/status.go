@@ -0,0 +1,57 @@
+package delixir
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// ContainerStatus represents the current state of the validator container
+type ContainerStatus struct {
+	ContainerID string
+	ImageID     string
+	// ImageDigest is the registry digest of the image, empty if it's unknown
+	ImageDigest string
+	State       string
+	// Health is Docker health status, see ContainerHealth
+	Health string
+}
+
+// Status returns the current state of the validator container
+func (dc *DockerClient) Status(ctx context.Context) (ContainerStatus, error) {
+	current, err := dc.getCurrentContainerData(ctx)
+	if err != nil {
+		return ContainerStatus{}, err
+	}
+	status := ContainerStatus{
+		ContainerID: current.ContainerID,
+		ImageID:     current.ImageID,
+		State:       current.State,
+	}
+	if status.Health, err = dc.containerHealth(ctx, current.ContainerID); err != nil {
+		return status, fmt.Errorf("error inspecting container: %v", err)
+	}
+	info, _, err := dc.cli.ImageInspectWithRaw(ctx, current.ImageID)
+	if err != nil {
+		return status, fmt.Errorf("error inspecting image %s: %v", current.ImageID, err)
+	}
+	status.ImageDigest = dc.repoDigest(info.RepoDigests)
+	return status, nil
+}
+
+// repoDigest returns the digest of the first repository digest of the validator image repositories
+func (dc *DockerClient) repoDigest(repoDigests []string) string {
+	repos := dc.imageRepositories()
+	for _, repoDigest := range repoDigests {
+		named, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil || !repos[reference.FamiliarName(named)] {
+			continue
+		}
+		if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+			return digest
+		}
+	}
+	return ""
+}
@@ -0,0 +1,411 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/config"
+)
+
+// defaultHealthInterval is the interval of service state checks after start
+const defaultHealthInterval = 2 * time.Second
+
+// host deployment statuses
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// Params represents deployment parameters
+type Params struct {
+	Inventory Inventory
+	// Binary is a prebuilt updater binary, the current module is built for the inventory GOARCH if empty
+	Binary string
+	// HealthInterval is the interval of service state checks after start, defaults to 2 seconds
+	HealthInterval time.Duration
+}
+
+// Deployer deploys the updater to inventory hosts
+type Deployer struct {
+	inv            Inventory
+	binaryPath     string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	healthSoak     time.Duration
+}
+
+// New creates new deployer
+func New(p Params) *Deployer {
+	d := &Deployer{
+		inv:            p.Inventory,
+		binaryPath:     p.Binary,
+		healthInterval: p.HealthInterval,
+	}
+	d.healthTimeout, _ = time.ParseDuration(p.Inventory.HealthTimeout) // validated by LoadInventory
+	d.healthSoak, _ = time.ParseDuration(p.Inventory.HealthSoak)
+	if d.healthInterval <= 0 {
+		d.healthInterval = defaultHealthInterval
+	}
+	return d
+}
+
+// Result represents the deployment result of a host
+type Result struct {
+	Host     Host
+	Status   string
+	Duration time.Duration
+	Err      error
+}
+
+// Summary represents deployment results in inventory order
+type Summary []Result
+
+// Failed returns whether any host was not deployed
+func (s Summary) Failed() bool {
+	for _, r := range s {
+		if r.Status != StatusOK {
+			return true
+		}
+	}
+	return false
+}
+
+// Print the summary table
+func (s Summary) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tCANARY\tSTATUS\tDURATION\tERROR")
+	for _, r := range s {
+		var errText string
+		if r.Err != nil {
+			errText = r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\n", r.Host, r.Host.Canary, r.Status, r.Duration.Round(time.Millisecond), errText)
+	}
+	_ = tw.Flush()
+}
+
+// Run builds the binary if needed and deploys it with rendered configuration to all hosts.
+// Canary hosts are deployed first, if any of them fails, other hosts are skipped
+func (d *Deployer) Run(ctx context.Context) (Summary, error) {
+	baseConfig, err := os.ReadFile(d.inv.Config)
+	if err != nil {
+		return nil, fmt.Errorf("error reading configuration: %v", err)
+	}
+
+	// render all configurations first to find mistakes before touching any host
+	configs := make([][]byte, len(d.inv.Hosts))
+	for i, host := range d.inv.Hosts {
+		if configs[i], err = renderConfig(baseConfig, host); err != nil {
+			return nil, fmt.Errorf("configuration for %s: %v", host, err)
+		}
+	}
+
+	binaryPath := d.binaryPath
+	if binaryPath == "" {
+		dir, err := os.MkdirTemp("", "deploy")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		binaryPath = filepath.Join(dir, d.inv.BinaryName)
+		if err := build(ctx, binaryPath, d.inv.GOARCH); err != nil {
+			return nil, err
+		}
+	}
+	binary, err := os.ReadFile(binaryPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading binary: %v", err)
+	}
+
+	summary := make(Summary, len(d.inv.Hosts))
+	var canaries, others []int
+	for i, host := range d.inv.Hosts {
+		summary[i].Host = host
+		if host.Canary {
+			canaries = append(canaries, i)
+		} else {
+			others = append(others, i)
+		}
+	}
+
+	d.wave(ctx, canaries, binary, configs, summary)
+	for _, i := range canaries {
+		if summary[i].Status != StatusOK {
+			for _, j := range others {
+				summary[j].Status = StatusSkipped
+				summary[j].Err = fmt.Errorf("canary %s failed", summary[i].Host)
+			}
+			return summary, nil
+		}
+	}
+	d.wave(ctx, others, binary, configs, summary)
+	return summary, nil
+}
+
+// build the updater binary from the module in the working directory for Linux
+func build(ctx context.Context, output, goarch string) error {
+	log.Printf("Building %s for linux/%s...", output, goarch)
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", output, ".")
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+goarch, "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error building binary: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// wave deploys hosts by indexes with the configured parallelism, storing results into summary
+func (d *Deployer) wave(ctx context.Context, indexes []int, binary []byte, configs [][]byte, summary Summary) {
+	sem := make(chan struct{}, d.inv.Parallel)
+	var wg sync.WaitGroup
+	for _, i := range indexes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			host, started := d.inv.Hosts[i], time.Now()
+			log.Printf(">>> Deploying %s", host)
+			err := d.deployHost(ctx, host, binary, configs[i])
+			summary[i].Duration = time.Since(started)
+			summary[i].Status, summary[i].Err = StatusOK, err
+			if err != nil {
+				summary[i].Status = StatusFailed
+				log.Printf("<<< Deploying %s failed: %v", host, err)
+				return
+			}
+			log.Printf("<<< Deployed %s", host)
+		}()
+	}
+	wg.Wait()
+}
+
+// deployHost uploads and verifies the binary and the configuration, then restarts the service with them,
+// or installs it on the first deployment, and waits for it and the validator container to become healthy
+func (d *Deployer) deployHost(ctx context.Context, host Host, binary, cfg []byte) error {
+	r, err := dial(d.inv, host)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	binaryPath := path.Join(host.Path, d.inv.BinaryName)
+	configPath := path.Join(host.Path, "config.yml")
+	if err := r.upload(ctx, binary, binaryPath+".new", 0o755); err != nil {
+		return err
+	}
+	if err := r.upload(ctx, cfg, configPath+".new", 0o600); err != nil {
+		return err
+	}
+
+	systemctl, service := systemctlCommand(cfg), shellQuote(d.inv.ServiceName)
+	loaded, err := d.serviceLoaded(ctx, r, systemctl)
+	if err != nil {
+		return err
+	}
+	if !loaded {
+		// the first deployment to the host: the updater installs and starts its own unit
+		if _, err := r.run(ctx, fmt.Sprintf("mv -f %[1]s.new %[1]s && mv -f %[2]s.new %[2]s",
+			shellQuote(binaryPath), shellQuote(configPath)), nil); err != nil {
+			return err
+		}
+		if _, err := r.run(ctx, d.updaterCommand(host, "install"), nil); err != nil {
+			return fmt.Errorf("error installing service: %v", err)
+		}
+		return d.waitHealthy(ctx, r, systemctl, host)
+	}
+
+	if _, err := r.run(ctx, systemctl+" stop "+service, nil); err != nil {
+		return err
+	}
+	_, installErr := r.run(ctx, fmt.Sprintf("mv -f %[1]s.new %[1]s && mv -f %[2]s.new %[2]s",
+		shellQuote(binaryPath), shellQuote(configPath)), nil)
+	// start the service even if the installation failed, to keep the previous version running
+	if _, err := r.run(ctx, systemctl+" start "+service, nil); err != nil {
+		return errors.Join(installErr, err)
+	}
+	if installErr != nil {
+		return installErr
+	}
+	return d.waitHealthy(ctx, r, systemctl, host)
+}
+
+// systemctlCommand returns the systemctl command managing the service of the rendered configuration:
+// rootless services are systemd user units
+func systemctlCommand(cfg []byte) string {
+	if parsed, err := config.Parse(cfg); err == nil && parsed.Rootless { // validated by renderConfig
+		return "systemctl --user"
+	}
+	return "systemctl"
+}
+
+// updaterCommand returns the shell command running the deployed updater with the arguments
+// in the host directory, where it finds its configuration
+func (d *Deployer) updaterCommand(host Host, args string) string {
+	return fmt.Sprintf("cd %s && ./%s %s", shellQuote(host.Path), shellQuote(d.inv.BinaryName), args)
+}
+
+// serviceLoaded returns whether systemd knows the unit of the service, it doesn't before the first deployment
+func (d *Deployer) serviceLoaded(ctx context.Context, r *remote, systemctl string) (bool, error) {
+	out, err := r.run(ctx, systemctl+" show -p LoadState "+shellQuote(d.inv.ServiceName), nil)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out) != "LoadState=not-found", nil
+}
+
+// serviceState represents systemd properties of the service checked after start
+type serviceState struct {
+	ActiveState string
+	NRestarts   string // empty if systemd doesn't report it
+}
+
+// serviceState requests the state of the service
+func (d *Deployer) serviceState(ctx context.Context, r *remote, systemctl string) (serviceState, error) {
+	out, err := r.run(ctx, systemctl+" show -p ActiveState -p NRestarts "+shellQuote(d.inv.ServiceName), nil)
+	if err != nil {
+		return serviceState{}, err
+	}
+	var state serviceState
+	for _, line := range strings.Split(out, "\n") {
+		switch key, value, _ := strings.Cut(strings.TrimSpace(line), "="); key {
+		case "ActiveState":
+			state.ActiveState = value
+		case "NRestarts":
+			state.NRestarts = value
+		}
+	}
+	return state, nil
+}
+
+// waitHealthy waits for the service to become active and stay active for the health soak period,
+// then waits for the validator container it manages to run and become healthy
+func (d *Deployer) waitHealthy(ctx context.Context, r *remote, systemctl string, host Host) error {
+	if err := d.waitActive(ctx, r, systemctl); err != nil {
+		return err
+	}
+	return d.waitContainer(ctx, r, host)
+}
+
+// waitActive waits for the service to become active no longer than the health timeout,
+// then requires it to stay active without restarts for the health soak period
+func (d *Deployer) waitActive(ctx context.Context, r *remote, systemctl string) error {
+	started, err := d.waitStarted(ctx, r, systemctl)
+	if err != nil {
+		return err
+	}
+
+	// a process which dies right after start is active for a moment, or is restarted by systemd
+	for soakEnd := time.Now().Add(d.healthSoak); time.Now().Before(soakEnd); {
+		select {
+		case <-time.After(d.healthInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		state, err := d.serviceState(ctx, r, systemctl)
+		switch {
+		case err != nil:
+			return fmt.Errorf("error checking service during %s soak: %v", d.healthSoak, err)
+		case state.ActiveState != "active":
+			return fmt.Errorf("service is not active during %s soak: %s", d.healthSoak, state.ActiveState)
+		case state.NRestarts != started.NRestarts:
+			return fmt.Errorf("service restarted during %s soak, restarts %s -> %s",
+				d.healthSoak, started.NRestarts, state.NRestarts)
+		}
+	}
+	return nil
+}
+
+// waitStarted waits for the service to become active no longer than the health timeout and returns its state
+func (d *Deployer) waitStarted(ctx context.Context, r *remote, systemctl string) (serviceState, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.healthTimeout)
+	defer cancel()
+	var last serviceState
+	var lastErr error
+	for {
+		state, err := d.serviceState(ctx, r, systemctl)
+		switch {
+		case err == nil && state.ActiveState == "active":
+			return state, nil
+		case err == nil:
+			last = state
+		case ctx.Err() == nil:
+			lastErr = err
+		}
+		select {
+		case <-time.After(d.healthInterval):
+		case <-ctx.Done():
+			if last.ActiveState == "" && lastErr != nil {
+				return last, fmt.Errorf("service is not active after %s: %v", d.healthTimeout, lastErr)
+			}
+			return last, fmt.Errorf("service is not active after %s: %s", d.healthTimeout, last.ActiveState)
+		}
+	}
+}
+
+// containerState represents the validator container state reported by the updater status command
+type containerState struct {
+	State  string
+	Health string
+}
+
+// containerState requests the state of the validator container from the deployed updater
+func (d *Deployer) containerState(ctx context.Context, r *remote, host Host) (containerState, error) {
+	out, err := r.run(ctx, d.updaterCommand(host, "status"), nil)
+	if err != nil {
+		return containerState{}, err
+	}
+	var state containerState
+	for _, line := range strings.Split(out, "\n") {
+		switch key, value, _ := strings.Cut(strings.TrimSpace(line), "="); key {
+		case "State":
+			state.State = value
+		case "Health":
+			state.Health = value
+		}
+	}
+	return state, nil
+}
+
+// waitContainer waits for the validator container to run and pass its health check, if it has one,
+// no longer than the health timeout. The updater may be pulling the image and recreating the container meanwhile
+func (d *Deployer) waitContainer(ctx context.Context, r *remote, host Host) error {
+	ctx, cancel := context.WithTimeout(ctx, d.healthTimeout)
+	defer cancel()
+	var last containerState
+	var lastErr error
+	for {
+		state, err := d.containerState(ctx, r, host)
+		switch {
+		case err == nil && state.State == "running" && (state.Health == "healthy" || state.Health == "none"):
+			return nil
+		case err == nil && state.Health == "unhealthy":
+			return fmt.Errorf("validator container is unhealthy")
+		case err == nil:
+			last, lastErr = state, nil
+		case ctx.Err() == nil:
+			lastErr = err
+		}
+		select {
+		case <-time.After(d.healthInterval):
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("validator container is not healthy after %s: %v", d.healthTimeout, lastErr)
+			}
+			return fmt.Errorf("validator container is not healthy after %s: %s %s",
+				d.healthTimeout, last.State, last.Health)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package deploy_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/deploy"
+	"github.com/mtfelian/elixir-testnet-updater/deploy/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSystemctl records calls and keeps the number of state requests since the service start in $SYSTEMCTL_STATE file.
+// The service started with $SYSTEMCTL_DIE_AFTER dies after that many requests,
+// with $SYSTEMCTL_RESTART_LOOP it is restarted by systemd before every request.
+// With $SYSTEMCTL_NOT_INSTALLED the unit is not loaded until the updater installs it
+const fakeSystemctl = `#!/bin/sh
+echo "$@" >> "$SYSTEMCTL_STATE.log"
+if [ "$1" = "--user" ]; then shift; fi
+loaded=1
+if [ -n "$SYSTEMCTL_NOT_INSTALLED" ] && [ ! -f "$SYSTEMCTL_STATE.unit" ]; then loaded=; fi
+case "$1" in
+stop)
+  if [ -z "$loaded" ]; then echo "Unit $2.service not loaded." >&2; exit 5; fi
+  rm -f "$SYSTEMCTL_STATE" ;;
+start)
+  if [ -z "$loaded" ]; then echo "Unit $2.service not found." >&2; exit 5; fi
+  if [ -n "$SYSTEMCTL_FAIL_START" ]; then echo "start failed" >&2; exit 1; fi
+  if [ -z "$SYSTEMCTL_CRASH" ]; then echo 0 > "$SYSTEMCTL_STATE"; fi ;;
+show)
+  if [ "$3" = "LoadState" ]; then
+    if [ -n "$loaded" ]; then echo "LoadState=loaded"; else echo "LoadState=not-found"; fi
+    exit 0
+  fi
+  if [ ! -f "$SYSTEMCTL_STATE" ]; then echo "ActiveState=failed"; echo "NRestarts=0"; exit 0; fi
+  requests=$(($(cat "$SYSTEMCTL_STATE") + 1))
+  echo "$requests" > "$SYSTEMCTL_STATE"
+  if [ -n "$SYSTEMCTL_DIE_AFTER" ] && [ "$requests" -gt "$SYSTEMCTL_DIE_AFTER" ]; then
+    echo "ActiveState=failed"
+  else
+    echo "ActiveState=active"
+  fi
+  if [ -n "$SYSTEMCTL_RESTART_LOOP" ]; then echo "NRestarts=$requests"; else echo "NRestarts=0"; fi ;;
+esac
+`
+
+// fakeUpdater installs the unit with the fake systemctl and reports the validator container
+// with $CONTAINER_HEALTH health, healthy by default
+const fakeUpdater = `#!/bin/sh
+# updater binary v2
+case "$1" in
+install) touch "$SYSTEMCTL_STATE.unit" && systemctl enable elixir-updater && systemctl start elixir-updater ;;
+status) echo "State=running"; echo "Health=${CONTAINER_HEALTH:-healthy}"; echo "Image=sha256:2" ;;
+esac
+`
+
+// serviceCalls are the expected systemctl calls of the deployment before the soak checks
+const serviceCalls = "show -p LoadState elixir-updater\nstop elixir-updater\nstart elixir-updater\nshow -p ActiveState -p NRestarts elixir-updater\n"
+
+const baseConfig = `# validator updater
+tg_bot_token: ""
+container_name: "elixir"
+image_name: "elixirprotocol/validator:latest" # the tag is set per host
+`
+
+type testFleet struct {
+	t        *testing.T
+	dir      string
+	identity string
+	key      ssh.PublicKey
+	bin      string
+	inv      deploy.Inventory
+	servers  []*sshtest.Server
+}
+
+func newTestFleet(t *testing.T) *testFleet {
+	t.Helper()
+	dir := t.TempDir()
+	identity, key := sshtest.GenerateKey(t, dir)
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "systemctl"), []byte(fakeSystemctl), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(configPath, []byte(baseConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "updater")
+	if err := os.WriteFile(binary, []byte(fakeUpdater), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &testFleet{t: t, dir: dir, identity: identity, key: key, bin: bin}
+	f.inv = deploy.Inventory{
+		Identity:      identity,
+		KnownHosts:    filepath.Join(dir, "known_hosts"),
+		Config:        configPath,
+		Parallel:      2,
+		HealthTimeout: "500ms",
+		HealthSoak:    "100ms",
+	}
+	return f
+}
+
+// addHost starts an SSH server for a new host with extra environment for the fake systemctl
+func (f *testFleet) addHost(tag string, canary bool, env ...string) deploy.Host {
+	f.t.Helper()
+	path := filepath.Join(f.dir, "host"+string(rune('a'+len(f.servers))))
+	if err := os.Mkdir(path, 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+	env = append(env, "PATH="+f.bin+":"+os.Getenv("PATH"), "SYSTEMCTL_STATE="+filepath.Join(path, "state"))
+	server := sshtest.NewServer(f.t, f.key, env...)
+	f.servers = append(f.servers, server)
+
+	knownHosts, err := os.OpenFile(f.inv.KnownHosts, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer knownHosts.Close()
+	if _, err := knownHosts.WriteString(server.KnownHostsLine()); err != nil {
+		f.t.Fatal(err)
+	}
+
+	host := deploy.Host{Address: "deployer@127.0.0.1", Port: server.Port, Path: path, Tag: tag, Canary: canary}
+	f.inv.Hosts = append(f.inv.Hosts, host)
+	return host
+}
+
+func (f *testFleet) run() (deploy.Summary, error) {
+	f.t.Helper()
+	f.inv.SetDefaults()
+	if err := f.inv.Validate(); err != nil {
+		f.t.Fatalf("invalid inventory: %v", err)
+	}
+	return deploy.New(deploy.Params{
+		Inventory:      f.inv,
+		Binary:         filepath.Join(f.dir, "updater"),
+		HealthInterval: 20 * time.Millisecond,
+	}).Run(context.Background())
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDeploy(t *testing.T) {
+	f := newTestFleet(t)
+	canary := f.addHost("testnet", true)
+	f.addHost("", false)
+	f.addHost("v3.1.0", false)
+	f.inv.Hosts[1].Set = map[string]any{"container_name": "elixir-2", "port": "17691"}
+
+	summary, err := f.run()
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if summary.Failed() {
+		var b strings.Builder
+		summary.Print(&b)
+		t.Fatalf("deployment failed:\n%s", b.String())
+	}
+
+	for i, want := range []string{
+		`image_name: "elixirprotocol/validator:testnet" # the tag is set per host`,
+		`container_name: "elixir-2"`,
+		`image_name: "elixirprotocol/validator:v3.1.0"`,
+	} {
+		path := f.inv.Hosts[i].Path
+		if got := readFile(t, filepath.Join(path, "elixir-testnet-updater")); got != fakeUpdater {
+			t.Errorf("host %d: unexpected binary %q", i, got)
+		}
+		cfg := readFile(t, filepath.Join(path, "config.yml"))
+		if !strings.Contains(cfg, want) || !strings.Contains(cfg, "# validator updater") {
+			t.Errorf("host %d: configuration doesn't contain %q:\n%s", i, want, cfg)
+		}
+		calls := readFile(t, filepath.Join(path, "state.log"))
+		if !strings.HasPrefix(calls, serviceCalls) || strings.Count(calls, "show") < 3 {
+			t.Errorf("host %d: unexpected systemctl calls:\n%s", i, calls)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(path, "*.new")); len(matches) > 0 {
+			t.Errorf("host %d: temporary files left: %v", i, matches)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(canary.Path, "elixir-testnet-updater")); err != nil || info.Mode().Perm() != 0o755 {
+		t.Errorf("unexpected binary mode: %v, %v", info, err)
+	}
+	if !strings.Contains(strings.Join(f.servers[0].Commands(), "\n"), "sha256sum") {
+		t.Errorf("uploads were not verified: %v", f.servers[0].Commands())
+	}
+}
+
+func TestDeployRootless(t *testing.T) {
+	f := newTestFleet(t)
+	host := f.addHost("", false)
+	f.inv.Hosts[0].Set = map[string]any{"rootless": true}
+
+	summary, err := f.run()
+	if err != nil || summary.Failed() {
+		t.Fatalf("Run: %v, %v", summary, err)
+	}
+	calls := readFile(t, filepath.Join(host.Path, "state.log"))
+	if !strings.HasPrefix(calls, "--user show -p LoadState elixir-updater\n--user stop elixir-updater\n--user start elixir-updater\n--user show ") ||
+		strings.Count(calls, "--user ") != strings.Count(calls, "\n") {
+		t.Errorf("unexpected systemctl calls:\n%s", calls)
+	}
+}
+
+func TestDeployFirstInstall(t *testing.T) {
+	f := newTestFleet(t)
+	host := f.addHost("", false, "SYSTEMCTL_NOT_INSTALLED=1")
+
+	summary, err := f.run()
+	if err != nil || summary.Failed() {
+		t.Fatalf("Run: %v, %v", summary, err)
+	}
+	calls := readFile(t, filepath.Join(host.Path, "state.log"))
+	if !strings.HasPrefix(calls, "show -p LoadState elixir-updater\nenable elixir-updater\nstart elixir-updater\n") ||
+		strings.Contains(calls, "stop") {
+		t.Errorf("unexpected systemctl calls:\n%s", calls)
+	}
+	if got := readFile(t, filepath.Join(host.Path, "elixir-testnet-updater")); got != fakeUpdater {
+		t.Errorf("unexpected binary %q", got)
+	}
+	commands := strings.Join(f.servers[0].Commands(), "\n")
+	if !strings.Contains(commands, "./'elixir-testnet-updater' install") ||
+		!strings.Contains(commands, "./'elixir-testnet-updater' status") {
+		t.Errorf("updater was not installed and checked: %v", commands)
+	}
+}
+
+func TestDeployCanaryFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name, env, err string
+	}{
+		{"not started", "SYSTEMCTL_CRASH=1", "not active after 500ms: failed"},
+		{"dies after start", "SYSTEMCTL_DIE_AFTER=2", "not active during 100ms soak: failed"},
+		{"restart loop", "SYSTEMCTL_RESTART_LOOP=1", "restarted during 100ms soak"},
+		{"validator unhealthy", "CONTAINER_HEALTH=unhealthy", "validator container is unhealthy"},
+		{"validator not healthy", "CONTAINER_HEALTH=starting", "not healthy after 500ms: running starting"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newTestFleet(t)
+			f.addHost("", true, tc.env)
+			other := f.addHost("", false)
+
+			summary, err := f.run()
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if summary[0].Status != deploy.StatusFailed || !strings.Contains(summary[0].Err.Error(), tc.err) {
+				t.Errorf("expected canary to fail the health check, got %s: %v", summary[0].Status, summary[0].Err)
+			}
+			if summary[1].Status != deploy.StatusSkipped {
+				t.Errorf("expected other host to be skipped, got %s", summary[1].Status)
+			}
+			if len(f.servers[1].Commands()) > 0 {
+				t.Errorf("skipped host was touched: %v", f.servers[1].Commands())
+			}
+			if _, err := os.Stat(filepath.Join(other.Path, "config.yml")); !os.IsNotExist(err) {
+				t.Errorf("skipped host has configuration: %v", err)
+			}
+
+			var b strings.Builder
+			summary.Print(&b)
+			if !strings.Contains(b.String(), "skipped") || !strings.Contains(b.String(), "canary") {
+				t.Errorf("unexpected summary:\n%s", b.String())
+			}
+		})
+	}
+}
+
+func TestDeployHostFailures(t *testing.T) {
+	f := newTestFleet(t)
+	f.addHost("", false, "SYSTEMCTL_FAIL_START=1")
+	f.addHost("", false)
+	f.addHost("", false)
+	// the third host presents an unknown host key
+	if err := os.WriteFile(f.inv.KnownHosts, []byte(f.servers[0].KnownHostsLine()+f.servers[1].KnownHostsLine()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := f.run()
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if summary[0].Status != deploy.StatusFailed || !strings.Contains(summary[0].Err.Error(), "start failed") {
+		t.Errorf("expected start failure, got %s: %v", summary[0].Status, summary[0].Err)
+	}
+	if summary[1].Status != deploy.StatusOK {
+		t.Errorf("expected other host to be deployed, got %s: %v", summary[1].Status, summary[1].Err)
+	}
+	if summary[2].Status != deploy.StatusFailed || !strings.Contains(summary[2].Err.Error(), "key") {
+		t.Errorf("expected host key failure, got %s: %v", summary[2].Status, summary[2].Err)
+	}
+	if !summary.Failed() {
+		t.Errorf("expected summary to be failed")
+	}
+}
+
+func TestDeployInvalidConfig(t *testing.T) {
+	f := newTestFleet(t)
+	f.addHost("", false)
+	f.addHost("", false)
+	f.inv.Hosts[1].Set = map[string]any{"port": "70000"}
+
+	if _, err := f.run(); err == nil || !strings.Contains(err.Error(), "port") {
+		t.Fatalf("expected configuration error, got: %v", err)
+	}
+	for _, server := range f.servers {
+		if len(server.Commands()) > 0 {
+			t.Errorf("host was touched despite invalid configuration: %v", server.Commands())
+		}
+	}
+}
+
+func TestLoadInventory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "deploy.yml")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("hosts:\n  - address: root@1.1.1.1\n    path: /root\n    canary: true\n")
+	inv, err := deploy.LoadInventory(path)
+	if err != nil {
+		t.Fatalf("LoadInventory: %v", err)
+	}
+	if inv.Hosts[0].Port != 22 || inv.Parallel != 1 || inv.ServiceName != "elixir-updater" || inv.Config != "config.yml" ||
+		inv.HealthSoak != "30s" {
+		t.Errorf("defaults were not set: %+v", inv)
+	}
+
+	write("parallel: -1\nhealth_soak: soon\nhosts:\n  - address: root@1.1.1.1\n    path: root\n  - path: /root\n")
+	_, err = deploy.LoadInventory(path)
+	for _, want := range []string{"parallel", "health_soak", "hosts[0].path", "hosts[1].address"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s problem, got: %v", want, err)
+		}
+	}
+
+	write("servers: []\n")
+	if _, err := deploy.LoadInventory(path); err == nil || !strings.Contains(err.Error(), "servers") {
+		t.Errorf("expected unknown field error, got: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+// Package deploy rolls the updater binary and its configuration out to a fleet of hosts over SSH
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// default inventory values
+const (
+	defaultIdentity      = "~/.ssh/id_rsa"
+	defaultKnownHosts    = "~/.ssh/known_hosts"
+	defaultBinaryName    = "elixir-testnet-updater"
+	defaultConfig        = "config.yml"
+	defaultServiceName   = "elixir-updater"
+	defaultGOARCH        = "amd64"
+	defaultParallel      = 1
+	defaultHealthTimeout = "1m"
+	defaultHealthSoak    = "30s"
+	defaultSSHPort       = 22
+)
+
+// Inventory represents fleet deployment settings and hosts
+type Inventory struct {
+	// Identity is the SSH private key path
+	Identity string `yaml:"identity"`
+	// KnownHosts is the known_hosts file to verify host keys with, unless InsecureIgnoreHostKey is set
+	KnownHosts            string `yaml:"known_hosts"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+	BinaryName            string `yaml:"binary_name"`
+	// Config is the local configuration file rendered for every host
+	Config      string `yaml:"config"`
+	ServiceName string `yaml:"service_name"`
+	GOARCH      string `yaml:"goarch"`
+	// Parallel is the number of hosts deployed simultaneously
+	Parallel int `yaml:"parallel"`
+	// HealthTimeout is the time to wait for the service to become active after start, and then for the container
+	HealthTimeout string `yaml:"health_timeout"`
+	// HealthSoak is the time the service should stay active without restarts after it became active
+	HealthSoak string `yaml:"health_soak"`
+	Hosts      []Host `yaml:"hosts"`
+}
+
+// Host represents a deployment target
+type Host struct {
+	// Address is user@host
+	Address string `yaml:"address"`
+	Port    int    `yaml:"port"`
+	// Path is the remote directory of the binary and config.yml
+	Path string `yaml:"path"`
+	// Tag replaces the tag of image_name in the rendered configuration, if set
+	Tag string `yaml:"tag"`
+	// Canary hosts are deployed first, a failed canary stops the deployment
+	Canary bool `yaml:"canary"`
+	// Set overrides top-level configuration options
+	Set map[string]any `yaml:"set"`
+}
+
+// String implements fmt.Stringer
+func (h Host) String() string {
+	return fmt.Sprintf("%s:%d%s", h.Address, h.Port, h.Path)
+}
+
+// LoadInventory reads the inventory file strictly, sets defaults and validates it
+func LoadInventory(path string) (Inventory, error) {
+	var inv Inventory
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return inv, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&inv); err != nil && !errors.Is(err, io.EOF) {
+		return inv, fmt.Errorf("invalid inventory %s: %v", path, err)
+	}
+	inv.SetDefaults()
+	if err := inv.Validate(); err != nil {
+		return inv, fmt.Errorf("invalid inventory %s: %v", path, err)
+	}
+	return inv, nil
+}
+
+// SetDefaults to the inventory
+func (inv *Inventory) SetDefaults() {
+	if inv.Identity == "" {
+		inv.Identity = defaultIdentity
+	}
+	if inv.KnownHosts == "" {
+		inv.KnownHosts = defaultKnownHosts
+	}
+	if inv.BinaryName == "" {
+		inv.BinaryName = defaultBinaryName
+	}
+	if inv.Config == "" {
+		inv.Config = defaultConfig
+	}
+	if inv.ServiceName == "" {
+		inv.ServiceName = defaultServiceName
+	}
+	if inv.GOARCH == "" {
+		inv.GOARCH = defaultGOARCH
+	}
+	if inv.Parallel == 0 {
+		inv.Parallel = defaultParallel
+	}
+	if inv.HealthTimeout == "" {
+		inv.HealthTimeout = defaultHealthTimeout
+	}
+	if inv.HealthSoak == "" {
+		inv.HealthSoak = defaultHealthSoak
+	}
+	for i := range inv.Hosts {
+		if inv.Hosts[i].Port == 0 {
+			inv.Hosts[i].Port = defaultSSHPort
+		}
+	}
+}
+
+// Validate returns all inventory problems joined
+func (inv *Inventory) Validate() error {
+	var errs []error
+	if inv.Parallel < 1 {
+		errs = append(errs, fmt.Errorf("parallel: invalid value %d, must be 1 or greater", inv.Parallel))
+	}
+	if d, err := time.ParseDuration(inv.HealthTimeout); err != nil || d <= 0 {
+		errs = append(errs, fmt.Errorf("health_timeout: invalid duration %q", inv.HealthTimeout))
+	}
+	if d, err := time.ParseDuration(inv.HealthSoak); err != nil || d < 0 {
+		errs = append(errs, fmt.Errorf("health_soak: invalid duration %q", inv.HealthSoak))
+	}
+	if strings.ContainsAny(inv.BinaryName, "/ ") {
+		errs = append(errs, fmt.Errorf("binary_name: invalid file name %q", inv.BinaryName))
+	}
+	if len(inv.Hosts) == 0 {
+		errs = append(errs, errors.New("hosts: no hosts defined"))
+	}
+	seen := make(map[string]bool)
+	for i, h := range inv.Hosts {
+		switch {
+		case h.Address == "":
+			errs = append(errs, fmt.Errorf("hosts[%d].address: not set", i))
+		case h.Port < 1 || h.Port > 65535:
+			errs = append(errs, fmt.Errorf("hosts[%d].port: invalid port %d", i, h.Port))
+		case !filepath.IsAbs(h.Path):
+			errs = append(errs, fmt.Errorf("hosts[%d].path: must be absolute, got %q", i, h.Path))
+		case seen[h.String()]:
+			errs = append(errs, fmt.Errorf("hosts[%d]: duplicate of %s", i, h))
+		}
+		seen[h.String()] = true
+	}
+	return errors.Join(errs...)
+}
+
+// expandHome replaces leading ~ in the path with the user home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,100 @@
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/distribution/reference"
+	"github.com/mtfelian/elixir-testnet-updater/config"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultImageName is used to apply the host tag if the configuration doesn't set image_name
+const defaultImageName = "elixirprotocol/validator:latest"
+
+// renderConfig applies host overrides to the base configuration, keeping its comments and order,
+// and validates the result
+func renderConfig(base []byte, host Host) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(base, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing configuration: %v", err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("configuration is not a mapping")
+	}
+
+	keys := make([]string, 0, len(host.Set))
+	for key := range host.Set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := setOption(root, key, host.Set[key]); err != nil {
+			return nil, err
+		}
+	}
+	if host.Tag != "" {
+		imageName := defaultImageName
+		if node := option(root, "image_name"); node != nil && node.Value != "" {
+			imageName = node.Value
+		}
+		named, err := reference.ParseNormalizedNamed(imageName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image_name %q: %v", imageName, err)
+		}
+		tagged, err := reference.WithTag(reference.TrimNamed(named), host.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %v", host.Tag, err)
+		}
+		if err := setOption(root, "image_name", reference.FamiliarString(tagged)); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, fmt.Errorf("error encoding configuration: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding configuration: %v", err)
+	}
+	if _, err := config.Parse(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// option returns the value node of the top-level option, nil if it's not set
+func option(root *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			return root.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setOption sets the top-level option to value, adding it if it's not set
+func setOption(root *yaml.Node, key string, value any) error {
+	var node yaml.Node
+	if err := node.Encode(value); err != nil {
+		return fmt.Errorf("invalid value of %s: %v", key, err)
+	}
+	if existing := option(root, key); existing != nil {
+		node.HeadComment, node.LineComment = existing.HeadComment, existing.LineComment
+		if node.Kind == yaml.ScalarNode && existing.Kind == yaml.ScalarNode && node.Tag == existing.Tag {
+			node.Style = existing.Style
+		}
+		*existing = node
+		return nil
+	}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &node)
+	return nil
+}
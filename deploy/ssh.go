@@ -0,0 +1,123 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// dialTimeout limits SSH connection establishment
+const dialTimeout = 30 * time.Second
+
+// remote runs commands on a host over SSH
+type remote struct {
+	client *ssh.Client
+}
+
+// clientConfig returns SSH client configuration for the inventory
+func clientConfig(inv Inventory, user string) (*ssh.ClientConfig, error) {
+	key, err := os.ReadFile(expandHome(inv.Identity))
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity %s: %v", inv.Identity, err)
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !inv.InsecureIgnoreHostKey {
+		if hostKeyCallback, err = knownhosts.New(expandHome(inv.KnownHosts)); err != nil {
+			return nil, fmt.Errorf("error reading known hosts: %v", err)
+		}
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}, nil
+}
+
+// dial connects to the host
+func dial(inv Inventory, host Host) (*remote, error) {
+	user, hostname, ok := strings.Cut(host.Address, "@")
+	if !ok {
+		user, hostname = "root", host.Address
+	}
+	cfg, err := clientConfig(inv, user)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", net.JoinHostPort(hostname, strconv.Itoa(host.Port)), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting: %v", err)
+	}
+	return &remote{client: client}, nil
+}
+
+// Close the connection
+func (r *remote) Close() error {
+	return r.client.Close()
+}
+
+// run the command with stdin, returning its stdout. Stderr is included into the error.
+// The session is closed when ctx is done
+func (r *remote) run(ctx context.Context, cmd string, stdin io.Reader) (string, error) {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("error opening session: %v", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin, session.Stdout, session.Stderr = stdin, &stdout, &stderr
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(cmd) }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = session.Close()
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return stdout.String(), fmt.Errorf("%q failed: %v: %s", cmd, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// upload writes content to the remote path with the file mode and verifies its SHA-256 checksum
+func (r *remote) upload(ctx context.Context, content []byte, path string, mode os.FileMode) error {
+	cmd := fmt.Sprintf("cat > %[1]s && chmod %04[2]o %[1]s", shellQuote(path), mode.Perm())
+	if _, err := r.run(ctx, cmd, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("error uploading %s: %v", path, err)
+	}
+
+	out, err := r.run(ctx, "sha256sum "+shellQuote(path), nil)
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %v", path, err)
+	}
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+	if got, _, _ := strings.Cut(strings.TrimSpace(out), " "); got != want {
+		return fmt.Errorf("checksum mismatch of %s: got %s, expected %s", path, got, want)
+	}
+	return nil
+}
+
+// shellQuote quotes s for POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,173 @@
+// Package sshtest provides a local SSH server stand-in running commands with sh, for testing
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is a local SSH server accepting a single public key and running exec requests with sh
+type Server struct {
+	// Port the server listens on 127.0.0.1
+	Port int
+	// HostKey is the server public key
+	HostKey ssh.PublicKey
+	// Env is added to the environment of commands
+	Env []string
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// NewServer starts the server authorizing the key, it's stopped when the test ends
+func NewServer(t testing.TB, authorized ssh.PublicKey, env ...string) *Server {
+	t.Helper()
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatalf("creating host signer: %v", err)
+	}
+
+	s := &Server{HostKey: hostSigner.PublicKey(), Env: env}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, errors.New("unauthorized key")
+			}
+			return nil, nil
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	s.Port = s.listener.Addr().(*net.TCPAddr).Port
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(func() {
+		_ = s.listener.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+// Commands returns commands run so far
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// KnownHostsLine returns the known_hosts file line of the server
+func (s *Server) KnownHostsLine() string {
+	return fmt.Sprintf("[127.0.0.1]:%d %s", s.Port, ssh.MarshalAuthorizedKey(s.HostKey))
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(channel, requests)
+	}
+}
+
+func (s *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" || len(req.Payload) < 4 {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		command := string(req.Payload[4:])
+		_ = req.Reply(true, nil)
+
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), s.Env...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = channel, channel, channel.Stderr()
+		status := 0
+		if err := cmd.Run(); err != nil {
+			status = 255
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				status = exitErr.ExitCode()
+			}
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(status))
+		_, _ = channel.SendRequest("exit-status", false, payload)
+		return
+	}
+}
+
+// GenerateKey writes a new private key in OpenSSH format into dir and returns its path and public key
+func GenerateKey(t testing.TB, dir string) (string, ssh.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatalf("marshaling key: %v", err)
+	}
+	path := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("creating public key: %v", err)
+	}
+	return path, sshPublic
+}
@@ -0,0 +1,94 @@
+// Package harness provides fakes to run service.Service end-to-end in tests:
+// a fake Docker engine and registry, a scriptable validator health server, a recording notifier and a fake clock
+package harness
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	"github.com/mtfelian/elixir-testnet-updater/service"
+)
+
+// defaults used by Params
+const (
+	ImageName     = "elixirprotocol/validator:latest"
+	ContainerName = "elixir"
+	DisplayName   = "harness-validator"
+)
+
+// Start is the initial time of the harness clock
+var Start = time.Date(2024, time.October, 1, 12, 0, 0, 0, time.UTC)
+
+// Harness bundles fakes needed to run service.Service
+type Harness struct {
+	Engine   *dockertest.Engine
+	Registry *httptest.Server
+	Health   *HealthServer
+	Notifier *Recorder
+	Clock    *Clock
+	EnvFile  string
+}
+
+// New starts the harness, its servers are closed on the test cleanup
+func New(t testing.TB) *Harness {
+	t.Helper()
+	h := &Harness{
+		Engine:   dockertest.NewEngine(),
+		Health:   NewHealthServer(),
+		Notifier: &Recorder{},
+		Clock:    NewClock(Start),
+		EnvFile:  filepath.Join(t.TempDir(), "validator.env"),
+	}
+	h.Registry = httptest.NewServer(h.Engine)
+	t.Cleanup(h.Registry.Close)
+	t.Cleanup(h.Health.Close)
+
+	env := "STRATEGY_EXECUTOR_DISPLAY_NAME=" + DisplayName + "\n" +
+		"STRATEGY_EXECUTOR_BENEFICIARY=0x0000000000000000000000000000000000000000\n" +
+		"SIGNER_PRIVATE_KEY=0000000000000000000000000000000000000000000000000000000000000000\n"
+	if err := os.WriteFile(h.EnvFile, []byte(env), 0600); err != nil {
+		t.Fatalf("error writing env file: %v", err)
+	}
+	return h
+}
+
+// Params returns service parameters wired to the harness fakes.
+// Periodic jobs are scheduled hourly for updates and every 5 minutes for metrics, driven by the harness clock
+func (h *Harness) Params() service.Params {
+	return service.Params{
+		ContainerName:      ContainerName,
+		RestartPolicy:      "unless-stopped",
+		EnvFilePath:        h.EnvFile,
+		Port:               "17690",
+		MetricsURI:         h.Health.URL,
+		ImageName:          ImageName,
+		UpdateSchedule:     "0 * * * *",
+		MetricsSchedule:    "*/5 * * * *",
+		KeepPreviousImages: 1,
+		Logs:               delixir.LogsParams{Lines: 100, Attach: true},
+
+		Notifier:          h.Notifier,
+		DockerAPI:         h.Engine,
+		RegistryURL:       dockertest.RegistryURL(h.Registry.URL),
+		Clock:             h.Clock,
+		MetricsTimeout:    time.Second,
+		DockerWaitTimeout: time.Minute,
+	}
+}
+
+// WaitFor polls cond until it returns true, failing the test after timeout
+func WaitFor(t testing.TB, timeout time.Duration, cond func() bool, format string, args ...any) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for "+format, args...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,112 @@
+package harness
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// HealthMode represents the behaviour of the fake health server
+type HealthMode int
+
+// health server modes
+const (
+	Healthy     HealthMode = iota // responds with the healthy payload
+	Degraded                      // responds with the degraded payload
+	Slow                          // responds with the healthy payload after the delay
+	Malformed                     // responds with invalid JSON
+	ServerError                   // responds with HTTP 500
+)
+
+// HealthServer is a scriptable fake validator /health endpoint
+type HealthServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	mode     HealthMode
+	healthy  map[string]any
+	degraded map[string]any
+	delay    time.Duration
+	requests int
+}
+
+// NewHealthServer starts a fake health server in Healthy mode
+func NewHealthServer() *HealthServer {
+	hs := &HealthServer{
+		mode: Healthy,
+		healthy: map[string]any{
+			"status":  "healthy",
+			"version": "3.3.0",
+			"peers":   8,
+		},
+		degraded: map[string]any{
+			"status":  "degraded",
+			"version": "3.3.0",
+			"peers":   0,
+		},
+		delay: time.Second,
+	}
+	hs.Server = httptest.NewServer(http.HandlerFunc(hs.serveHealth))
+	return hs
+}
+
+// SetMode switches the server behaviour
+func (hs *HealthServer) SetMode(mode HealthMode) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.mode = mode
+}
+
+// SetDelay sets the response delay for Slow mode
+func (hs *HealthServer) SetDelay(d time.Duration) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.delay = d
+}
+
+// SetPayload replaces the payload returned in Healthy and Slow modes
+func (hs *HealthServer) SetPayload(payload map[string]any) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.healthy = payload
+}
+
+// Requests returns the number of served /health requests
+func (hs *HealthServer) Requests() int {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.requests
+}
+
+func (hs *HealthServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/health" {
+		http.NotFound(w, r)
+		return
+	}
+
+	hs.mu.Lock()
+	hs.requests++
+	mode, healthy, degraded, delay := hs.mode, hs.healthy, hs.degraded, hs.delay
+	hs.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch mode {
+	case Degraded:
+		_ = json.NewEncoder(w).Encode(degraded)
+	case Slow:
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		_ = json.NewEncoder(w).Encode(healthy)
+	case Malformed:
+		_, _ = w.Write([]byte(`{"status": "healthy",`))
+	case ServerError:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	default:
+		_ = json.NewEncoder(w).Encode(healthy)
+	}
+}
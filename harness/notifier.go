@@ -0,0 +1,74 @@
+package harness
+
+import (
+	"strings"
+	"sync"
+)
+
+// Recorder is a notifier.Notifier and notifier.FileSender recording sent messages and files
+type Recorder struct {
+	mu       sync.Mutex
+	messages []string
+	files    []File
+}
+
+// File represents a file sent with a notifier
+type File struct {
+	Name    string
+	Content []byte
+	Caption string
+}
+
+// SendBroadcastFile records the file
+func (r *Recorder) SendBroadcastFile(name string, content []byte, caption string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files = append(r.files, File{Name: name, Content: content, Caption: caption})
+}
+
+// Files returns recorded files
+func (r *Recorder) Files() []File {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]File(nil), r.files...)
+}
+
+// SendBroadcastMessage records the message
+func (r *Recorder) SendBroadcastMessage(message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, message)
+}
+
+// Messages returns recorded messages
+func (r *Recorder) Messages() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+// Contains returns whether any recorded message contains substr
+func (r *Recorder) Contains(substr string) bool {
+	return r.Count(substr) > 0
+}
+
+// Count returns the number of recorded messages containing substr
+func (r *Recorder) Count(substr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int
+	for _, m := range r.messages {
+		if strings.Contains(m, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// Reset forgets recorded messages and files
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = nil
+	r.files = nil
+}
@@ -0,0 +1,163 @@
+// Package hooks runs custom commands and webhooks at points of the validator container update,
+// e.g. to snapshot the data directory before the container is stopped
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+)
+
+// DefaultTimeout is the default time a hook may run
+const DefaultTimeout = time.Minute
+
+// maxOutputSize limits the hook output included in errors
+const maxOutputSize = 1024
+
+// Hook represents a command or a webhook run at the update point
+type Hook struct {
+	// Point is one of delixir.HookPoints
+	Point string
+	// Command is run with "sh -c", the event is passed in ELIXIR_* environment variables
+	Command string
+	// URL receives the event as JSON in a POST request, used if Command is empty
+	URL string
+	// Timeout defaults to DefaultTimeout
+	Timeout time.Duration
+}
+
+// String implements fmt.Stringer
+func (h Hook) String() string {
+	if h.Command != "" {
+		return fmt.Sprintf("command %q", h.Command)
+	}
+	return "webhook " + h.URL
+}
+
+// Runner runs hooks, it implements delixir.Hooks
+type Runner struct {
+	hooks      []Hook
+	httpClient *http.Client
+}
+
+// New creates new hooks runner
+func New(hooks []Hook) *Runner {
+	r := &Runner{hooks: make([]Hook, len(hooks)), httpClient: &http.Client{}}
+	for i, hook := range hooks {
+		if hook.Timeout <= 0 {
+			hook.Timeout = DefaultTimeout
+		}
+		r.hooks[i] = hook
+	}
+	return r
+}
+
+// Run the hooks of the event point in order, stopping at the first failed one
+func (r *Runner) Run(ctx context.Context, event delixir.HookEvent) error {
+	for _, hook := range r.hooks {
+		if hook.Point != event.Point {
+			continue
+		}
+		log.Printf("Running %s hook %s...", event.Point, hook)
+		if err := r.run(ctx, hook, event); err != nil {
+			return fmt.Errorf("%s failed: %v", hook, err)
+		}
+	}
+	return nil
+}
+
+// Describe returns the hooks of the point in order, it implements delixir.HookDescriber
+func (r *Runner) Describe(point string) []string {
+	var hooks []string
+	for _, hook := range r.hooks {
+		if hook.Point == point {
+			hooks = append(hooks, hook.String())
+		}
+	}
+	return hooks
+}
+
+func (r *Runner) run(ctx context.Context, hook Hook, event delixir.HookEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+	var err error
+	if hook.Command != "" {
+		err = runCommand(ctx, hook.Command, event)
+	} else {
+		err = r.post(ctx, hook.URL, event)
+	}
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", hook.Timeout)
+	}
+	return err
+}
+
+// runCommand runs the shell command with the event environment, its output is logged
+func runCommand(ctx context.Context, command string, event delixir.HookEvent) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), Env(event)...)
+	cmd.WaitDelay = time.Second // don't wait for the output of orphaned children
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("Hook output:\n%s", output)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, truncate(strings.TrimSpace(string(output))))
+	}
+	return nil
+}
+
+// post sends the event to the webhook URL, any status other than 2xx is an error
+func (r *Runner) post(ctx context.Context, url string, event delixir.HookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxOutputSize))
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Env returns environment variables describing the event to hook commands
+func Env(event delixir.HookEvent) []string {
+	return []string{
+		"ELIXIR_HOOK_POINT=" + event.Point,
+		"ELIXIR_CONTAINER_NAME=" + event.ContainerName,
+		"ELIXIR_IMAGE_NAME=" + event.ImageName,
+		"ELIXIR_CONTAINER_ID=" + event.ContainerID,
+		"ELIXIR_CURRENT_IMAGE_ID=" + event.CurrentImageID,
+		"ELIXIR_NEW_IMAGE=" + event.NewImage,
+		"ELIXIR_ERROR=" + event.Error,
+	}
+}
+
+// truncate keeps the tail of the output, which usually contains the error
+func truncate(s string) string {
+	if len(s) > maxOutputSize {
+		return "..." + s[len(s)-maxOutputSize:]
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package hooks_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/hooks"
+)
+
+var testEvent = delixir.HookEvent{
+	Point:          delixir.HookBeforeStop,
+	ContainerName:  "elixir",
+	ImageName:      "elixirprotocol/validator:latest",
+	ContainerID:    "c1",
+	CurrentImageID: "sha256:old",
+	NewImage:       "sha256:new",
+}
+
+func TestRunCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	runner := hooks.New([]hooks.Hook{
+		{Point: delixir.HookBeforeStop, Command: `echo "$ELIXIR_HOOK_POINT $ELIXIR_CONTAINER_ID $ELIXIR_NEW_IMAGE" >> ` + out},
+		{Point: delixir.HookAfterStart, Command: "echo after-start >> " + out},
+		{Point: delixir.HookBeforeStop, Command: "echo second >> " + out},
+	})
+	if err := runner.Run(context.Background(), testEvent); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "before-stop c1 sha256:new\nsecond\n"; got != want {
+		t.Errorf("hooks wrote %q, expected %q", got, want)
+	}
+}
+
+func TestRunCommandFailure(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	runner := hooks.New([]hooks.Hook{
+		{Point: delixir.HookBeforeStop, Command: "echo snapshot failed; exit 3"},
+		{Point: delixir.HookBeforeStop, Command: "touch " + out},
+	})
+	err := runner.Run(context.Background(), testEvent)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "snapshot failed") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Errorf("the hook after the failed one ran")
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	runner := hooks.New([]hooks.Hook{{Point: delixir.HookBeforeStop, Command: "sleep 10", Timeout: 50 * time.Millisecond}})
+	start := time.Now()
+	err := runner.Run(context.Background(), testEvent)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hook was not killed, Run took %s", elapsed)
+	}
+}
+
+func TestRunWebhook(t *testing.T) {
+	var received delixir.HookEvent
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("decoding event: %v", err)
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("maintenance window"))
+	}))
+	defer server.Close()
+	runner := hooks.New([]hooks.Hook{{Point: delixir.HookBeforeStop, URL: server.URL}})
+
+	if err := runner.Run(context.Background(), testEvent); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if received != testEvent {
+		t.Errorf("webhook received %+v", received)
+	}
+
+	status = http.StatusConflict
+	err := runner.Run(context.Background(), testEvent)
+	if err == nil || !strings.Contains(err.Error(), "409") || !strings.Contains(err.Error(), "maintenance window") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
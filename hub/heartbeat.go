@@ -0,0 +1,140 @@
+// Package hub aggregates heartbeats of updater instances across a fleet: it tracks which image each host runs,
+// detects stale hosts and version skew and alerts on them
+package hub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API paths of the hub
+const (
+	HeartbeatsPath    = "/api/v1/heartbeats"
+	FleetPath         = "/api/v1/fleet"
+	FleetTablePath    = "/fleet"
+	RolloutAllowPath  = "/api/v1/rollouts/allow"
+	RolloutReportPath = "/api/v1/rollouts/report"
+	RolloutResumePath = "/api/v1/rollouts/resume"
+)
+
+// DefaultClientTimeout is the default heartbeat request timeout
+const DefaultClientTimeout = 10 * time.Second
+
+// Heartbeat is a periodic report of an updater instance
+type Heartbeat struct {
+	// InstanceID is the validator display name
+	InstanceID string `json:"instance_id"`
+	// Canary instances update to new images first, see Server.Allow
+	Canary         bool   `json:"canary"`
+	UpdaterVersion string `json:"updater_version"`
+	ContainerName  string `json:"container_name"`
+	ImageName      string `json:"image_name"`
+	ImageID        string `json:"image_id"`
+	ImageDigest    string `json:"image_digest"`
+	ContainerState string `json:"container_state"`
+	DockerHealth   string `json:"docker_health"`
+	// Metrics is the last health endpoint snapshot
+	Metrics          map[string]any `json:"metrics,omitempty"`
+	UpdateInProgress bool           `json:"update_in_progress"`
+	// Error describes why the container state is unknown
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+func (hb *Heartbeat) validate() error {
+	if hb.InstanceID == "" {
+		return errors.New("instance_id is required")
+	}
+	return nil
+}
+
+// image returns the key identifying the image the instance runs
+func (hb Heartbeat) image() string {
+	if hb.ImageDigest != "" {
+		return hb.ImageDigest
+	}
+	return hb.ImageID
+}
+
+// ClientParams represents heartbeat client parameters
+type ClientParams struct {
+	// URL is the base URL of the hub, e.g. http://hub.local:8080
+	URL   string
+	Token string
+	// InstanceID and Canary are set to sent heartbeats and rollout requests
+	InstanceID string
+	Canary     bool
+	// Timeout defaults to DefaultClientTimeout
+	Timeout time.Duration
+}
+
+// Client sends heartbeats to the hub
+type Client struct {
+	url        string
+	token      string
+	instanceID string
+	canary     bool
+	httpClient *http.Client
+}
+
+// NewClient creates new heartbeat client
+func NewClient(p ClientParams) *Client {
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultClientTimeout
+	}
+	return &Client{
+		url:        strings.TrimSuffix(p.URL, "/"),
+		token:      p.Token,
+		instanceID: p.InstanceID,
+		canary:     p.Canary,
+		httpClient: &http.Client{Timeout: p.Timeout},
+	}
+}
+
+// Send the heartbeat to the hub, instance ID and canary flag are set from the client parameters if configured
+func (c *Client) Send(ctx context.Context, hb Heartbeat) error {
+	if c.instanceID != "" {
+		hb.InstanceID = c.instanceID
+	}
+	hb.Canary = hb.Canary || c.canary
+	if err := c.post(ctx, HeartbeatsPath, hb, nil); err != nil {
+		return fmt.Errorf("error sending heartbeat: %v", err)
+	}
+	return nil
+}
+
+// post sends v as JSON to the hub API path and decodes the response into result, if it's not nil
+func (c *Client) post(ctx context.Context, path string, v, result any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxRequestSize)).Decode(result)
+}
@@ -0,0 +1,195 @@
+package hub_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+	"github.com/mtfelian/elixir-testnet-updater/hub"
+)
+
+const token = "secret"
+
+type testHub struct {
+	server   *hub.Server
+	http     *httptest.Server
+	client   *hub.Client
+	notifier *harness.Recorder
+	clock    *harness.Clock
+}
+
+func newTestHub(t *testing.T) *testHub {
+	t.Helper()
+	th := &testHub{notifier: &harness.Recorder{}, clock: harness.NewClock(harness.Start)}
+	th.server = hub.NewServer(hub.ServerParams{
+		Token:      token,
+		StaleAfter: 5 * time.Minute,
+		SkewAfter:  time.Hour,
+		Notifier:   th.notifier,
+		Clock:      th.clock,
+	})
+	th.http = httptest.NewServer(th.server)
+	t.Cleanup(th.http.Close)
+	th.client = hub.NewClient(hub.ClientParams{URL: th.http.URL + "/", Token: token})
+	return th
+}
+
+func (th *testHub) send(t *testing.T, id, digest, version string) {
+	t.Helper()
+	if err := th.client.Send(context.Background(), hub.Heartbeat{
+		InstanceID:     id,
+		UpdaterVersion: version,
+		ImageDigest:    digest,
+		ContainerState: "running",
+		DockerHealth:   "healthy",
+		Metrics:        map[string]any{"status": "healthy"},
+	}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+func (th *testHub) get(t *testing.T, path, token string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, th.http.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+const (
+	digestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	digestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func TestHubFleet(t *testing.T) {
+	th := newTestHub(t)
+	th.send(t, "validator-2", digestA, "v1.0.0")
+	th.send(t, "validator-1", digestA, "v1.0.0")
+	if n := th.notifier.Count("joined"); n != 2 {
+		t.Errorf("expected 2 join notifications, got %v", th.notifier.Messages())
+	}
+
+	status, body := th.get(t, hub.FleetPath, token)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", status, body)
+	}
+	var fleet hub.Fleet
+	if err := json.Unmarshal([]byte(body), &fleet); err != nil {
+		t.Fatal(err)
+	}
+	if len(fleet.Instances) != 2 || fleet.Instances[0].InstanceID != "validator-1" ||
+		fleet.Instances[1].ImageDigest != digestA || fleet.Instances[1].Metrics["status"] != "healthy" ||
+		!fleet.Instances[0].ReceivedAt.Equal(harness.Start) || fleet.ImageSkew != "" {
+		t.Errorf("unexpected fleet: %+v", fleet)
+	}
+
+	th.heartbeat("validator-3", true, digestA, "healthy")
+	_, table := th.get(t, hub.FleetTablePath, token)
+	for _, want := range []string{"INSTANCE", "validator-1", "sha256:aaaaaaaaaaaa ", "running", "healthy", "v1.0.0"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("fleet table doesn't contain %q:\n%s", want, table)
+		}
+	}
+	for _, line := range strings.Split(table, "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "validator-3" && fields[1] != "canary" {
+			t.Errorf("live canary has status %q:\n%s", fields[1], table)
+		}
+	}
+}
+
+func TestHubAuthorization(t *testing.T) {
+	th := newTestHub(t)
+	if status, _ := th.get(t, hub.FleetPath, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized fleet request, got %d", status)
+	}
+	client := hub.NewClient(hub.ClientParams{URL: th.http.URL})
+	if err := client.Send(context.Background(), hub.Heartbeat{InstanceID: "x"}); err == nil ||
+		!strings.Contains(err.Error(), "401") {
+		t.Errorf("expected unauthorized heartbeat, got: %v", err)
+	}
+	if err := th.client.Send(context.Background(), hub.Heartbeat{}); err == nil ||
+		!strings.Contains(err.Error(), "instance_id is required") {
+		t.Errorf("expected invalid heartbeat, got: %v", err)
+	}
+	if len(th.server.Fleet().Instances) != 0 {
+		t.Errorf("rejected heartbeats were stored")
+	}
+}
+
+func TestHubStaleInstances(t *testing.T) {
+	th := newTestHub(t)
+	th.send(t, "validator-1", digestA, "v1.0.0")
+	th.send(t, "validator-2", digestA, "v1.0.0")
+
+	th.clock.Advance(4 * time.Minute)
+	th.send(t, "validator-1", digestA, "v1.0.0")
+	th.server.Check()
+	th.clock.Advance(2 * time.Minute)
+	th.server.Check()
+	th.server.Check()
+	if n := th.notifier.Count(`instance "validator-2" is stale, no heartbeat for 6m0s`); n != 1 {
+		t.Fatalf("expected one stale notification, got %v", th.notifier.Messages())
+	}
+	if th.notifier.Contains(`"validator-1" is stale`) {
+		t.Errorf("live instance is reported stale")
+	}
+	if fleet := th.server.Fleet(); !fleet.Instances[1].Stale {
+		t.Errorf("instance is not marked stale: %+v", fleet.Instances[1])
+	}
+
+	th.send(t, "validator-2", digestA, "v1.0.0")
+	if !th.notifier.Contains(`instance "validator-2" is reporting again after 6m0s`) {
+		t.Errorf("recovery was not notified: %v", th.notifier.Messages())
+	}
+}
+
+func TestHubVersionSkew(t *testing.T) {
+	th := newTestHub(t)
+	th.send(t, "validator-1", digestA, "v1.0.0")
+	th.send(t, "validator-2", digestA, "v1.0.0")
+	th.send(t, "validator-3", digestB, "v1.1.0")
+	th.server.Check()
+
+	th.clock.Advance(59 * time.Minute)
+	for _, id := range []string{"validator-1", "validator-2"} {
+		th.send(t, id, digestA, "v1.0.0")
+	}
+	th.send(t, "validator-3", digestB, "v1.1.0")
+	th.server.Check()
+	if th.notifier.Contains("skew") {
+		t.Fatalf("skew alerted before skew_after: %v", th.notifier.Messages())
+	}
+
+	th.clock.Advance(time.Minute)
+	th.server.Check()
+	th.server.Check()
+	want := "fleet: image skew for 1h0m0s: sha256:aaaaaaaaaaaa on validator-1, validator-2; sha256:bbbbbbbbbbbb on validator-3"
+	if n := th.notifier.Count(want); n != 1 {
+		t.Errorf("expected one image skew alert %q, got %v", want, th.notifier.Messages())
+	}
+	if n := th.notifier.Count("fleet: updater version skew"); n != 1 {
+		t.Errorf("expected one updater version skew alert, got %v", th.notifier.Messages())
+	}
+	if fleet := th.server.Fleet(); fleet.ImageSkew == "" {
+		t.Errorf("skew is not reported in fleet")
+	}
+
+	th.send(t, "validator-1", digestB, "v1.1.0")
+	th.send(t, "validator-2", digestB, "v1.1.0")
+	th.server.Check()
+	if !th.notifier.Contains("fleet: all live instances run the same image again") ||
+		!th.notifier.Contains("fleet: all live instances run the same updater version again") {
+		t.Errorf("skew resolution was not notified: %v", th.notifier.Messages())
+	}
+}
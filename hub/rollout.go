@@ -0,0 +1,240 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// RolloutRequest asks the hub whether the instance may update to the image, or reports the update result
+type RolloutRequest struct {
+	InstanceID string `json:"instance_id"`
+	Canary     bool   `json:"canary"`
+	// Image is the registry digest of the image, or its ID if the digest is unknown
+	Image string `json:"image"`
+	// Error is the update failure of a report, empty on success
+	Error string `json:"error,omitempty"`
+}
+
+func (r *RolloutRequest) validate() error {
+	if r.InstanceID == "" || r.Image == "" {
+		return errors.New("instance_id and image are required")
+	}
+	return nil
+}
+
+// ResumeRequest resumes the halted rollout of the image
+type ResumeRequest struct {
+	Image string `json:"image"`
+}
+
+func (r *ResumeRequest) validate() error {
+	if r.Image == "" {
+		return errors.New("image is required")
+	}
+	return nil
+}
+
+// RolloutDecision is the response to RolloutRequest
+type RolloutDecision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Rollout represents the rollout of an image across the fleet
+type Rollout struct {
+	Image   string    `json:"image"`
+	Started time.Time `json:"started"`
+	// Halted is the reason the rollout was halted, empty if it's in progress
+	Halted string `json:"halted,omitempty"`
+	// Completed is the time all live instances ran the image, zero if it's in progress.
+	// Completed rollouts are not shown
+	Completed time.Time `json:"-"`
+}
+
+// Allow decides whether the instance may update to the image now. Canaries update first,
+// other instances wait until all live canaries run the image and stay healthy on it for the soak time.
+// Without a live canary which has soaked on the image, other instances wait too.
+// A rollout halted by a failed canary allows nobody, a completed one allows everybody
+func (s *Server) Allow(req RolloutRequest) RolloutDecision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+
+	r, exists := s.rollouts[req.Image]
+	if !exists {
+		// a newer image supersedes completed rollouts, they are kept only to ignore late requests
+		for image, completed := range s.rollouts {
+			if !completed.Completed.IsZero() {
+				delete(s.rollouts, image)
+			}
+		}
+		r = &Rollout{Image: req.Image, Started: now}
+		s.rollouts[req.Image] = r
+		log.Printf("Rollout of image %s started by %q", req.Image, req.InstanceID)
+		s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: rollout of image %s started", shortImage(req.Image)))
+	}
+	if r.Halted != "" {
+		return RolloutDecision{Reason: fmt.Sprintf("rollout of image %s is halted: %s", shortImage(req.Image), r.Halted)}
+	}
+	if req.Canary || !r.Completed.IsZero() {
+		return RolloutDecision{Allowed: true}
+	}
+
+	var soaked bool
+	for _, id := range s.idsLocked() {
+		inst := s.instances[id]
+		if !inst.Canary || inst.Stale || id == req.InstanceID {
+			continue
+		}
+		switch {
+		case inst.image() != req.Image:
+			return RolloutDecision{Reason: fmt.Sprintf("waiting for canary %q to update", id)}
+		case inst.HealthySince.IsZero():
+			return RolloutDecision{Reason: fmt.Sprintf("waiting for canary %q to become healthy", id)}
+		case now.Sub(inst.HealthySince) < s.soak:
+			return RolloutDecision{Reason: fmt.Sprintf("canary %q is soaking, %s left",
+				id, (s.soak - now.Sub(inst.HealthySince)).Round(time.Second))}
+		}
+		soaked = true
+	}
+	if !soaked {
+		// stale canaries and canaries which never sent a heartbeat prove nothing about the image
+		return RolloutDecision{Reason: "waiting for a live canary to soak on the image"}
+	}
+	return RolloutDecision{Allowed: true}
+}
+
+// Report the update result of the instance. A failed canary halts the rollout unless it's completed
+func (s *Server) Report(req RolloutRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Error == "" {
+		log.Printf("Instance %q updated to image %s", req.InstanceID, req.Image)
+		return
+	}
+	if r, exists := s.rollouts[req.Image]; !req.Canary || (exists && !r.Completed.IsZero()) {
+		s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: instance %q failed to update to image %s: %s",
+			req.InstanceID, shortImage(req.Image), req.Error))
+		return
+	}
+	s.haltLocked(req.Image, fmt.Sprintf("canary %q failed to update: %s", req.InstanceID, req.Error))
+}
+
+// Resume the halted rollout of the image
+func (s *Server) Resume(image string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, exists := s.rollouts[image]
+	if !exists || r.Halted == "" {
+		return fmt.Errorf("rollout of image %s is not halted", image)
+	}
+	delete(s.rollouts, image)
+	s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: rollout of image %s was resumed", shortImage(image)))
+	return nil
+}
+
+// haltLocked halts the rollout of the image, s.mu should be held
+func (s *Server) haltLocked(image, reason string) {
+	r, exists := s.rollouts[image]
+	if !exists {
+		r = &Rollout{Image: image, Started: s.clock.Now()}
+		s.rollouts[image] = r
+	}
+	if r.Halted != "" {
+		return
+	}
+	r.Halted = reason
+	s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: rollout of image %s is halted: %s", shortImage(image), reason))
+}
+
+// healthy returns whether the heartbeat reports a running container without failing health check
+func healthy(hb Heartbeat) bool {
+	return hb.Error == "" && !hb.UpdateInProgress && hb.ContainerState == "running" &&
+		(hb.DockerHealth == types.Healthy || hb.DockerHealth == types.NoHealthcheck || hb.DockerHealth == "")
+}
+
+// trackHealthLocked updates the time the instance became healthy on its image.
+// A canary which runs a rolled out image and fails halts the rollout. s.mu should be held
+func (s *Server) trackHealthLocked(inst *Instance, previous Heartbeat) {
+	switch {
+	case !healthy(inst.Heartbeat):
+		inst.HealthySince = time.Time{}
+	case inst.HealthySince.IsZero() || inst.image() != previous.image():
+		inst.HealthySince = s.clock.Now()
+	}
+
+	failed := inst.DockerHealth == types.Unhealthy || (inst.ContainerState != "" && inst.ContainerState != "running")
+	r, exists := s.rollouts[inst.image()]
+	if inst.Canary && failed && !inst.UpdateInProgress && exists && r.Completed.IsZero() {
+		s.haltLocked(r.Image, fmt.Sprintf("canary %q is %s", inst.InstanceID, canaryFailure(inst.Heartbeat)))
+	}
+}
+
+// canaryFailure describes the failed container state
+func canaryFailure(hb Heartbeat) string {
+	if hb.DockerHealth == types.Unhealthy {
+		return "unhealthy"
+	}
+	return hb.ContainerState
+}
+
+// checkRolloutsLocked completes rollouts which all live instances run, s.mu should be held
+func (s *Server) checkRolloutsLocked() {
+	for image, r := range s.rollouts {
+		if r.Halted != "" || !r.Completed.IsZero() {
+			continue
+		}
+		done := true
+		for _, inst := range s.instances {
+			if !inst.Stale && inst.image() != image {
+				done = false
+				break
+			}
+		}
+		if done {
+			r.Completed = s.clock.Now()
+			s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: rollout of image %s is completed in %s",
+				shortImage(image), s.clock.Now().Sub(r.Started).Round(time.Second)))
+		}
+	}
+}
+
+// rolloutsLocked returns rollouts ordered by start time, s.mu should be held
+func (s *Server) rolloutsLocked() []Rollout {
+	rollouts := make([]Rollout, 0, len(s.rollouts))
+	for _, r := range s.rollouts {
+		if r.Completed.IsZero() {
+			rollouts = append(rollouts, *r)
+		}
+	}
+	sort.Slice(rollouts, func(i, j int) bool { return rollouts[i].Started.Before(rollouts[j].Started) })
+	return rollouts
+}
+
+// Allow asks the hub whether the instance may update to the image now, and the reason if it may not
+func (c *Client) Allow(ctx context.Context, image string) (bool, string, error) {
+	var decision RolloutDecision
+	req := RolloutRequest{InstanceID: c.instanceID, Canary: c.canary, Image: image}
+	if err := c.post(ctx, RolloutAllowPath, req, &decision); err != nil {
+		return false, "", fmt.Errorf("error requesting rollout decision: %v", err)
+	}
+	return decision.Allowed, decision.Reason, nil
+}
+
+// Report the update result to the hub, updateErr is nil on success
+func (c *Client) Report(ctx context.Context, image string, updateErr error) error {
+	req := RolloutRequest{InstanceID: c.instanceID, Canary: c.canary, Image: image}
+	if updateErr != nil {
+		req.Error = updateErr.Error()
+	}
+	if err := c.post(ctx, RolloutReportPath, req, nil); err != nil {
+		return fmt.Errorf("error reporting rollout result: %v", err)
+	}
+	return nil
+}
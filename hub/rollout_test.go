@@ -0,0 +1,170 @@
+package hub_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/hub"
+)
+
+// heartbeat sends a heartbeat of the running container
+func (th *testHub) heartbeat(id string, canary bool, digest, health string) {
+	th.server.Receive(hub.Heartbeat{
+		InstanceID:     id,
+		Canary:         canary,
+		ImageDigest:    digest,
+		ContainerState: "running",
+		DockerHealth:   health,
+	})
+}
+
+func (th *testHub) allow(t *testing.T, id string, canary bool, digest, reason string) {
+	t.Helper()
+	decision := th.server.Allow(hub.RolloutRequest{InstanceID: id, Canary: canary, Image: digest})
+	if reason == "" && !decision.Allowed {
+		t.Fatalf("expected %s to be allowed, got: %s", id, decision.Reason)
+	}
+	if reason != "" && (decision.Allowed || !strings.Contains(decision.Reason, reason)) {
+		t.Fatalf("expected %s to be denied with %q, got: %+v", id, reason, decision)
+	}
+}
+
+func TestRollout(t *testing.T) {
+	th := newTestHub(t)
+	th.heartbeat("canary", true, digestA, "healthy")
+	th.heartbeat("validator", false, digestA, "healthy")
+
+	th.allow(t, "validator", false, digestB, `waiting for canary "canary" to update`)
+	if !th.notifier.Contains("fleet: rollout of image sha256:bbbbbbbbbbbb started") {
+		t.Errorf("rollout start was not notified: %v", th.notifier.Messages())
+	}
+	th.allow(t, "canary", true, digestB, "")
+
+	th.heartbeat("canary", true, digestB, "starting")
+	th.allow(t, "validator", false, digestB, `waiting for canary "canary" to become healthy`)
+	th.clock.Advance(time.Minute)
+	th.heartbeat("canary", true, digestB, "healthy")
+	th.clock.Advance(20 * time.Minute)
+	th.heartbeat("canary", true, digestB, "healthy")
+	th.allow(t, "validator", false, digestB, `canary "canary" is soaking, 10m0s left`)
+
+	th.clock.Advance(10 * time.Minute)
+	th.allow(t, "validator", false, digestB, "")
+	if len(th.server.Fleet().Rollouts) != 1 {
+		t.Errorf("expected rollout in progress")
+	}
+	th.heartbeat("validator", false, digestB, "healthy")
+	th.server.Check()
+	if !th.notifier.Contains("fleet: rollout of image sha256:bbbbbbbbbbbb is completed in 31m0s") {
+		t.Errorf("rollout completion was not notified: %v", th.notifier.Messages())
+	}
+	if len(th.server.Fleet().Rollouts) != 0 {
+		t.Errorf("completed rollout is shown")
+	}
+
+	// a late request for the completed image doesn't start the rollout again
+	th.allow(t, "validator-2", false, digestB, "")
+	th.server.Check()
+	if th.notifier.Count("rollout of image sha256:bbbbbbbbbbbb started") != 1 ||
+		th.notifier.Count("rollout of image sha256:bbbbbbbbbbbb is completed") != 1 {
+		t.Errorf("completed rollout was restarted: %v", th.notifier.Messages())
+	}
+
+	// a newer image starts a new rollout and drops the completed one
+	th.allow(t, "validator", false, digestA, "waiting")
+	if fleet := th.server.Fleet(); len(fleet.Rollouts) != 1 || fleet.Rollouts[0].Image != digestA {
+		t.Errorf("expected the new rollout only, got %+v", fleet.Rollouts)
+	}
+}
+
+func TestRolloutHalt(t *testing.T) {
+	for name, fail := range map[string]func(th *testHub){
+		"report": func(th *testHub) {
+			th.server.Report(hub.RolloutRequest{InstanceID: "canary", Canary: true, Image: digestB, Error: "rolled back"})
+		},
+		"unhealthy": func(th *testHub) {
+			th.heartbeat("canary", true, digestB, "unhealthy")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			th := newTestHub(t)
+			th.heartbeat("canary", true, digestA, "healthy")
+			th.heartbeat("canary-2", true, digestA, "healthy")
+			th.heartbeat("validator", false, digestA, "healthy")
+			th.allow(t, "canary", true, digestB, "")
+
+			fail(th)
+			if n := th.notifier.Count("fleet: rollout of image sha256:bbbbbbbbbbbb is halted: canary \"canary\""); n != 1 {
+				t.Fatalf("expected one halt notification, got %v", th.notifier.Messages())
+			}
+			th.allow(t, "canary-2", true, digestB, "is halted")
+			th.clock.Advance(time.Hour)
+			th.allow(t, "validator", false, digestB, "is halted")
+			if fleet := th.server.Fleet(); len(fleet.Rollouts) != 1 || fleet.Rollouts[0].Halted == "" {
+				t.Errorf("halted rollout is not reported: %+v", fleet.Rollouts)
+			}
+
+			if err := th.server.Resume(digestB); err != nil {
+				t.Fatalf("Resume: %v", err)
+			}
+			if err := th.server.Resume(digestB); err == nil {
+				t.Errorf("expected error resuming not halted rollout")
+			}
+			th.allow(t, "canary-2", true, digestB, "")
+		})
+	}
+}
+
+func TestRolloutWithoutLiveCanary(t *testing.T) {
+	th := newTestHub(t)
+	th.heartbeat("validator", false, digestA, "healthy")
+	th.allow(t, "validator", false, digestB, "waiting for a live canary to soak on the image")
+
+	th.heartbeat("canary", true, digestA, "healthy")
+	th.allow(t, "canary", true, digestB, "")
+	th.heartbeat("canary", true, digestB, "healthy")
+	th.clock.Advance(6 * time.Minute)
+	th.heartbeat("validator", false, digestA, "healthy")
+	th.server.Check()
+	if fleet := th.server.Fleet(); !fleet.Instances[0].Stale {
+		t.Fatalf("canary is not stale: %+v", fleet.Instances[0])
+	}
+	th.clock.Advance(time.Hour)
+	th.allow(t, "validator", false, digestB, "waiting for a live canary to soak on the image")
+
+	// the canary is back and soaks on the image
+	th.heartbeat("canary", true, digestB, "healthy")
+	th.allow(t, "validator", false, digestB, `canary "canary" is soaking`)
+	th.clock.Advance(30 * time.Minute)
+	th.allow(t, "validator", false, digestB, "")
+}
+
+func TestRolloutClient(t *testing.T) {
+	th := newTestHub(t)
+	th.heartbeat("canary", true, digestA, "healthy")
+	client := hub.NewClient(hub.ClientParams{URL: th.http.URL, Token: token, InstanceID: "validator"})
+	canary := hub.NewClient(hub.ClientParams{URL: th.http.URL, Token: token, InstanceID: "canary", Canary: true})
+
+	allowed, reason, err := client.Allow(context.Background(), digestB)
+	if err != nil || allowed || !strings.Contains(reason, "waiting for canary") {
+		t.Fatalf("expected denial, got %v, %q, %v", allowed, reason, err)
+	}
+	if allowed, _, err := canary.Allow(context.Background(), digestB); err != nil || !allowed {
+		t.Fatalf("expected canary to be allowed, got %v, %v", allowed, err)
+	}
+	if err := canary.Report(context.Background(), digestB, errors.New("health check failed")); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	allowed, reason, err = client.Allow(context.Background(), digestB)
+	if err != nil || allowed || !strings.Contains(reason, `canary "canary" failed to update: health check failed`) {
+		t.Fatalf("expected halted rollout, got %v, %q, %v", allowed, reason, err)
+	}
+
+	unauthorized := hub.NewClient(hub.ClientParams{URL: th.http.URL, InstanceID: "validator"})
+	if _, _, err := unauthorized.Allow(context.Background(), digestB); err == nil {
+		t.Errorf("expected unauthorized request to fail")
+	}
+}
@@ -0,0 +1,345 @@
+package hub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/clock"
+	"github.com/mtfelian/elixir-testnet-updater/notifier"
+)
+
+// default values
+const (
+	DefaultStaleAfter = 5 * time.Minute
+	DefaultSkewAfter  = 2 * time.Hour
+	DefaultSoak       = 30 * time.Minute
+	maxRequestSize    = 1 << 20
+)
+
+// Instance represents the last known state of an updater instance
+type Instance struct {
+	Heartbeat
+	ReceivedAt time.Time `json:"received_at"`
+	Stale      bool      `json:"stale"`
+	// HealthySince is the time the instance became healthy on its current image, zero if it's not healthy
+	HealthySince time.Time `json:"healthy_since"`
+}
+
+// Fleet represents states of all known instances
+type Fleet struct {
+	Instances []Instance `json:"instances"`
+	// ImageSkew and VersionSkew describe differing images and updater versions of live instances, empty if none
+	ImageSkew   string    `json:"image_skew,omitempty"`
+	VersionSkew string    `json:"version_skew,omitempty"`
+	Rollouts    []Rollout `json:"rollouts"`
+}
+
+// ServerParams represents hub server parameters
+type ServerParams struct {
+	// Token is required from clients as a bearer token, if set
+	Token string
+	// StaleAfter is the time without heartbeats after which an instance is stale, defaults to DefaultStaleAfter
+	StaleAfter time.Duration
+	// SkewAfter is the time live instances may run different versions before alerting, defaults to DefaultSkewAfter
+	SkewAfter time.Duration
+	// Soak is the time canaries should stay healthy on a new image before other instances update to it,
+	// defaults to DefaultSoak
+	Soak     time.Duration
+	Notifier notifier.Notifier
+	// Clock defaults to the real clock
+	Clock clock.Clock
+}
+
+// skew tracks differing values of live instances
+type skew struct {
+	name string
+	// value returns the compared value of the instance, empty values are ignored
+	value   func(Heartbeat) string
+	since   time.Time
+	alerted string
+}
+
+// Server receives heartbeats, serves the fleet state and alerts on stale instances and version skew
+type Server struct {
+	token      string
+	staleAfter time.Duration
+	skewAfter  time.Duration
+	soak       time.Duration
+	notifier   notifier.Notifier
+	clock      clock.Clock
+
+	mu        sync.Mutex
+	instances map[string]*Instance
+	skews     []*skew
+	rollouts  map[string]*Rollout
+}
+
+// NewServer creates new hub server
+func NewServer(p ServerParams) *Server {
+	s := &Server{
+		token:      p.Token,
+		staleAfter: p.StaleAfter,
+		skewAfter:  p.SkewAfter,
+		soak:       p.Soak,
+		notifier:   p.Notifier,
+		clock:      p.Clock,
+		instances:  make(map[string]*Instance),
+		rollouts:   make(map[string]*Rollout),
+		skews: []*skew{
+			{name: "image", value: func(hb Heartbeat) string { return hb.image() }},
+			{name: "updater version", value: func(hb Heartbeat) string { return hb.UpdaterVersion }},
+		},
+	}
+	if s.staleAfter <= 0 {
+		s.staleAfter = DefaultStaleAfter
+	}
+	if s.skewAfter <= 0 {
+		s.skewAfter = DefaultSkewAfter
+	}
+	if s.soak <= 0 {
+		s.soak = DefaultSoak
+	}
+	if s.notifier == nil {
+		s.notifier = &notifier.Dummy{}
+	}
+	if s.clock == nil {
+		s.clock = clock.Real{}
+	}
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch {
+	case r.URL.Path == HeartbeatsPath && r.Method == http.MethodPost:
+		var hb Heartbeat
+		if !decodeRequest(w, r, &hb, "heartbeat") {
+			return
+		}
+		s.Receive(hb)
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == RolloutAllowPath && r.Method == http.MethodPost:
+		var req RolloutRequest
+		if !decodeRequest(w, r, &req, "rollout request") {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Allow(req))
+	case r.URL.Path == RolloutReportPath && r.Method == http.MethodPost:
+		var req RolloutRequest
+		if !decodeRequest(w, r, &req, "rollout report") {
+			return
+		}
+		s.Report(req)
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == RolloutResumePath && r.Method == http.MethodPost:
+		var req ResumeRequest
+		if !decodeRequest(w, r, &req, "rollout resume request") {
+			return
+		}
+		if err := s.Resume(req.Image); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == FleetPath && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Fleet())
+	case r.URL.Path == FleetTablePath && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		s.Fleet().Print(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// request is a validated API request
+type request interface {
+	validate() error
+}
+
+// decodeRequest decodes and validates JSON request body.
+// It responds with an error and returns false if the request is invalid
+func decodeRequest(w http.ResponseWriter, r *http.Request, req request, name string) bool {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(req)
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Receive the heartbeat of the instance
+func (s *Server) Receive(hb Heartbeat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, known := s.instances[hb.InstanceID]
+	switch {
+	case !known:
+		log.Printf("Instance %q joined the fleet", hb.InstanceID)
+		s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: instance %q joined, image %s",
+			hb.InstanceID, shortImage(hb.image())))
+		inst = &Instance{}
+		s.instances[hb.InstanceID] = inst
+	case inst.Stale:
+		s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: instance %q is reporting again after %s",
+			hb.InstanceID, s.clock.Now().Sub(inst.ReceivedAt).Round(time.Second)))
+		inst.HealthySince = time.Time{} // the health while it was silent is unknown, the soak starts over
+	}
+	previous := inst.Heartbeat
+	inst.Heartbeat = hb
+	inst.ReceivedAt = s.clock.Now()
+	inst.Stale = false
+	s.trackHealthLocked(inst, previous)
+}
+
+// Check detects stale instances and version skew, notifying about changes
+func (s *Server) Check() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+
+	for _, id := range s.idsLocked() {
+		inst := s.instances[id]
+		if !inst.Stale && now.Sub(inst.ReceivedAt) > s.staleAfter {
+			inst.Stale = true
+			s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: instance %q is stale, no heartbeat for %s",
+				id, now.Sub(inst.ReceivedAt).Round(time.Second)))
+		}
+	}
+
+	s.checkRolloutsLocked()
+
+	for _, sk := range s.skews {
+		description := s.skewLocked(sk)
+		switch {
+		case description == "":
+			if sk.alerted != "" {
+				s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: all live instances run the same %s again", sk.name))
+			}
+			sk.since, sk.alerted = time.Time{}, ""
+		case sk.since.IsZero():
+			sk.since = now
+		}
+		if description != "" && description != sk.alerted && now.Sub(sk.since) >= s.skewAfter {
+			sk.alerted = description
+			s.notifier.SendBroadcastMessage(fmt.Sprintf("fleet: %s skew for %s: %s",
+				sk.name, now.Sub(sk.since).Round(time.Second), description))
+		}
+	}
+}
+
+// Fleet returns states of all known instances ordered by ID
+func (s *Server) Fleet() Fleet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fleet := Fleet{Instances: make([]Instance, 0, len(s.instances))}
+	for _, id := range s.idsLocked() {
+		fleet.Instances = append(fleet.Instances, *s.instances[id])
+	}
+	fleet.ImageSkew = s.skewLocked(s.skews[0])
+	fleet.VersionSkew = s.skewLocked(s.skews[1])
+	fleet.Rollouts = s.rolloutsLocked()
+	return fleet
+}
+
+// idsLocked returns sorted instance IDs, s.mu should be held
+func (s *Server) idsLocked() []string {
+	ids := make([]string, 0, len(s.instances))
+	for id := range s.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// skewLocked describes differing values of live instances like "A on x, y; B on z", empty if there's no skew.
+// s.mu should be held
+func (s *Server) skewLocked(sk *skew) string {
+	groups := make(map[string][]string)
+	for _, id := range s.idsLocked() {
+		inst := s.instances[id]
+		if value := sk.value(inst.Heartbeat); !inst.Stale && value != "" {
+			groups[value] = append(groups[value], id)
+		}
+	}
+	if len(groups) < 2 {
+		return ""
+	}
+	values := make([]string, 0, len(groups))
+	for value := range groups {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		parts = append(parts, fmt.Sprintf("%s on %s", shortImage(value), strings.Join(groups[value], ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// shortImage shortens image digests and IDs to 12 hex characters
+func shortImage(s string) string {
+	if algorithm, hex, ok := strings.Cut(s, ":"); ok && len(hex) > 12 {
+		return algorithm + ":" + hex[:12]
+	}
+	return s
+}
+
+// Print the fleet table
+func (f Fleet) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tSTATUS\tLAST SEEN\tIMAGE\tSTATE\tHEALTH\tUPDATER\tERROR")
+	for _, inst := range f.Instances {
+		status := "ok"
+		switch {
+		case inst.Stale && inst.Canary:
+			status = "stale canary"
+		case inst.Stale:
+			status = "stale"
+		case inst.Canary && inst.UpdateInProgress:
+			status = "updating canary"
+		case inst.Canary:
+			status = "canary"
+		case inst.UpdateInProgress:
+			status = "updating"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", inst.InstanceID, status,
+			inst.ReceivedAt.UTC().Format(time.RFC3339), shortImage(inst.image()), inst.ContainerState,
+			inst.DockerHealth, inst.UpdaterVersion, inst.Error)
+	}
+	_ = tw.Flush()
+	if f.ImageSkew != "" {
+		fmt.Fprintf(w, "\nimage skew: %s\n", f.ImageSkew)
+	}
+	if f.VersionSkew != "" {
+		fmt.Fprintf(w, "updater version skew: %s\n", f.VersionSkew)
+	}
+	for _, r := range f.Rollouts {
+		state := "in progress"
+		if r.Halted != "" {
+			state = "halted: " + r.Halted
+		}
+		fmt.Fprintf(w, "rollout of %s started at %s: %s\n", shortImage(r.Image), r.Started.UTC().Format(time.RFC3339), state)
+	}
+}
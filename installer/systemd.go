@@ -1,6 +1,7 @@
 package installer
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -13,12 +14,19 @@ type Systemd struct {
 	serviceName string
 	binaryPath  string
 	user        string
+	rootless    bool
+	// socket is the user unit of the container runtime API the rootless service depends on, if known
+	socket string
 }
 
 // SystemdParams represents systemd service params
 type SystemdParams struct {
 	ServiceName string
 	User        string
+	// Rootless installs a user unit of the current user instead of the system one, User is ignored
+	Rootless bool
+	// Runtime is "docker", "podman" or "auto", the rootless service depends on the runtime user unit
+	Runtime string
 }
 
 // NewSystemd creates new systemd service installer
@@ -26,6 +34,18 @@ func NewSystemd(p SystemdParams) (*Systemd, error) {
 	ss := &Systemd{
 		serviceName: p.ServiceName,
 		user:        p.User,
+		rootless:    p.Rootless,
+	}
+	if ss.rootless {
+		if os.Getuid() == 0 {
+			return nil, errors.New("rootless service must be installed by the user running the container runtime, not root")
+		}
+		switch p.Runtime {
+		case "podman":
+			ss.socket = "podman.socket"
+		case "docker":
+			ss.socket = "docker.service" // rootless Docker daemon
+		}
 	}
 
 	var err error
@@ -38,30 +58,50 @@ func NewSystemd(p SystemdParams) (*Systemd, error) {
 
 // unitFilePath returns a path to systemd service definition file
 func (ss *Systemd) unitFilePath() string {
+	if ss.rootless {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			dir = filepath.Join(os.Getenv("HOME"), ".config")
+		}
+		return filepath.Join(dir, "systemd", "user", ss.serviceName+".service")
+	}
 	return "/etc/systemd/system/" + ss.serviceName + ".service"
 }
 
 const systemdUnitTemplate = `[Unit]
 Description=Elixir Updater
-After=network.target
+{{- with .After}}
+After={{.}}
+{{- end}}
+{{- with .Socket}}
+Wants={{.}}
+{{- end}}
 
 [Service]
 ExecStart={{.ExecStart}}
 Restart=always
-User={{.User}}
+{{- with .User}}
+User={{.}}
+{{- end}}
 WorkingDirectory={{.WorkingDirectory}}
 StandardOutput=syslog
 StandardError=syslog
 
 [Install]
-WantedBy=multi-user.target
+WantedBy={{.WantedBy}}
 `
 
 // SystemdUnitFileData represents data which describes a Linux system service
 type SystemdUnitFileData struct {
-	ExecStart        string
+	ExecStart string
+	// User is empty for user units
 	User             string
 	WorkingDirectory string
+	// After lists the units the service starts after, may be empty
+	After string
+	// Socket is the container runtime unit the service depends on, may be empty
+	Socket   string
+	WantedBy string
 }
 
 // writeUnitFile writes the systemd unit file to the specified path
@@ -70,6 +110,15 @@ func (ss *Systemd) writeUnitFile() error {
 		ExecStart:        ss.binaryPath,
 		User:             ss.user,
 		WorkingDirectory: filepath.Dir(ss.binaryPath),
+		After:            "network.target",
+		WantedBy:         "multi-user.target",
+	}
+	if ss.rootless {
+		// system targets like network.target don't exist in the user manager
+		unitData.User, unitData.After, unitData.Socket, unitData.WantedBy = "", ss.socket, ss.socket, "default.target"
+		if err := os.MkdirAll(filepath.Dir(ss.unitFilePath()), 0o755); err != nil {
+			return fmt.Errorf("error creating unit directory: %v", err)
+		}
 	}
 
 	tmpl, err := template.New("systemd").Parse(systemdUnitTemplate)
@@ -90,17 +139,37 @@ func (ss *Systemd) writeUnitFile() error {
 	return nil
 }
 
+// systemctl returns the systemctl command managing the units of the installation
+func (ss *Systemd) systemctl(args ...string) *exec.Cmd {
+	if ss.rootless {
+		args = append([]string{"--user"}, args...)
+	}
+	return exec.Command("systemctl", args...)
+}
+
 // enableAndStartService enables and starts the systemd service
 func (ss *Systemd) enableAndStartService() error {
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
+	if err := ss.systemctl("daemon-reload").Run(); err != nil {
 		return fmt.Errorf("error reloading systemd daemon: %v", err)
 	}
 
-	if err := exec.Command("systemctl", "enable", ss.serviceName).Run(); err != nil {
+	if ss.rootless {
+		// user services are stopped on logout and not started on boot without lingering
+		if err := exec.Command("loginctl", "enable-linger").Run(); err != nil {
+			fmt.Printf("Failed to enable lingering, the service will run only while the user is logged in: %v\n", err)
+		}
+		if ss.socket == "podman.socket" {
+			if err := ss.systemctl("enable", "--now", ss.socket).Run(); err != nil {
+				return fmt.Errorf("error enabling Podman API socket: %v", err)
+			}
+		}
+	}
+
+	if err := ss.systemctl("enable", ss.serviceName).Run(); err != nil {
 		return fmt.Errorf("error enabling service: %v", err)
 	}
 
-	if err := exec.Command("systemctl", "start", ss.serviceName).Run(); err != nil {
+	if err := ss.systemctl("start", ss.serviceName).Run(); err != nil {
 		return fmt.Errorf("error starting service: %v", err)
 	}
 
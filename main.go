@@ -2,67 +2,332 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mtfelian/elixir-testnet-updater/config"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/deploy"
+	"github.com/mtfelian/elixir-testnet-updater/hooks"
+	"github.com/mtfelian/elixir-testnet-updater/hub"
 	"github.com/mtfelian/elixir-testnet-updater/installer"
+	"github.com/mtfelian/elixir-testnet-updater/selfupdate"
 	"github.com/mtfelian/elixir-testnet-updater/service"
 )
 
-const delay = 3 * time.Second
-
 var svc *service.Service
 
+// version is set on release builds with -ldflags "-X main.version=vX.Y.Z"
+var version = "dev"
+
 func main() {
-	fmt.Printf("Waiting for %s startup delay...\n", delay)
-	time.Sleep(delay)
-	svc = initialize()
-	svc.Notifier.SendBroadcastMessage("launcher started")
-	select {}
-}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "deploy":
+			os.Exit(deployCommand(os.Args[2:]))
+		case "install":
+			os.Exit(installCommand())
+		case "status":
+			os.Exit(statusCommand())
+		case "version":
+			fmt.Println(version)
+			return
+		}
+	}
+
+	dryRun := flag.Bool("dry-run", false, "print the actions of the update without making any changes, then exit")
+	flag.Parse()
+	if !*dryRun {
+		recoverSelfUpdate()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-func initialize() *service.Service {
 	cfg, err := config.New()
 	if err != nil {
-		log.Fatalf("Failed to create initialize configuration: %v", err)
+		log.Fatalf("Failed to initialize configuration: %v", err)
 	}
+	if *dryRun {
+		os.Exit(dryRunCommand(ctx, cfg))
+	}
+	log.Printf("Starting updater %s", version)
+	svc = initialize(ctx, cfg)
+	svc.Notifier.SendBroadcastMessage("launcher started")
 
-	params := service.Params{
-		TGBotToken:       cfg.TGBotToken,
-		TGForceChatID:    cfg.TGForceChatID,
-		User:             cfg.User,
-		ContainerName:    cfg.ContainerName,
-		RestartPolicy:    cfg.RestartPolicy,
-		EnvFilePath:      cfg.EnvFilePath,
-		ServiceName:      cfg.ServiceName,
-		Port:             cfg.Port,
-		DockerAPIVersion: cfg.DockerAPIVersion,
-		ImageName:        cfg.ImageName,
-		MetricsURI:       fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+	<-ctx.Done()
+	stop() // the second signal kills the process immediately
+	if err := shutdown(cfg); err != nil {
+		log.Printf("Running jobs were cancelled: %v", err)
+		os.Exit(1)
+	}
+	log.Println("Stopped.")
+}
+
+// recoverSelfUpdate counts the start of the binary installed by self-update, restoring the previous one
+// after too many failed starts. It runs before the configuration is loaded, which a new release may fail on
+func recoverSelfUpdate() {
+	if err := selfupdate.Recover(selfupdate.Params{CurrentVersion: version}); errors.Is(err, selfupdate.ErrRolledBack) {
+		log.Fatalf("New updater failed to start, the previous one is restored: exiting to be restarted")
+	} else if err != nil {
+		log.Printf("Failed to check self-update state: %v", err)
+	}
+}
+
+// shutdown stops the service gracefully, waiting for in-flight jobs no longer than configured timeout
+func shutdown(cfg config.Config) error {
+	timeout, _ := time.ParseDuration(cfg.ShutdownTimeout) // validated by config
+	log.Printf("Shutting down, waiting up to %s for running jobs...", timeout)
+	svc.Notifier.SendBroadcastMessage("launcher stopping")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return svc.Stop(ctx)
+}
+
+func initialize(ctx context.Context, cfg config.Config) *service.Service {
+	params := serviceParams(cfg)
+	if err := installService(cfg); err != nil {
+		log.Fatal(err)
 	}
 
+	svc, err := service.New(ctx, params)
+	if err != nil && ctx.Err() != nil {
+		log.Println("Interrupted while starting.")
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Failed to initialize service: %v", err)
+	}
+	return svc
+}
+
+// installService installs the updater as a system service if it's not installed yet
+func installService(cfg config.Config) error {
 	var serviceInstaller installer.Installer
-	if params.ServiceName != "" {
+	if cfg.ServiceName != "" {
+		var err error
 		serviceInstaller, err = installer.NewSystemd(installer.SystemdParams{
-			ServiceName: params.ServiceName,
-			User:        params.User,
+			ServiceName: cfg.ServiceName,
+			User:        cfg.User,
+			Rootless:    cfg.Rootless,
+			Runtime:     cfg.Runtime,
 		})
 		if err != nil {
-			log.Fatalf("Failed to create systemd service: %v", err)
+			return fmt.Errorf("failed to create systemd service: %v", err)
 		}
 	} else {
 		serviceInstaller = &installer.Dummy{}
 	}
-	if !serviceInstaller.IsInstalled() {
-		if err := serviceInstaller.Install(); err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("Service was installed. For systemd case, "+
-			"use 'journalctl -u %s -n 10 -f' command to follow log\n", params.ServiceName)
+	if serviceInstaller.IsInstalled() {
+		return nil
+	}
+	if err := serviceInstaller.Install(); err != nil {
+		return err
+	}
+	journalctl := "journalctl"
+	if cfg.Rootless {
+		journalctl += " --user"
+	}
+	fmt.Printf("Service was installed. For systemd case, "+
+		"use '%s -u %s -n 10 -f' command to follow log\n", journalctl, cfg.ServiceName)
+	return nil
+}
+
+// installCommand installs and starts the updater service without running it in the foreground,
+// and returns the exit code
+func installCommand() int {
+	cfg, err := config.New()
+	if err != nil {
+		log.Printf("Failed to initialize configuration: %v", err)
+		return 2
+	}
+	if err := installService(cfg); err != nil {
+		log.Printf("Failed to install service: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// statusCommand prints the state of the validator container as KEY=value lines and returns the exit code
+func statusCommand() int {
+	cfg, err := config.New()
+	if err != nil {
+		log.Printf("Failed to initialize configuration: %v", err)
+		return 2
+	}
+	status, err := service.Status(context.Background(), serviceParams(cfg))
+	if err != nil {
+		log.Printf("Failed to get container status: %v", err)
+		return 1
+	}
+	fmt.Printf("State=%s\nHealth=%s\nImage=%s\n", status.State, status.Health, status.ImageID)
+	return 0
+}
+
+// dryRunCommand prints the actions the update job would take and returns the exit code
+func dryRunCommand(ctx context.Context, cfg config.Config) int {
+	plan, err := service.DryRun(ctx, serviceParams(cfg))
+	if err != nil {
+		log.Printf("Dry run failed: %v", err)
+		return 1
+	}
+	plan.Print(os.Stdout)
+	return 0
+}
+
+// serviceParams returns service parameters from the configuration
+func serviceParams(cfg config.Config) service.Params {
+	updateGracePeriod, _ := time.ParseDuration(cfg.UpdateGracePeriod) // validated by config
+	dockerWaitTimeout, _ := time.ParseDuration(cfg.DockerWaitTimeout)
+	crashLoopWindow, _ := time.ParseDuration(cfg.Crash.LoopWindow)
+	hubStaleAfter, _ := time.ParseDuration(cfg.Hub.StaleAfter)
+	hubSkewAfter, _ := time.ParseDuration(cfg.Hub.SkewAfter)
+	hubSoak, _ := time.ParseDuration(cfg.Hub.Soak)
+	return service.Params{
+		TGBotToken:         cfg.TGBotToken,
+		TGForceChatID:      cfg.TGForceChatID,
+		User:               cfg.User,
+		ContainerName:      cfg.ContainerName,
+		RestartPolicy:      cfg.RestartPolicy,
+		EnvFilePath:        cfg.EnvFilePath,
+		ServiceName:        cfg.ServiceName,
+		Port:               cfg.Port,
+		HostPort:           cfg.HostPort,
+		HostIP:             cfg.HostIP,
+		ExtraPorts:         cfg.Ports,
+		Runtime:            cfg.Runtime,
+		RuntimeHost:        cfg.RuntimeHost,
+		DockerAPIVersion:   cfg.DockerAPIVersion,
+		DockerWaitTimeout:  dockerWaitTimeout,
+		ImageName:          cfg.ImageName,
+		MetricsURI:         fmt.Sprintf("%s:%s", cfg.Host, cfg.HostPort),
+		UpdateSchedule:     cfg.UpdateSchedule,
+		MetricsSchedule:    cfg.MetricsSchedule,
+		SelfUpdateSchedule: cfg.SelfUpdate.Schedule,
+		Platform:           cfg.Platform,
+		KeepPreviousImages: *cfg.KeepPreviousImages,
+		AdoptContainers:    *cfg.AdoptContainers,
+		UpdateGracePeriod:  updateGracePeriod,
+
+		LabelAlertsDuringUpdate: cfg.AlertsDuringUpdate == config.AlertsLabel,
+		Registry: delixir.RegistryParams{
+			Mirror:           cfg.Registry.Mirror,
+			DisableFallback:  cfg.Registry.DisableFallback,
+			Username:         cfg.Registry.Username,
+			Password:         cfg.Registry.Password,
+			DockerConfigPath: cfg.Registry.DockerConfigPath,
+		},
+		Crash: delixir.CrashParams{
+			Policy:     cfg.Crash.Policy,
+			LoopLimit:  cfg.Crash.LoopLimit,
+			LoopWindow: crashLoopWindow,
+		},
+		Healthcheck: healthcheckParams(cfg),
+		SelfUpdate:  selfUpdateParams(cfg),
+		Hooks:       hookParams(cfg),
+		Version:     version,
+
+		HubListen: cfg.Hub.Listen,
+		Hub: hub.ServerParams{
+			Token:      cfg.Hub.Token,
+			StaleAfter: hubStaleAfter,
+			SkewAfter:  hubSkewAfter,
+			Soak:       hubSoak,
+		},
+		Heartbeat:          hub.ClientParams{URL: cfg.Hub.URL, Token: cfg.Hub.Token, Canary: cfg.Hub.Canary},
+		HeartbeatSchedule:  cfg.Hub.HeartbeatSchedule,
+		CoordinateRollouts: cfg.Hub.CoordinateRollouts,
+		Logs: delixir.LogsParams{
+			Lines:        *cfg.Logs.Lines,
+			ExcerptLines: cfg.Logs.ExcerptLines,
+			Attach:       *cfg.Logs.Attach,
+			Patterns:     cfg.Logs.Patterns,
+		},
+	}
+}
+
+// healthcheckParams returns Docker health check parameters of the validator container
+func healthcheckParams(cfg config.Config) delixir.HealthcheckParams {
+	if cfg.Healthcheck.Disable {
+		return delixir.HealthcheckParams{}
 	}
+	// durations are validated by config
+	p := delixir.HealthcheckParams{Retries: cfg.Healthcheck.Retries}
+	p.Interval, _ = time.ParseDuration(cfg.Healthcheck.Interval)
+	p.Timeout, _ = time.ParseDuration(cfg.Healthcheck.Timeout)
+	p.StartPeriod, _ = time.ParseDuration(cfg.Healthcheck.StartPeriod)
+	p.Wait, _ = time.ParseDuration(cfg.Healthcheck.Wait)
+	p.Test = delixir.DefaultHealthcheckTest(cfg.Port)
+	if cfg.Healthcheck.Test != "" {
+		p.Test = []string{"CMD-SHELL", cfg.Healthcheck.Test}
+	}
+	return p
+}
+
+// hookParams returns hooks run at points of the container update
+func hookParams(cfg config.Config) []hooks.Hook {
+	params := make([]hooks.Hook, 0, len(cfg.Hooks))
+	for _, hook := range cfg.Hooks {
+		timeout, _ := time.ParseDuration(hook.Timeout) // validated by config
+		params = append(params, hooks.Hook{Point: hook.Point, Command: hook.Command, URL: hook.URL, Timeout: timeout})
+	}
+	return params
+}
+
+// selfUpdateParams returns parameters of the updater binary self-update
+func selfUpdateParams(cfg config.Config) selfupdate.Params {
+	p := selfupdate.Params{
+		URL:              cfg.SelfUpdate.URL,
+		CurrentVersion:   version,
+		Asset:            cfg.SelfUpdate.Asset,
+		Checksums:        cfg.SelfUpdate.Checksums,
+		ServiceName:      cfg.ServiceName,
+		UserService:      cfg.Rootless,
+		MaxStartAttempts: cfg.SelfUpdate.MaxStartAttempts,
+	}
+	if cfg.SelfUpdate.PublicKey != "" {
+		key, _ := base64.StdEncoding.DecodeString(cfg.SelfUpdate.PublicKey) // validated by config
+		p.PublicKey = ed25519.PublicKey(key)
+	}
+	return p
+}
+
+// deployCommand deploys the updater to the hosts of the inventory and returns the exit code
+func deployCommand(args []string) int {
+	flags := flag.NewFlagSet("deploy", flag.ExitOnError)
+	inventoryPath := flags.String("inventory", "deploy.yml", "path to the inventory file")
+	binary := flags.String("binary", "", "prebuilt updater binary, the current module is built if empty")
+	parallel := flags.Int("parallel", 0, "number of hosts deployed at once, overrides the inventory")
+	_ = flags.Parse(args)
 
-	ctx := context.Background()
-	return service.New(ctx, params)
+	inv, err := deploy.LoadInventory(*inventoryPath)
+	if err != nil {
+		log.Printf("Failed to load inventory: %v", err)
+		return 2
+	}
+	if *parallel > 0 {
+		inv.Parallel = *parallel
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	summary, err := deploy.New(deploy.Params{Inventory: inv, Binary: *binary}).Run(ctx)
+	if err != nil {
+		log.Printf("Deployment failed: %v", err)
+		return 1
+	}
+	summary.Print(os.Stdout)
+	if summary.Failed() {
+		return 1
+	}
+	return 0
 }
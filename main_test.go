@@ -0,0 +1,58 @@
+package main_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfUpdateRollbackOnInvalidConfiguration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the updater binary")
+	}
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "elixir-testnet-updater")
+	build := exec.Command("go", "build", "-o", executable, "-ldflags", "-X main.version=v1.1.0", ".")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("error building the updater: %v: %s", err, out)
+	}
+
+	// v1.1.0 was installed by self-update and rejects the configuration of v1.0.0
+	previous := "#!/bin/sh\necho v1.0.0\n"
+	writeFile(t, executable+".old", previous, 0o755)
+	writeFile(t, executable+".selfupdate.json", `{"previous":"v1.0.0","target":"v1.1.0","max_attempts":2}`, 0o600)
+	writeFile(t, filepath.Join(dir, "config.yml"), "option_of_v1_0_0: true\n", 0o600)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		cmd := exec.Command(executable)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Fatalf("start %d succeeded with invalid configuration: %s", attempt, out)
+		}
+		expected := fmt.Sprintf("attempt %d of 2", attempt)
+		if attempt == 3 {
+			expected = "the previous one is restored"
+		}
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("start %d output doesn't contain %q:\n%s", attempt, expected, out)
+		}
+	}
+
+	if b, err := os.ReadFile(executable); err != nil || string(b) != previous {
+		t.Errorf("previous binary was not restored: %v", err)
+	}
+	if b, err := os.ReadFile(executable + ".selfupdate.json"); err != nil || !strings.Contains(string(b), `"rolled_back":true`) {
+		t.Errorf("rollback is not saved to the state: %s, %v", b, err)
+	}
+}
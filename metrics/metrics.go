@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,41 +9,95 @@ import (
 	"net/http"
 	"reflect"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/mtfelian/elixir-testnet-updater/notifier"
 )
 
+// DefaultTimeout is the default health endpoint request timeout
+const DefaultTimeout = 10 * time.Second
+
+// UpdateState reports whether the validator container is being updated
+type UpdateState interface {
+	UpdateInProgress() bool
+}
+
+// Alerter sends alerts with additional context, like validator container logs
+type Alerter interface {
+	Alert(ctx context.Context, message string)
+}
+
+// ContainerHealth reports Docker health status of the validator container
+type ContainerHealth interface {
+	ContainerHealth(ctx context.Context) (string, error)
+}
+
 // Metrics represents metrics
 type Metrics struct {
-	uri         string
-	notifier    notifier.Notifier
+	uri        string
+	notifier   notifier.Notifier
+	httpClient *http.Client
+	// lastMetrics is guarded by mu
+	mu          sync.Mutex
 	lastMetrics map[string]any
+
+	updateState       UpdateState
+	labelDuringUpdate bool
+	alerter           Alerter
+	containerHealth   ContainerHealth
 }
 
 // Params represents metrics parameters
 type Params struct {
 	URI      string
 	Notifier notifier.Notifier
+	Timeout  time.Duration // defaults to DefaultTimeout
+
+	// UpdateState makes fetch failures during an update suppressed, or labelled if LabelDuringUpdate is set
+	UpdateState       UpdateState
+	LabelDuringUpdate bool
+	// Alerter sends fetch failure alerts, defaults to sending them with Notifier
+	Alerter Alerter
+	// ContainerHealth adds Docker health status to metrics and alerts
+	ContainerHealth ContainerHealth
 }
 
 // New creates new metrics fetcher
 func New(p Params) *Metrics {
+	if p.Timeout <= 0 {
+		p.Timeout = DefaultTimeout
+	}
 	return &Metrics{
-		uri:      p.URI,
-		notifier: p.Notifier,
+		uri:        p.URI,
+		notifier:   p.Notifier,
+		httpClient: &http.Client{Timeout: p.Timeout},
+
+		updateState:       p.UpdateState,
+		labelDuringUpdate: p.LabelDuringUpdate,
+		alerter:           p.Alerter,
+		containerHealth:   p.ContainerHealth,
 	}
 }
 
 // Fetch from the container's endpoint
-func (m *Metrics) Fetch() (map[string]any, error) {
+func (m *Metrics) Fetch(ctx context.Context) (map[string]any, error) {
 	const metricsURI = "/health"
 	endpoint := fmt.Sprintf("%s%s", m.uri, metricsURI)
-	resp, err := http.Get(endpoint)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating metrics request: %v", err)
+	}
+	resp, err := m.httpClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching metrics: %v", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching metrics: unexpected status %q", resp.Status)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading response body: %v", err)
@@ -61,22 +116,86 @@ func (m *Metrics) Equals(oldMetrics, newMetrics map[string]any) bool {
 }
 
 // Update returns new metrics if metrics were changed
-func (m *Metrics) Update() {
-	newMetrics, err := m.Fetch()
+func (m *Metrics) Update(ctx context.Context) {
+	newMetrics, err := m.Fetch(ctx)
+	health := m.dockerHealth(ctx)
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Metrics update was cancelled: %v", err)
+		return
+	}
+	if err != nil && m.updateState != nil && m.updateState.UpdateInProgress() {
+		if !m.labelDuringUpdate {
+			log.Printf("Failed to fetch metrics during update, alert suppressed: %v", err)
+			return
+		}
+		log.Printf("Failed to fetch metrics during update: %v", err)
+		m.notifier.SendBroadcastMessage(fmt.Sprintf("Failed to update metrics (during update): %v", err))
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to fetch metrics: %v", err)
-		m.notifier.SendBroadcastMessage(fmt.Sprintf("Failed to update metrics: %v", err))
+		message := fmt.Sprintf("Failed to update metrics: %v", err)
+		if health != "" {
+			message += fmt.Sprintf(" (Docker health: %s)", health)
+		}
+		if m.alerter != nil {
+			m.alerter.Alert(ctx, message)
+		} else {
+			m.notifier.SendBroadcastMessage(message)
+		}
+		return
 	}
 
-	if m.lastMetrics == nil || !m.Equals(m.lastMetrics, newMetrics) {
+	if health != "" {
+		newMetrics[dockerHealthKey] = health
+	}
+	m.mu.Lock()
+	lastMetrics := m.lastMetrics
+	m.lastMetrics = newMetrics
+	m.mu.Unlock()
+	if lastMetrics == nil || !m.Equals(lastMetrics, newMetrics) {
 		log.Println("Metrics have changed, sending update notification...")
 		m.sendMetrics(newMetrics)
-		m.lastMetrics = newMetrics
+		return
 	}
 
 	log.Println("No changes in metrics.")
 }
 
+// Last returns the last fetched metrics, nil if they were never fetched
+func (m *Metrics) Last() map[string]any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastMetrics == nil {
+		return nil
+	}
+	last := make(map[string]any, len(m.lastMetrics))
+	for key, value := range m.lastMetrics {
+		last[key] = value
+	}
+	return last
+}
+
+// dockerHealthKey is the metrics key of Docker health status of the validator container
+const dockerHealthKey = "docker_health"
+
+// dockerHealth returns Docker health status of the validator container,
+// empty if it's unknown or the container has no health check
+func (m *Metrics) dockerHealth(ctx context.Context) string {
+	if m.containerHealth == nil {
+		return ""
+	}
+	health, err := m.containerHealth.ContainerHealth(ctx)
+	if err != nil {
+		log.Printf("Failed to get Docker health status: %v", err)
+		return ""
+	}
+	if health == "none" {
+		return ""
+	}
+	return health
+}
+
 func (m *Metrics) sendMetrics(metrics map[string]any) {
 	var message string
 	keys := make([]string, 0, len(metrics))
@@ -85,7 +204,7 @@ func (m *Metrics) sendMetrics(metrics map[string]any) {
 	}
 	sort.Strings(keys)
 	for _, key := range keys {
-		message += fmt.Sprintf("%s: %s\n", key, metrics[key])
+		message += fmt.Sprintf("%s: %v\n", key, metrics[key])
 	}
 	m.notifier.SendBroadcastMessage(message)
 }
@@ -4,3 +4,8 @@ package notifier
 type Notifier interface {
 	SendBroadcastMessage(message string)
 }
+
+// FileSender is implemented by notifiers able to send files
+type FileSender interface {
+	SendBroadcastFile(name string, content []byte, caption string)
+}
@@ -142,3 +142,16 @@ func (bot *TGBot) SendBroadcastMessage(message string) {
 		log.Printf("Message sent to chat %d", chatID)
 	}
 }
+
+// SendBroadcastFile sends a document with the caption to all stored chat IDs
+func (bot *TGBot) SendBroadcastFile(name string, content []byte, caption string) {
+	for chatID := range bot.chatIDs {
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: name, Bytes: content})
+		doc.Caption = fmt.Sprintf("[%s] %s", bot.instanceID, caption)
+		if _, err := bot.bot.Send(doc); err != nil {
+			log.Printf("Error sending file to chat %d: %v", chatID, err)
+			continue
+		}
+		log.Printf("File sent to chat %d", chatID)
+	}
+}
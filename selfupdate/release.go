@@ -0,0 +1,153 @@
+package selfupdate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxMetadataSize limits release metadata, checksums and signature downloads
+const maxMetadataSize = 1 << 20
+
+// Release represents a release in GitHub releases API format
+type Release struct {
+	TagName    string  `json:"tag_name"`
+	Draft      bool    `json:"draft"`
+	Prerelease bool    `json:"prerelease"`
+	Assets     []Asset `json:"assets"`
+}
+
+// Asset represents a release file
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// asset returns the release asset by name
+func (r Release) asset(name string) (Asset, error) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return Asset{}, fmt.Errorf("release %s has no asset %q", r.TagName, name)
+}
+
+// get requests the URL and returns the response body, which must be closed
+func (u *Updater) get(ctx context.Context, url string, accept string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// download returns the small asset content
+func (u *Updater) download(ctx context.Context, a Asset) ([]byte, error) {
+	body, err := u.get(ctx, a.URL, "application/octet-stream")
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s: %v", a.Name, err)
+	}
+	defer body.Close()
+	b, err := io.ReadAll(io.LimitReader(body, maxMetadataSize))
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s: %v", a.Name, err)
+	}
+	return b, nil
+}
+
+// latestRelease requests the release source
+func (u *Updater) latestRelease(ctx context.Context) (Release, error) {
+	var rel Release
+	body, err := u.get(ctx, u.url, "application/vnd.github+json")
+	if err != nil {
+		return rel, fmt.Errorf("error requesting the latest release: %v", err)
+	}
+	defer body.Close()
+	if err := json.NewDecoder(io.LimitReader(body, maxMetadataSize)).Decode(&rel); err != nil {
+		return rel, fmt.Errorf("error decoding the latest release: %v", err)
+	}
+	return rel, nil
+}
+
+// verifySignature checks the ed25519 signature of the checksums file, raw or base64 encoded
+func verifySignature(key ed25519.PublicKey, checksums, signature []byte) error {
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+		if err != nil {
+			return fmt.Errorf("invalid signature encoding: %v", err)
+		}
+		signature = decoded
+	}
+	if !ed25519.Verify(key, checksums, signature) {
+		return fmt.Errorf("invalid signature of checksums")
+	}
+	return nil
+}
+
+// findChecksum returns the SHA-256 hex digest of the file from sha256sum output
+func findChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum of %s", name)
+}
+
+// parseVersion parses vMAJOR.MINOR.PATCH[-PRERELEASE][+BUILD]
+func parseVersion(s string) (numbers [3]int, prerelease string, ok bool) {
+	s, _, _ = strings.Cut(strings.TrimPrefix(s, "v"), "+")
+	s, prerelease, _ = strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return numbers, "", false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, "", false
+		}
+		numbers[i] = n
+	}
+	return numbers, prerelease, true
+}
+
+// newerVersion returns whether semantic version a is newer than b. Prerelease identifiers are compared as strings
+func newerVersion(a, b string) bool {
+	an, ap, _ := parseVersion(a)
+	bn, bp, _ := parseVersion(b)
+	for i := range an {
+		if an[i] != bn[i] {
+			return an[i] > bn[i]
+		}
+	}
+	switch {
+	case ap == bp:
+		return false
+	case ap == "":
+		return true
+	case bp == "":
+		return false
+	}
+	return ap > bp
+}
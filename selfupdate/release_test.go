@@ -0,0 +1,23 @@
+package selfupdate
+
+import "testing"
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  string
+		newer bool
+	}{
+		{"v1.2.0", "v1.1.9", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"1.2.0", "v1.2.0", false},
+		{"v1.2.0", "v1.2.0-rc.1", true},
+		{"v1.2.0-rc.1", "v1.2.0", false},
+		{"v1.2.0-rc.2", "v1.2.0-rc.1", true},
+		{"v1.2.0+build.5", "v1.2.0", false},
+		{"v2.0.0", "v10.0.0", false},
+	} {
+		if got := newerVersion(tc.a, tc.b); got != tc.newer {
+			t.Errorf("newerVersion(%q, %q) = %v, expected %v", tc.a, tc.b, got, tc.newer)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Package selfupdate replaces the updater binary with a newer release and restarts it through systemd
+package selfupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/notifier"
+)
+
+// default values
+const (
+	DefaultChecksums        = "checksums.txt"
+	DefaultMaxStartAttempts = 3
+	defaultHTTPTimeout      = 5 * time.Minute
+	versionCheckTimeout     = 10 * time.Second
+)
+
+// DefaultAsset returns the release asset name of the binary for the current platform
+func DefaultAsset() string {
+	return fmt.Sprintf("elixir-testnet-updater-%s-%s", runtime.GOOS, runtime.GOARCH)
+}
+
+// Params represents self-update parameters
+type Params struct {
+	// URL of the latest release in GitHub releases API format,
+	// e.g. https://api.github.com/repos/OWNER/REPO/releases/latest
+	URL string
+	// CurrentVersion is the version of the running binary, development builds are never updated
+	CurrentVersion string
+	// Asset is the binary asset name, defaults to DefaultAsset()
+	Asset string
+	// Checksums is the asset name of SHA-256 sums in sha256sum format, defaults to DefaultChecksums
+	Checksums string
+	// PublicKey makes the ed25519 signature of checksums required, it's expected in "<Checksums>.sig" asset
+	PublicKey ed25519.PublicKey
+	// Executable is the binary to replace, defaults to os.Executable()
+	Executable string
+	// ServiceName is the systemd service restarted after the binary is replaced
+	ServiceName string
+	// UserService makes the service restarted as a systemd user unit, for rootless installations
+	UserService bool
+	// MaxStartAttempts of the new binary before rollback, defaults to DefaultMaxStartAttempts.
+	// It's saved on installation and used by Recover of the new binary
+	MaxStartAttempts int
+	// Restart overrides the systemd service restart
+	Restart func(ctx context.Context) error
+
+	Notifier   notifier.Notifier
+	HTTPClient *http.Client
+}
+
+func (p *Params) setDefaults() {
+	if p.Asset == "" {
+		p.Asset = DefaultAsset()
+	}
+	if p.Checksums == "" {
+		p.Checksums = DefaultChecksums
+	}
+	if p.MaxStartAttempts <= 0 {
+		p.MaxStartAttempts = DefaultMaxStartAttempts
+	}
+}
+
+// executable returns the path of the binary to replace
+func (p *Params) executable() (string, error) {
+	if p.Executable != "" {
+		return p.Executable, nil
+	}
+	return os.Executable()
+}
+
+// Updater checks the release source and updates the running binary
+type Updater struct {
+	url            string
+	currentVersion string
+	asset          string
+	checksums      string
+	publicKey      ed25519.PublicKey
+	executable     string
+	maxAttempts    int
+	restart        func(ctx context.Context) error
+	notifier       notifier.Notifier
+	httpClient     *http.Client
+
+	// mu serializes updates
+	mu sync.Mutex
+}
+
+// New creates new self-updater
+func New(p Params) (*Updater, error) {
+	p.setDefaults()
+	u := &Updater{
+		url:            p.URL,
+		currentVersion: p.CurrentVersion,
+		asset:          p.Asset,
+		checksums:      p.Checksums,
+		publicKey:      p.PublicKey,
+		maxAttempts:    p.MaxStartAttempts,
+		restart:        p.Restart,
+		notifier:       p.Notifier,
+		httpClient:     p.HTTPClient,
+	}
+
+	var err error
+	if u.executable, err = p.executable(); err != nil {
+		return nil, fmt.Errorf("error getting executable path: %v", err)
+	}
+	if u.restart == nil {
+		args := []string{"--no-block", "restart", p.ServiceName}
+		if p.UserService {
+			args = append([]string{"--user"}, args...)
+		}
+		u.restart = func(ctx context.Context) error {
+			// don't wait for the restart job, it stops this process
+			out, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		}
+	}
+	if u.notifier == nil {
+		u.notifier = &notifier.Dummy{}
+	}
+	if u.httpClient == nil {
+		u.httpClient = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	return u, nil
+}
+
+// Confirm the start of the binary installed by self-update, or report a rollback.
+// It should be called when the updater has started successfully
+func (u *Updater) Confirm() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	st, err := loadState(u.executable)
+	if err != nil {
+		return err
+	}
+	switch {
+	case st.RolledBack && st.Previous == u.currentVersion:
+		u.notifier.SendBroadcastMessage(fmt.Sprintf("updater %s failed to start, rolled back to %s",
+			st.Target, st.Previous))
+		return saveState(u.executable, state{Rejected: st.Target})
+	case st.Target == u.currentVersion && !st.RolledBack:
+		if err := os.Remove(backupPath(u.executable)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing the previous binary: %v", err)
+		}
+		u.notifier.SendBroadcastMessage(fmt.Sprintf("updater was updated from %s to %s", st.Previous, st.Target))
+		return saveState(u.executable, state{})
+	}
+	return nil
+}
+
+// Check returns the latest release if it's newer than the running binary and wasn't rolled back, nil otherwise
+func (u *Updater) Check(ctx context.Context) (*Release, error) {
+	if _, _, ok := parseVersion(u.currentVersion); !ok {
+		return nil, fmt.Errorf("current version %q is not a release version", u.currentVersion)
+	}
+	rel, err := u.latestRelease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rel.Draft || rel.Prerelease {
+		return nil, nil
+	}
+	if _, _, ok := parseVersion(rel.TagName); !ok {
+		return nil, fmt.Errorf("latest release has invalid version %q", rel.TagName)
+	}
+	if !newerVersion(rel.TagName, u.currentVersion) {
+		return nil, nil
+	}
+	st, err := loadState(u.executable)
+	if err != nil {
+		return nil, err
+	}
+	if st.Rejected == rel.TagName {
+		log.Printf("Updater %s was rolled back before, skipping it", rel.TagName)
+		return nil, nil
+	}
+	return &rel, nil
+}
+
+// Update checks for a newer release, installs it and restarts the service.
+// Failures are notified and returned
+func (u *Updater) Update(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	rel, err := u.Check(ctx)
+	if err != nil {
+		return fmt.Errorf("error checking for updater release: %v", err)
+	}
+	if rel == nil {
+		log.Printf("Updater %s is up to date", u.currentVersion)
+		return nil
+	}
+
+	log.Printf("Updating updater from %s to %s...", u.currentVersion, rel.TagName)
+	if err := u.install(ctx, *rel); err != nil {
+		u.notifier.SendBroadcastMessage(fmt.Sprintf("failed to update updater to %s: %v", rel.TagName, err))
+		return err
+	}
+	u.notifier.SendBroadcastMessage(fmt.Sprintf("updater %s was installed, restarting", rel.TagName))
+	return nil
+}
+
+// install verifies the release binary, replaces the executable with it and restarts the service
+func (u *Updater) install(ctx context.Context, rel Release) error {
+	checksum, err := u.verifiedChecksum(ctx, rel)
+	if err != nil {
+		return err
+	}
+
+	newPath := u.executable + ".new"
+	defer os.Remove(newPath)
+	if err := u.downloadBinary(ctx, rel, newPath, checksum); err != nil {
+		return err
+	}
+	if err := checkVersion(ctx, newPath, rel.TagName); err != nil {
+		return err
+	}
+
+	backup := backupPath(u.executable)
+	_ = os.Remove(backup)
+	if err := os.Link(u.executable, backup); err != nil {
+		if err := copyFile(u.executable, backup); err != nil {
+			return fmt.Errorf("error keeping the previous binary: %v", err)
+		}
+	}
+	st := state{Previous: u.currentVersion, Target: rel.TagName, MaxAttempts: u.maxAttempts}
+	if err := saveState(u.executable, st); err != nil {
+		return fmt.Errorf("error saving self-update state: %v", err)
+	}
+	if err := os.Rename(newPath, u.executable); err != nil {
+		_ = saveState(u.executable, state{})
+		return fmt.Errorf("error replacing the binary: %v", err)
+	}
+
+	if err := u.restart(ctx); err != nil {
+		rollbackErr := os.Rename(backup, u.executable)
+		_ = saveState(u.executable, state{})
+		if rollbackErr != nil {
+			return fmt.Errorf("error restarting the service: %v; error restoring the previous binary: %v", err, rollbackErr)
+		}
+		return fmt.Errorf("error restarting the service, the previous binary is restored: %v", err)
+	}
+	return nil
+}
+
+// verifiedChecksum returns the expected SHA-256 of the binary asset, checking the signature of checksums
+func (u *Updater) verifiedChecksum(ctx context.Context, rel Release) (string, error) {
+	checksumsAsset, err := rel.asset(u.checksums)
+	if err != nil {
+		return "", err
+	}
+	checksums, err := u.download(ctx, checksumsAsset)
+	if err != nil {
+		return "", err
+	}
+	if u.publicKey != nil {
+		signatureAsset, err := rel.asset(u.checksums + ".sig")
+		if err != nil {
+			return "", err
+		}
+		signature, err := u.download(ctx, signatureAsset)
+		if err != nil {
+			return "", err
+		}
+		if err := verifySignature(u.publicKey, checksums, signature); err != nil {
+			return "", err
+		}
+	}
+	return findChecksum(checksums, u.asset)
+}
+
+// downloadBinary writes the binary asset to path, checking its SHA-256
+func (u *Updater) downloadBinary(ctx context.Context, rel Release, path, checksum string) error {
+	binaryAsset, err := rel.asset(u.asset)
+	if err != nil {
+		return err
+	}
+	body, err := u.get(ctx, binaryAsset.URL, "application/octet-stream")
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", binaryAsset.Name, err)
+	}
+	defer body.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), body); err != nil {
+		file.Close()
+		return fmt.Errorf("error downloading %s: %v", binaryAsset.Name, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		return fmt.Errorf("checksum mismatch of %s: expected %s, got %s", binaryAsset.Name, checksum, actual)
+	}
+	return nil
+}
+
+// checkVersion runs the binary with "version" command to ensure it's runnable and reports the expected version
+func checkVersion(ctx context.Context, path, expected string) error {
+	ctx, cancel := context.WithTimeout(ctx, versionCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "version").Output()
+	if err != nil {
+		return fmt.Errorf("new binary doesn't run: %v", err)
+	}
+	if version := strings.TrimSpace(string(out)); version != expected {
+		return fmt.Errorf("new binary reports version %q instead of %q", version, expected)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package selfupdate_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+	"github.com/mtfelian/elixir-testnet-updater/selfupdate"
+)
+
+const asset = "updater-linux-amd64"
+
+// binary returns a shell script which reports the version like the updater does
+func binary(version string) string {
+	return "#!/bin/sh\necho " + version + "\n"
+}
+
+// releaseServer serves the latest release in GitHub releases API format
+type releaseServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	tag     string
+	assets  map[string][]byte
+	private ed25519.PrivateKey
+}
+
+func newReleaseServer(t *testing.T) (*releaseServer, ed25519.PublicKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &releaseServer{private: private}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.URL.Path == "/releases/latest" {
+			rel := selfupdate.Release{TagName: s.tag}
+			for name := range s.assets {
+				rel.Assets = append(rel.Assets, selfupdate.Asset{Name: name, URL: s.URL + "/download/" + name})
+			}
+			_ = json.NewEncoder(w).Encode(rel)
+			return
+		}
+		content, ok := s.assets[strings.TrimPrefix(r.URL.Path, "/download/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	t.Cleanup(s.Close)
+	return s, public
+}
+
+// publish the release with the binary, its checksum and signature
+func (s *releaseServer) publish(tag, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := sha256.Sum256([]byte(content))
+	checksums := []byte(fmt.Sprintf("%s  other-asset\n%s *%s\n", strings.Repeat("0", 64), hex.EncodeToString(sum[:]), asset))
+	s.tag = tag
+	s.assets = map[string][]byte{
+		asset:               []byte(content),
+		"checksums.txt":     checksums,
+		"checksums.txt.sig": []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(s.private, checksums))),
+	}
+}
+
+type testUpdater struct {
+	params     selfupdate.Params
+	recorder   *harness.Recorder
+	restarts   int
+	restartErr error
+}
+
+func newTestUpdater(t *testing.T, server *releaseServer, key ed25519.PublicKey, version string) *testUpdater {
+	t.Helper()
+	executable := filepath.Join(t.TempDir(), "updater")
+	if err := os.WriteFile(executable, []byte(binary(version)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tu := &testUpdater{recorder: &harness.Recorder{}}
+	tu.params = selfupdate.Params{
+		URL:            server.URL + "/releases/latest",
+		CurrentVersion: version,
+		Asset:          asset,
+		PublicKey:      key,
+		Executable:     executable,
+		Notifier:       tu.recorder,
+		Restart: func(context.Context) error {
+			tu.restarts++
+			return tu.restartErr
+		},
+	}
+	return tu
+}
+
+// start simulates a start of the current binary and returns the updater, nil if it was rolled back
+func (tu *testUpdater) start(t *testing.T) *selfupdate.Updater {
+	t.Helper()
+	out, err := os.ReadFile(tu.params.Executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tu.params.CurrentVersion = strings.TrimPrefix(strings.TrimSpace(string(out)), "#!/bin/sh\necho ")
+	if err := selfupdate.Recover(tu.params); errors.Is(err, selfupdate.ErrRolledBack) {
+		return nil
+	} else if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	u, err := selfupdate.New(tu.params)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return u
+}
+
+func (tu *testUpdater) binary(t *testing.T) string {
+	t.Helper()
+	b, err := os.ReadFile(tu.params.Executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestUpdate(t *testing.T) {
+	server, key := newReleaseServer(t)
+	tu := newTestUpdater(t, server, key, "v1.0.0")
+	u := tu.start(t)
+
+	server.publish("v1.0.0", binary("v1.0.0"))
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if tu.restarts != 0 || tu.binary(t) != binary("v1.0.0") {
+		t.Fatalf("the same version was installed")
+	}
+
+	server.publish("v1.1.0", binary("v1.1.0"))
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if tu.restarts != 1 {
+		t.Fatalf("expected the service to be restarted once, got %d", tu.restarts)
+	}
+	if tu.binary(t) != binary("v1.1.0") {
+		t.Fatalf("binary was not replaced: %q", tu.binary(t))
+	}
+	if !tu.recorder.Contains("updater v1.1.0 was installed, restarting") {
+		t.Errorf("installation was not notified: %v", tu.recorder.Messages())
+	}
+
+	u = tu.start(t)
+	if err := u.Confirm(); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if !tu.recorder.Contains("updater was updated from v1.0.0 to v1.1.0") {
+		t.Errorf("update was not notified: %v", tu.recorder.Messages())
+	}
+	matches, _ := filepath.Glob(tu.params.Executable + ".*")
+	if len(matches) > 0 {
+		t.Errorf("files left after confirmed update: %v", matches)
+	}
+}
+
+func TestUpdateVerification(t *testing.T) {
+	for name, tc := range map[string]struct {
+		tamper func(s *releaseServer)
+		err    string
+	}{
+		"checksum": {
+			tamper: func(s *releaseServer) { s.assets[asset] = []byte(binary("v2.0.0") + "# tampered\n") },
+			err:    "checksum mismatch",
+		},
+		"signature": {
+			tamper: func(s *releaseServer) { s.assets["checksums.txt"] = append(s.assets["checksums.txt"], '\n') },
+			err:    "invalid signature",
+		},
+		"missing signature": {
+			tamper: func(s *releaseServer) { delete(s.assets, "checksums.txt.sig") },
+			err:    `no asset "checksums.txt.sig"`,
+		},
+		"version": {
+			tamper: func(s *releaseServer) { s.tag = "v2.0.1" },
+			err:    `reports version "v2.0.0" instead of "v2.0.1"`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, key := newReleaseServer(t)
+			tu := newTestUpdater(t, server, key, "v1.0.0")
+			u := tu.start(t)
+			server.publish("v2.0.0", binary("v2.0.0"))
+			tc.tamper(server)
+
+			if err := u.Update(context.Background()); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error containing %q, got: %v", tc.err, err)
+			}
+			if tu.restarts != 0 || tu.binary(t) != binary("v1.0.0") {
+				t.Errorf("binary was replaced")
+			}
+			if !tu.recorder.Contains("failed to update updater to") {
+				t.Errorf("failure was not notified: %v", tu.recorder.Messages())
+			}
+			matches, _ := filepath.Glob(tu.params.Executable + ".*")
+			if len(matches) > 0 {
+				t.Errorf("files left after failed update: %v", matches)
+			}
+		})
+	}
+}
+
+func TestUpdateRestartFailure(t *testing.T) {
+	server, key := newReleaseServer(t)
+	tu := newTestUpdater(t, server, key, "v1.0.0")
+	tu.restartErr = errors.New("no systemd")
+	u := tu.start(t)
+	server.publish("v1.1.0", binary("v1.1.0"))
+
+	if err := u.Update(context.Background()); err == nil || !strings.Contains(err.Error(), "previous binary is restored") {
+		t.Fatalf("expected restart error, got: %v", err)
+	}
+	if tu.binary(t) != binary("v1.0.0") {
+		t.Errorf("previous binary was not restored")
+	}
+}
+
+func TestRollback(t *testing.T) {
+	server, key := newReleaseServer(t)
+	tu := newTestUpdater(t, server, key, "v1.0.0")
+	tu.params.MaxStartAttempts = 2
+	u := tu.start(t)
+	server.publish("v1.1.0", binary("v1.1.0"))
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// the new binary fails before confirmation
+	for i := 0; i < 2; i++ {
+		if tu.start(t) == nil {
+			t.Fatalf("rolled back after %d starts", i+1)
+		}
+	}
+	if tu.start(t) != nil {
+		t.Fatalf("expected rollback")
+	}
+	if tu.binary(t) != binary("v1.0.0") {
+		t.Fatalf("previous binary was not restored: %q", tu.binary(t))
+	}
+
+	u = tu.start(t)
+	if err := u.Confirm(); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if !tu.recorder.Contains("updater v1.1.0 failed to start, rolled back to v1.0.0") {
+		t.Errorf("rollback was not notified: %v", tu.recorder.Messages())
+	}
+
+	// the rolled back release is not installed again, the next one is
+	if err := u.Update(context.Background()); err != nil || tu.restarts != 1 {
+		t.Fatalf("rolled back release was installed again: %v", err)
+	}
+	server.publish("v1.1.1", binary("v1.1.1"))
+	if err := u.Update(context.Background()); err != nil || tu.restarts != 2 {
+		t.Fatalf("next release was not installed: %v", err)
+	}
+}
+
+func TestRollbackBeforeConfiguration(t *testing.T) {
+	server, key := newReleaseServer(t)
+	tu := newTestUpdater(t, server, key, "v1.0.0")
+	tu.params.MaxStartAttempts = 2
+	u := tu.start(t)
+	server.publish("v1.1.0", binary("v1.1.0"))
+	if err := u.Update(context.Background()); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// the new binary fails to load the configuration, so only the version and the executable are known
+	params := selfupdate.Params{Executable: tu.params.Executable, CurrentVersion: "v1.1.0"}
+	for i := 0; i < 2; i++ {
+		if err := selfupdate.Recover(params); err != nil {
+			t.Fatalf("Recover after %d starts: %v", i+1, err)
+		}
+	}
+	if err := selfupdate.Recover(params); !errors.Is(err, selfupdate.ErrRolledBack) {
+		t.Fatalf("expected rollback after the configured start attempts, got: %v", err)
+	}
+	if tu.binary(t) != binary("v1.0.0") {
+		t.Fatalf("previous binary was not restored: %q", tu.binary(t))
+	}
+
+	u = tu.start(t)
+	if err := u.Confirm(); err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if !tu.recorder.Contains("updater v1.1.0 failed to start, rolled back to v1.0.0") {
+		t.Errorf("rollback was not notified: %v", tu.recorder.Messages())
+	}
+}
+
+func TestUpdateDevelopmentBuild(t *testing.T) {
+	server, key := newReleaseServer(t)
+	server.publish("v1.1.0", binary("v1.1.0"))
+	tu := newTestUpdater(t, server, key, "dev")
+	u := tu.start(t)
+	if err := u.Update(context.Background()); err == nil || !strings.Contains(err.Error(), "not a release version") {
+		t.Fatalf("expected development build error, got: %v", err)
+	}
+}
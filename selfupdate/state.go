@@ -0,0 +1,126 @@
+package selfupdate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// ErrRolledBack is returned by Recover when the new binary failed to start too many times
+// and the previous one was restored. The process should exit to be restarted with the previous binary
+var ErrRolledBack = errors.New("self-update was rolled back")
+
+// state is persisted between the replacement of the binary and the confirmation of its start
+type state struct {
+	Previous string `json:"previous"`
+	Target   string `json:"target"`
+	// Attempts is the number of starts of the target binary which weren't confirmed
+	Attempts   int  `json:"attempts"`
+	RolledBack bool `json:"rolled_back"`
+	// Rejected is the version which was rolled back, it's not installed again
+	Rejected string `json:"rejected,omitempty"`
+	// MaxAttempts of the target binary start, saved on installation so Recover doesn't need the configuration
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+// backupPath returns the path of the previous binary kept for rollback
+func backupPath(executable string) string { return executable + ".old" }
+
+// statePath returns the path of the self-update state file
+func statePath(executable string) string { return executable + ".selfupdate.json" }
+
+// loadState returns the zero state if the file doesn't exist
+func loadState(executable string) (state, error) {
+	var st state
+	b, err := os.ReadFile(statePath(executable))
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return st, fmt.Errorf("invalid self-update state %s: %v", statePath(executable), err)
+	}
+	return st, nil
+}
+
+// saveState writes the state atomically, the zero state removes the file
+func saveState(executable string, st state) error {
+	path := statePath(executable)
+	if st == (state{}) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Recover counts starts of the freshly installed binary and restores the previous one
+// if the new binary failed to confirm its start more than MaxStartAttempts times given on installation.
+// Only p.Executable and p.CurrentVersion are required, so it should be called on startup before anything
+// which may fail, including configuration loading, see Updater.Confirm
+func Recover(p Params) error {
+	p.setDefaults()
+	executable, err := p.executable()
+	if err != nil {
+		return err
+	}
+	st, err := loadState(executable)
+	if err != nil || st.Target != p.CurrentVersion || st.RolledBack {
+		return err
+	}
+
+	maxAttempts := p.MaxStartAttempts
+	if st.MaxAttempts > 0 {
+		maxAttempts = st.MaxAttempts
+	}
+	st.Attempts++
+	if st.Attempts <= maxAttempts {
+		log.Printf("Starting updater %s after self-update, attempt %d of %d", st.Target, st.Attempts, maxAttempts)
+		return saveState(executable, st)
+	}
+
+	log.Printf("Updater %s failed to start %d times, restoring %s", st.Target, maxAttempts, st.Previous)
+	if err := os.Rename(backupPath(executable), executable); err != nil {
+		return fmt.Errorf("error restoring the previous binary: %v", err)
+	}
+	st.RolledBack = true
+	if err := saveState(executable, st); err != nil {
+		return err
+	}
+	return ErrRolledBack
+}
+
+// copyFile copies the file with its permissions
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
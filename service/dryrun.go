@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mtfelian/elixir-testnet-updater/clock"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/hooks"
+	"github.com/mtfelian/elixir-testnet-updater/hub"
+	"github.com/mtfelian/elixir-testnet-updater/notifier"
+)
+
+// DryRun returns the actions the update job would take with the parameters, without making any changes.
+// Neither notifications nor heartbeats are sent, hooks are not run, and the service is not started
+func DryRun(ctx context.Context, p Params) (delixir.Plan, error) {
+	envVars, envConfig, err := delixir.ParseEnvFile(p.EnvFilePath)
+	if err != nil {
+		return delixir.Plan{}, fmt.Errorf("failed to parse env file: %v", err)
+	}
+
+	var rolloutGate delixir.RolloutGate
+	if p.Heartbeat.URL != "" && p.CoordinateRollouts {
+		p.Heartbeat.InstanceID = envConfig.DisplayName
+		rolloutGate = hub.NewClient(p.Heartbeat) // only reported in the plan, it is not asked
+	}
+	var updateHooks delixir.Hooks
+	if len(p.Hooks) > 0 {
+		updateHooks = hooks.New(p.Hooks) // only described in the plan, they are not run
+	}
+	clk := p.Clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	dc, err := delixir.NewDockerClient(dockerClientParams(p, envVars, &notifier.Dummy{}, clk, rolloutGate, updateHooks))
+	if err != nil {
+		return delixir.Plan{}, fmt.Errorf("failed to create Docker client: %v", err)
+	}
+	return dc.Plan(ctx)
+}
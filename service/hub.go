@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/hub"
+)
+
+// hubCheckSchedule is the schedule of stale instances and version skew detection in hub mode
+const hubCheckSchedule = "* * * * *"
+
+// hubShutdownTimeout limits waiting for in-flight hub requests on stop
+const hubShutdownTimeout = 5 * time.Second
+
+// serveHub starts serving the hub API in background
+func (s *Service) serveHub(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for hub API: %v", err)
+	}
+	s.hubAddr = listener.Addr()
+	s.hubServer = &http.Server{Handler: s.Hub, ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("Serving hub API on %s", s.hubAddr)
+	go func() {
+		if err := s.hubServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Hub API server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopHub stops serving the hub API, if it's served
+func (s *Service) stopHub() {
+	if s.hubServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hubShutdownTimeout)
+	defer cancel()
+	if err := s.hubServer.Shutdown(ctx); err != nil {
+		log.Printf("Failed to stop hub API server: %v", err)
+	}
+}
+
+// HubAddr returns the address the hub API is served on, nil unless the service runs in hub mode
+func (s *Service) HubAddr() net.Addr {
+	return s.hubAddr
+}
+
+// SendHeartbeat reports the validator container state to the hub
+func (s *Service) SendHeartbeat(ctx context.Context) {
+	hb := hub.Heartbeat{
+		UpdaterVersion:   s.version,
+		ContainerName:    s.containerName,
+		ImageName:        s.imageName,
+		Metrics:          s.Metrics.Last(),
+		UpdateInProgress: s.DockerClient.UpdateInProgress(),
+		Time:             s.clock.Now(),
+	}
+	status, err := s.DockerClient.Status(ctx)
+	hb.ImageID, hb.ImageDigest = status.ImageID, status.ImageDigest
+	hb.ContainerState, hb.DockerHealth = status.State, status.Health
+	if err != nil {
+		hb.Error = err.Error()
+	}
+	if err := s.heartbeat.Send(ctx, hb); err != nil {
+		log.Printf("Failed to send heartbeat: %v", err)
+	}
+}
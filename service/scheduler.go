@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/clock"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduler errors
+var (
+	ErrJobNotFound   = errors.New("job not found")
+	ErrJobRunning    = errors.New("job is already running")
+	ErrJobExists     = errors.New("job already exists")
+	ErrSchedulerStop = errors.New("scheduler is stopped")
+)
+
+// Job represents a state of the scheduled job
+type Job struct {
+	Name     string
+	Schedule string
+	NextRun  time.Time // zero if the job is paused or the scheduler is not running
+	LastRun  time.Time // zero if the job never ran
+	Running  bool
+	Paused   bool
+}
+
+// job is a scheduled job
+type job struct {
+	Job
+	schedule cron.Schedule
+	fn       func()
+	wake     chan struct{} // interrupts waiting for the next run to reschedule
+}
+
+// Scheduler runs named jobs on cron schedules, with time provided by the clock.
+// A job never runs concurrently with itself: a run which is due while the previous one is in progress is skipped
+type Scheduler struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	jobs    []*job
+	started bool
+	stopped bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewScheduler creates new scheduler. Real clock is used if c is nil
+func NewScheduler(c clock.Clock) *Scheduler {
+	if c == nil {
+		c = clock.Real{}
+	}
+	return &Scheduler{clock: c, stop: make(chan struct{})}
+}
+
+// Add the job with standard 5-field cron spec. Jobs added after Start are scheduled immediately
+func (s *Scheduler) Add(name, spec string, fn func()) error {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q for job %q: %v", spec, name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return ErrSchedulerStop
+	}
+	if s.find(name) != nil {
+		return fmt.Errorf("%w: %s", ErrJobExists, name)
+	}
+	j := &job{
+		Job:      Job{Name: name, Schedule: spec},
+		schedule: schedule,
+		fn:       fn,
+		wake:     make(chan struct{}, 1),
+	}
+	s.jobs = append(s.jobs, j)
+	if s.started {
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+	return nil
+}
+
+// Start scheduling the jobs
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started || s.stopped {
+		return
+	}
+	s.started = true
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+}
+
+// Jobs returns states of all jobs in order of addition
+func (s *Scheduler) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j.Job)
+	}
+	return jobs
+}
+
+// Trigger runs the job immediately in background, regardless of its pause state
+func (s *Scheduler) Trigger(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return ErrSchedulerStop
+	}
+	j := s.find(name)
+	if j == nil {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, name)
+	}
+	if j.Running {
+		return fmt.Errorf("%w: %s", ErrJobRunning, name)
+	}
+	j.Running = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(j)
+	}()
+	return nil
+}
+
+// Pause scheduled runs of the job
+func (s *Scheduler) Pause(name string) error {
+	return s.setPaused(name, true)
+}
+
+// Resume scheduled runs of the job
+func (s *Scheduler) Resume(name string) error {
+	return s.setPaused(name, false)
+}
+
+func (s *Scheduler) setPaused(name string, paused bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.find(name)
+	if j == nil {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, name)
+	}
+	if j.Paused == paused {
+		return nil
+	}
+	j.Paused = paused
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stop scheduling and wait for running jobs to finish until ctx is done
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for running jobs: %w", ctx.Err())
+	}
+}
+
+// find returns the job by name, s.mu should be held
+func (s *Scheduler) find(name string) *job {
+	for _, j := range s.jobs {
+		if j.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// loop waits for the job's next scheduled time and runs it until the scheduler stops
+func (s *Scheduler) loop(j *job) {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		now := s.clock.Now()
+		next := j.schedule.Next(now)
+		if j.Paused {
+			j.NextRun = time.Time{}
+		} else {
+			j.NextRun = next
+		}
+		paused := j.Paused
+		s.mu.Unlock()
+
+		var timer <-chan time.Time
+		if !paused {
+			timer = s.clock.After(next.Sub(now))
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-j.wake:
+			continue
+		case <-timer:
+		}
+
+		s.mu.Lock()
+		if j.Paused || s.stopped {
+			s.mu.Unlock()
+			continue
+		}
+		if j.Running {
+			s.mu.Unlock()
+			log.Printf("Job %q is still running, skipping the run at %s", j.Name, next.Format(time.RFC1123))
+			continue
+		}
+		j.Running = true
+		s.mu.Unlock()
+		s.run(j)
+	}
+}
+
+// run the job which is already marked as running
+func (s *Scheduler) run(j *job) {
+	s.mu.Lock()
+	j.LastRun = s.clock.Now()
+	s.mu.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %q panicked: %v", j.Name, r)
+		}
+		s.mu.Lock()
+		j.Running = false
+		s.mu.Unlock()
+	}()
+	j.fn()
+}
@@ -0,0 +1,107 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+	"github.com/mtfelian/elixir-testnet-updater/service"
+)
+
+func TestSchedulerRunsJobsOnClock(t *testing.T) {
+	clock := harness.NewClock(harness.Start)
+	s := service.NewScheduler(clock)
+	var runs atomic.Int32
+	if err := s.Add("tick", "*/5 * * * *", func() { runs.Add(1) }); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	s.Start()
+	defer s.Stop(context.Background())
+
+	if !clock.WaitForWaiters(1, time.Second) {
+		t.Fatalf("job was not scheduled")
+	}
+	jobs := s.Jobs()
+	if len(jobs) != 1 || !jobs[0].NextRun.Equal(harness.Start.Add(5*time.Minute)) {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+
+	clock.Advance(5 * time.Minute)
+	harness.WaitFor(t, time.Second, func() bool { return runs.Load() == 1 }, "the first run")
+	harness.WaitFor(t, time.Second, func() bool {
+		return s.Jobs()[0].NextRun.Equal(harness.Start.Add(10 * time.Minute))
+	}, "rescheduling")
+}
+
+func TestSchedulerPauseResumeTrigger(t *testing.T) {
+	clock := harness.NewClock(harness.Start)
+	s := service.NewScheduler(clock)
+	var runs atomic.Int32
+	if err := s.Add("tick", "*/5 * * * *", func() { runs.Add(1) }); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	s.Start()
+	defer s.Stop(context.Background())
+
+	if err := s.Pause("tick"); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	harness.WaitFor(t, time.Second, func() bool { return s.Jobs()[0].NextRun.IsZero() }, "pause")
+	clock.Advance(5 * time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if n := runs.Load(); n != 0 {
+		t.Fatalf("paused job ran %d times", n)
+	}
+
+	if err := s.Trigger("tick"); err != nil {
+		t.Fatalf("Trigger: %v", err)
+	}
+	harness.WaitFor(t, time.Second, func() bool { return runs.Load() == 1 }, "the triggered run")
+
+	if err := s.Resume("tick"); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	harness.WaitFor(t, time.Second, func() bool { return !s.Jobs()[0].NextRun.IsZero() }, "resume")
+	clock.Advance(5 * time.Minute)
+	harness.WaitFor(t, time.Second, func() bool { return runs.Load() == 2 }, "the scheduled run")
+
+	if err := s.Trigger("missing"); !errors.Is(err, service.ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestSchedulerStopWaitsForRunningJobs(t *testing.T) {
+	s := service.NewScheduler(harness.NewClock(harness.Start))
+	release := make(chan struct{})
+	var finished atomic.Bool
+	if err := s.Add("slow", "0 * * * *", func() {
+		<-release
+		finished.Store(true)
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	s.Start()
+	if err := s.Trigger("slow"); err != nil {
+		t.Fatalf("Trigger: %v", err)
+	}
+	if err := s.Trigger("slow"); !errors.Is(err, service.ErrJobRunning) {
+		t.Errorf("expected ErrJobRunning, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Stop to time out while the job runs, got %v", err)
+	}
+
+	close(release)
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if !finished.Load() {
+		t.Errorf("Stop returned before the job finished")
+	}
+}
@@ -2,13 +2,19 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"time"
 
+	"github.com/mtfelian/elixir-testnet-updater/clock"
 	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/hooks"
+	"github.com/mtfelian/elixir-testnet-updater/hub"
 	"github.com/mtfelian/elixir-testnet-updater/metrics"
 	"github.com/mtfelian/elixir-testnet-updater/notifier"
-	"github.com/robfig/cron/v3"
+	"github.com/mtfelian/elixir-testnet-updater/selfupdate"
 )
 
 // Service represents service capabilities
@@ -16,83 +22,320 @@ type Service struct {
 	Notifier     notifier.Notifier
 	DockerClient *delixir.DockerClient
 	Metrics      *metrics.Metrics
+	Scheduler    *Scheduler
+	// SelfUpdater is nil if self-update is disabled
+	SelfUpdater *selfupdate.Updater
+	// Hub is nil unless the service runs in hub mode
+	Hub *hub.Server
+
+	// heartbeat is nil if heartbeats are disabled, hubServer serves Hub
+	heartbeat *hub.Client
+	hubServer *http.Server
+	hubAddr   net.Addr
+	// version, containerName and imageName are reported in heartbeats
+	version       string
+	containerName string
+	imageName     string
+
+	clock clock.Clock
+	// cancel aborts in-flight jobs, see Stop
+	cancel context.CancelFunc
+	// eventsDone is closed when Docker events watching stops
+	eventsDone chan struct{}
 }
 
+// names of the service jobs
+const (
+	JobUpdate     = "update"
+	JobMetrics    = "metrics"
+	JobSelfUpdate = "self-update"
+	JobHeartbeat  = "heartbeat"
+	JobHubCheck   = "hub-check"
+)
+
 // Params represents service parameters
 type Params struct {
 	TGBotToken    string
 	TGForceChatID int64
 
-	User             string
-	ContainerName    string
-	RestartPolicy    string
-	EnvFilePath      string
-	ServiceName      string
-	Port             string
-	DockerAPIVersion string
-	MetricsURI       string
-	ImageName        string
+	User               string
+	ContainerName      string
+	RestartPolicy      string
+	EnvFilePath        string
+	ServiceName        string
+	Port               string
+	HostPort           string
+	HostIP             string
+	ExtraPorts         []string
+	Runtime            string
+	RuntimeHost        string
+	DockerAPIVersion   string
+	DockerWaitTimeout  time.Duration
+	MetricsURI         string
+	ImageName          string
+	UpdateSchedule     string
+	MetricsSchedule    string
+	Registry           delixir.RegistryParams
+	Platform           string
+	KeepPreviousImages int
+	AdoptContainers    bool
+	Crash              delixir.CrashParams
+	Logs               delixir.LogsParams
+	Healthcheck        delixir.HealthcheckParams
+	// SelfUpdate is disabled if its URL is empty
+	SelfUpdate         selfupdate.Params
+	SelfUpdateSchedule string
+	// Hooks are run at points of the container update, see delixir.HookPoints
+	Hooks []hooks.Hook
+	// Version of the updater reported in heartbeats
+	Version string
+
+	// HubListen is the address to serve the hub API on, hub mode is disabled if empty
+	HubListen string
+	Hub       hub.ServerParams
+	// Heartbeat is disabled if its URL is empty, instance ID is the validator display name
+	Heartbeat         hub.ClientParams
+	HeartbeatSchedule string
+	// CoordinateRollouts makes container updates wait for the hub permission, see hub.Server.Allow
+	CoordinateRollouts bool
+
+	// Notifier overrides the notifier built from TG bot parameters
+	Notifier notifier.Notifier
+	// DockerAPI overrides Docker Engine API client, RegistryURL overrides registry API URLs
+	DockerAPI   delixir.DockerAPI
+	RegistryURL func(host string) string
+	// Clock defaults to the real clock
+	Clock clock.Clock
+	// UpdateGracePeriod is the time after a container swap during which health failures are treated
+	// as happened during update, defaults to delixir.DefaultUpdateGracePeriod
+	UpdateGracePeriod time.Duration
+	// LabelAlertsDuringUpdate makes health failures during update labelled instead of suppressed
+	LabelAlertsDuringUpdate bool
+	// MetricsTimeout limits health endpoint requests, defaults to metrics.DefaultTimeout
+	MetricsTimeout time.Duration
 }
 
-// New initializes new service instance
-func New(ctx context.Context, p Params) *Service {
-	service := new(Service)
+// New initializes new service instance, waiting for the Docker daemon until ctx is done. The first update check
+// is started in background. Jobs run with ctx values but aren't cancelled with it: call Stop to shut the service
+// down gracefully
+func New(ctx context.Context, p Params) (*Service, error) {
+	jobsCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	service := &Service{
+		clock:      p.Clock,
+		cancel:     cancel,
+		eventsDone: make(chan struct{}),
+
+		version:       p.Version,
+		containerName: p.ContainerName,
+		imageName:     p.ImageName,
+	}
+	if service.clock == nil {
+		service.clock = clock.Real{}
+	}
+	service.Scheduler = NewScheduler(service.clock)
 
 	envVars, envConfig, err := delixir.ParseEnvFile(p.EnvFilePath)
 	if err != nil {
-		log.Fatalf("Failed to parse env file: %v", err)
+		cancel()
+		return nil, fmt.Errorf("failed to parse env file: %v", err)
 	}
 
-	if p.TGBotToken != "" {
+	switch {
+	case p.Notifier != nil:
+		service.Notifier = p.Notifier
+	case p.TGBotToken != "":
 		if service.Notifier, err = notifier.NewTGBot(notifier.TGBotParams{
 			BotToken:    p.TGBotToken,
 			ForceChatID: p.TGForceChatID,
 			InstanceID:  envConfig.DisplayName,
 		}); err != nil {
-			log.Fatalf("Failed to init TG bot: %v", err)
+			cancel()
+			return nil, fmt.Errorf("failed to init TG bot: %v", err)
 		}
-	} else {
+	default:
 		service.Notifier = &notifier.Dummy{}
 	}
 
+	var rolloutGate delixir.RolloutGate
+	if p.Heartbeat.URL != "" {
+		p.Heartbeat.InstanceID = envConfig.DisplayName
+		service.heartbeat = hub.NewClient(p.Heartbeat)
+		if p.CoordinateRollouts {
+			rolloutGate = service.heartbeat
+		}
+	}
+
+	var updateHooks delixir.Hooks
+	if len(p.Hooks) > 0 {
+		updateHooks = hooks.New(p.Hooks)
+	}
+
+	if service.DockerClient, err = delixir.NewDockerClient(dockerClientParams(p, envVars, service.Notifier,
+		service.clock, rolloutGate, updateHooks)); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create Docker client: %v", err)
+	}
+
 	service.Metrics = metrics.New(metrics.Params{
 		URI:      p.MetricsURI,
 		Notifier: service.Notifier,
+		Timeout:  p.MetricsTimeout,
+
+		UpdateState:       service.DockerClient,
+		Alerter:           service.DockerClient,
+		ContainerHealth:   service.DockerClient,
+		LabelDuringUpdate: p.LabelAlertsDuringUpdate,
 	})
 
-	if service.DockerClient, err = delixir.NewDockerClient(delixir.DockerClientParams{
-		EnvVars:       envVars,
-		Notifier:      service.Notifier,
-		APIVersion:    p.DockerAPIVersion,
-		ContainerName: p.ContainerName,
-		Port:          p.Port,
-		RestartPolicy: p.RestartPolicy,
-		ImageName:     p.ImageName,
-	}); err != nil {
-		log.Fatalf("Failed to create Docker DockerClient: %v", err)
+	if p.SelfUpdate.URL != "" {
+		p.SelfUpdate.Notifier = service.Notifier
+		if service.SelfUpdater, err = selfupdate.New(p.SelfUpdate); err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to create self-updater: %v", err)
+		}
+	}
+
+	if p.HubListen != "" {
+		p.Hub.Notifier, p.Hub.Clock = service.Notifier, service.clock
+		service.Hub = hub.NewServer(p.Hub)
+		if err := service.serveHub(p.HubListen); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	if p.DockerWaitTimeout > 0 {
+		if err := service.DockerClient.WaitForDaemon(ctx, p.DockerWaitTimeout); err != nil {
+			service.stopHub()
+			cancel()
+			return nil, err
+		}
+	}
+
+	if err := service.startPeriodicUpdates(jobsCtx, p); err != nil {
+		service.stopHub()
+		cancel()
+		return nil, err
+	}
+	// check once first, in background to be stopped like scheduled checks
+	if err := service.Scheduler.Trigger(JobUpdate); err != nil {
+		log.Printf("Failed to start the first update check: %v", err)
+	}
+	go func() {
+		defer close(service.eventsDone)
+		service.DockerClient.WatchEvents(jobsCtx)
+	}()
+
+	if service.SelfUpdater != nil {
+		if err := service.SelfUpdater.Confirm(); err != nil {
+			log.Printf("Failed to confirm self-update: %v", err)
+		}
 	}
+	return service, nil
+}
+
+// CheckForUpdates checks for the new validator image and updates the container
+func (s *Service) CheckForUpdates(ctx context.Context) {
+	log.Printf("Checking for updates at %s...", s.clock.Now().Format(time.RFC1123))
+	s.DockerClient.CheckAndUpdateContainer(ctx)
+}
 
-	service.DockerClient.CheckAndUpdateContainer(ctx) // check once first
-	service.startPeriodicUpdates(ctx)
+// UpdateMetrics polls the validator health endpoint and notifies about changes.
+// Docker daemon availability is checked too, to report outages between update checks
+func (s *Service) UpdateMetrics(ctx context.Context) {
+	_ = s.DockerClient.CheckDaemon(ctx)
+	s.Metrics.Update(ctx)
+}
 
-	return service
+// SelfUpdate checks for the new updater release and installs it, restarting the service
+func (s *Service) SelfUpdate(ctx context.Context) {
+	log.Printf("Checking for updater releases at %s...", s.clock.Now().Format(time.RFC1123))
+	if err := s.SelfUpdater.Update(ctx); err != nil {
+		log.Printf("Self-update failed: %v", err)
+	}
 }
 
-func (s *Service) startPeriodicUpdates(ctx context.Context) {
-	c := cron.New()
+// Stop periodic jobs, waiting for running ones to finish until ctx is done.
+// If ctx is done first, running jobs are cancelled and ctx error is returned
+func (s *Service) Stop(ctx context.Context) error {
+	err := s.Scheduler.Stop(ctx)
+	s.cancel()
+	<-s.eventsDone
+	s.stopHub()
+	return err
+}
 
-	if _, err := c.AddFunc("0 * * * *", func() { // every hour at minute 0
-		log.Printf("Checking for updates at %s...", time.Now().Format(time.RFC1123))
-		s.DockerClient.CheckAndUpdateContainer(ctx)
+func (s *Service) startPeriodicUpdates(ctx context.Context, p Params) error {
+	if err := s.Scheduler.Add(JobUpdate, p.UpdateSchedule, func() {
+		s.CheckForUpdates(ctx)
 	}); err != nil {
-		log.Fatalf("Failed to add periodic task: %v", err)
+		return fmt.Errorf("failed to add periodic task: %v", err)
 	}
 
-	if _, err := c.AddFunc("*/5 * * * *", func() {
-		s.Metrics.Update()
+	if err := s.Scheduler.Add(JobMetrics, p.MetricsSchedule, func() {
+		s.UpdateMetrics(ctx)
 	}); err != nil {
-		log.Fatalf("Failed to add metrics changed detection periodic task: %v", err)
+		return fmt.Errorf("failed to add metrics changed detection periodic task: %v", err)
+	}
+
+	if s.SelfUpdater != nil {
+		if err := s.Scheduler.Add(JobSelfUpdate, p.SelfUpdateSchedule, func() {
+			s.SelfUpdate(ctx)
+		}); err != nil {
+			return fmt.Errorf("failed to add self-update periodic task: %v", err)
+		}
+	}
+
+	if s.heartbeat != nil {
+		if err := s.Scheduler.Add(JobHeartbeat, p.HeartbeatSchedule, func() {
+			s.SendHeartbeat(ctx)
+		}); err != nil {
+			return fmt.Errorf("failed to add heartbeat periodic task: %v", err)
+		}
+	}
+	if s.Hub != nil {
+		if err := s.Scheduler.Add(JobHubCheck, hubCheckSchedule, s.Hub.Check); err != nil {
+			return fmt.Errorf("failed to add hub check periodic task: %v", err)
+		}
 	}
 
-	c.Start()
+	s.Scheduler.Start()
+	return nil
+}
+
+// dockerClientParams returns parameters of the validator container Docker client
+func dockerClientParams(p Params, envVars []string, n notifier.Notifier, clk clock.Clock,
+	rolloutGate delixir.RolloutGate, updateHooks delixir.Hooks,
+) delixir.DockerClientParams {
+	return delixir.DockerClientParams{
+		EnvVars:       envVars,
+		EnvFilePath:   p.EnvFilePath,
+		Notifier:      n,
+		Runtime:       p.Runtime,
+		Host:          p.RuntimeHost,
+		APIVersion:    p.DockerAPIVersion,
+		ContainerName: p.ContainerName,
+		Port:          p.Port,
+		HostPort:      p.HostPort,
+		HostIP:        p.HostIP,
+		ExtraPorts:    p.ExtraPorts,
+		RestartPolicy: p.RestartPolicy,
+		ImageName:     p.ImageName,
+		Registry:      p.Registry,
+		Platform:      p.Platform,
+
+		KeepPreviousImages: p.KeepPreviousImages,
+		UpdateGracePeriod:  p.UpdateGracePeriod,
+		Crash:              p.Crash,
+		Logs:               p.Logs,
+		Healthcheck:        p.Healthcheck,
+		Clock:              clk,
+		RolloutGate:        rolloutGate,
+		Hooks:              updateHooks,
+		Adopt:              p.AdoptContainers,
+		Version:            p.Version,
+
+		API:         p.DockerAPI,
+		RegistryURL: p.RegistryURL,
+	}
 }
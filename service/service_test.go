@@ -0,0 +1,467 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/delixir/dockertest"
+	"github.com/mtfelian/elixir-testnet-updater/harness"
+	"github.com/mtfelian/elixir-testnet-updater/hub"
+	"github.com/mtfelian/elixir-testnet-updater/service"
+)
+
+func newTestService(t *testing.T, h *harness.Harness) *service.Service {
+	t.Helper()
+	svc, err := service.New(context.Background(), h.Params())
+	if err != nil {
+		t.Fatalf("service.New: %v", err)
+	}
+	waitFirstCheck(t, svc)
+	t.Cleanup(func() {
+		if err := svc.Stop(context.Background()); err != nil {
+			t.Errorf("svc.Stop: %v", err)
+		}
+	})
+	return svc
+}
+
+// waitFirstCheck waits for the update check started by service.New to finish
+func waitFirstCheck(t *testing.T, svc *service.Service) {
+	t.Helper()
+	harness.WaitFor(t, time.Second, func() bool {
+		for _, job := range svc.Scheduler.Jobs() {
+			if job.Name == service.JobUpdate {
+				return !job.LastRun.IsZero() && !job.Running
+			}
+		}
+		return false
+	}, "the first update check")
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	h := harness.New(t)
+	first := h.Engine.Publish(harness.ImageName)
+
+	newTestService(t, h)
+	cont, ok := h.Engine.Container(harness.ContainerName)
+	if !ok || cont.ImageID != first.ID || cont.State != dockertest.StateRunning {
+		t.Fatalf("validator container was not installed: %+v", cont)
+	}
+
+	// both jobs are waiting for their next run
+	if !h.Clock.WaitForWaiters(2, time.Second) {
+		t.Fatalf("jobs were not scheduled")
+	}
+	h.Notifier.Reset()
+	h.Clock.Advance(5 * time.Minute)
+	harness.WaitFor(t, time.Second, func() bool { return h.Notifier.Contains("status: healthy") },
+		"initial metrics notification")
+
+	h.Health.SetMode(harness.Degraded)
+	h.Clock.Advance(5 * time.Minute)
+	harness.WaitFor(t, time.Second, func() bool { return h.Notifier.Contains("status: degraded") },
+		"degraded metrics notification")
+
+	second := h.Engine.Publish(harness.ImageName)
+	h.Clock.Set(harness.Start.Add(time.Hour))
+	harness.WaitFor(t, time.Second, func() bool {
+		cont, _ := h.Engine.Container(harness.ContainerName)
+		return cont.ImageID == second.ID && cont.State == dockertest.StateRunning
+	}, "validator container update to %s", second.ID)
+	harness.WaitFor(t, time.Second, func() bool { return h.Notifier.Contains("updated image") },
+		"update notification")
+}
+
+func TestServiceHealthFailures(t *testing.T) {
+	for name, mode := range map[string]harness.HealthMode{
+		"server error": harness.ServerError,
+		"malformed":    harness.Malformed,
+		"slow":         harness.Slow,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := harness.New(t)
+			h.Engine.Publish(harness.ImageName)
+			h.Health.SetDelay(3 * time.Second) // exceeds harness metrics timeout
+			svc := newTestService(t, h)
+			h.Clock.Advance(delixir.DefaultUpdateGracePeriod) // after the install grace period
+
+			h.Notifier.Reset()
+			h.Health.SetMode(mode)
+			svc.UpdateMetrics(context.Background())
+			if n := h.Notifier.Count("Failed to update metrics"); n != 1 {
+				t.Errorf("expected 1 failure notification, got: %v", h.Notifier.Messages())
+			}
+		})
+	}
+}
+
+func TestServiceHealthFailureLogs(t *testing.T) {
+	h := harness.New(t)
+	h.Engine.Publish(harness.ImageName)
+	svc := newTestService(t, h)
+	h.Clock.Advance(delixir.DefaultUpdateGracePeriod)
+
+	h.Notifier.Reset()
+	h.Engine.AppendLogs(harness.ContainerName, "proposal 17 signed", "FATAL: lost connection to the chain")
+	h.Health.SetMode(harness.ServerError)
+	svc.UpdateMetrics(context.Background())
+
+	messages := h.Notifier.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0], "Failed to update metrics") ||
+		!strings.Contains(messages[0], "FATAL: lost connection to the chain") {
+		t.Errorf("expected failure notification with known error lines, got: %v", messages)
+	}
+	if files := h.Notifier.Files(); len(files) != 1 {
+		t.Errorf("expected logs attached, got %d files", len(files))
+	}
+}
+
+func TestServiceStopWaitsForUpdate(t *testing.T) {
+	h := harness.New(t)
+	h.Engine.Publish(harness.ImageName)
+	svc, err := service.New(context.Background(), h.Params())
+	if err != nil {
+		t.Fatalf("service.New: %v", err)
+	}
+	waitFirstCheck(t, svc)
+
+	next := h.Engine.Publish(harness.ImageName)
+	release := h.Engine.Block("ImagePull")
+	pulls := h.Engine.CallCount("ImagePull")
+	if err := svc.Scheduler.Trigger(service.JobUpdate); err != nil {
+		t.Fatalf("Trigger: %v", err)
+	}
+	harness.WaitFor(t, time.Second, func() bool { return h.Engine.CallCount("ImagePull") > pulls }, "the pull")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+	if err := svc.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	cont, _ := h.Engine.Container(harness.ContainerName)
+	if cont.ImageID != next.ID || cont.State != dockertest.StateRunning {
+		t.Errorf("update was not completed before stop: %+v", cont)
+	}
+}
+
+func TestServiceStopCancelsUpdateOnTimeout(t *testing.T) {
+	h := harness.New(t)
+	first := h.Engine.Publish(harness.ImageName)
+	svc, err := service.New(context.Background(), h.Params())
+	if err != nil {
+		t.Fatalf("service.New: %v", err)
+	}
+	waitFirstCheck(t, svc)
+
+	h.Engine.Publish(harness.ImageName)
+	defer h.Engine.Block("ImagePull")()
+	pulls := h.Engine.CallCount("ImagePull")
+	if err := svc.Scheduler.Trigger(service.JobUpdate); err != nil {
+		t.Fatalf("Trigger: %v", err)
+	}
+	harness.WaitFor(t, time.Second, func() bool { return h.Engine.CallCount("ImagePull") > pulls }, "the pull")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := svc.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Stop to time out, got %v", err)
+	}
+	// the cancelled pull lets the job finish without touching the container
+	if err := svc.Scheduler.Stop(context.Background()); err != nil {
+		t.Fatalf("waiting for the cancelled job: %v", err)
+	}
+	cont, _ := h.Engine.Container(harness.ContainerName)
+	if cont.ImageID != first.ID || cont.State != dockertest.StateRunning {
+		t.Errorf("container was changed by the cancelled update: %+v", cont)
+	}
+}
+
+func TestServiceStopCancelsFirstCheckOnTimeout(t *testing.T) {
+	h := harness.New(t)
+	h.Engine.Publish(harness.ImageName)
+	defer h.Engine.Block("ImagePull")()
+
+	done := make(chan *service.Service, 1)
+	go func() {
+		svc, err := service.New(context.Background(), h.Params())
+		if err != nil {
+			t.Errorf("service.New: %v", err)
+		}
+		done <- svc
+	}()
+	var svc *service.Service
+	select {
+	case svc = <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("service.New waits for the first update check")
+	}
+	if svc == nil {
+		t.FailNow()
+	}
+	harness.WaitFor(t, time.Second, func() bool { return h.Engine.CallCount("ImagePull") == 1 }, "the first pull")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := svc.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Stop to time out, got %v", err)
+	}
+	if err := svc.Scheduler.Stop(context.Background()); err != nil {
+		t.Fatalf("waiting for the cancelled first check: %v", err)
+	}
+	if _, ok := h.Engine.Container(harness.ContainerName); ok {
+		t.Errorf("container was created by the cancelled first check")
+	}
+}
+
+func TestServiceHealthAlertsDuringUpdate(t *testing.T) {
+	for name, label := range map[string]bool{"suppressed": false, "labelled": true} {
+		t.Run(name, func(t *testing.T) {
+			h := harness.New(t)
+			h.Engine.Publish(harness.ImageName)
+			params := h.Params()
+			params.LabelAlertsDuringUpdate = label
+			svc, err := service.New(context.Background(), params)
+			if err != nil {
+				t.Fatalf("service.New: %v", err)
+			}
+			waitFirstCheck(t, svc)
+			defer svc.Stop(context.Background())
+
+			// the initial install is in its grace period
+			h.Clock.Advance(time.Hour)
+			h.Engine.Publish(harness.ImageName)
+			release := h.Engine.Block("ContainerStart")
+			go svc.CheckForUpdates(context.Background())
+			harness.WaitFor(t, time.Second, svc.DockerClient.UpdateInProgress, "the container swap")
+
+			h.Notifier.Reset()
+			h.Health.SetMode(harness.ServerError)
+			svc.UpdateMetrics(context.Background())
+			labelled := h.Notifier.Count("Failed to update metrics (during update)")
+			if label && labelled != 1 || !label && len(h.Notifier.Messages()) != 0 {
+				t.Errorf("unexpected notifications: %v", h.Notifier.Messages())
+			}
+
+			release()
+			harness.WaitFor(t, time.Second, func() bool { return h.Notifier.Contains("updated image") }, "the update")
+			h.Clock.Advance(delixir.DefaultUpdateGracePeriod)
+			h.Notifier.Reset()
+			svc.UpdateMetrics(context.Background())
+			if n := h.Notifier.Count("Failed to update metrics: "); n != 1 {
+				t.Errorf("expected an unlabelled alert after the grace period: %v", h.Notifier.Messages())
+			}
+		})
+	}
+}
+
+func TestServiceWaitsForDockerDaemon(t *testing.T) {
+	h := harness.New(t)
+	first := h.Engine.Publish(harness.ImageName)
+	h.Engine.FailOn("Ping", errors.New("connection refused"))
+
+	type result struct {
+		svc *service.Service
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		svc, err := service.New(context.Background(), h.Params())
+		done <- result{svc, err}
+	}()
+
+	// backoff grows: 1s, 2s, 4s
+	for _, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if !h.Clock.WaitForWaiters(1, time.Second) {
+			t.Fatalf("daemon wait backoff was not scheduled")
+		}
+		h.Clock.Advance(d)
+	}
+	if !h.Clock.WaitForWaiters(1, time.Second) {
+		t.Fatalf("daemon wait backoff was not scheduled")
+	}
+	if _, ok := h.Engine.Container(harness.ContainerName); ok {
+		t.Fatalf("container was created before the daemon became reachable")
+	}
+
+	h.Engine.FailOn("Ping", nil)
+	h.Clock.Advance(8 * time.Second)
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("service.New: %v", res.err)
+	}
+	t.Cleanup(func() { _ = res.svc.Stop(context.Background()) })
+	waitFirstCheck(t, res.svc)
+
+	if cont, ok := h.Engine.Container(harness.ContainerName); !ok || cont.ImageID != first.ID {
+		t.Errorf("validator container was not installed: %+v", cont)
+	}
+	if n := h.Notifier.Count("Docker daemon is unreachable"); n != 1 {
+		t.Errorf("expected 1 outage notification, got: %v", h.Notifier.Messages())
+	}
+	if !h.Notifier.Contains("Docker daemon is reachable again after 15s") {
+		t.Errorf("expected recovery notification, got: %v", h.Notifier.Messages())
+	}
+}
+
+func TestServiceDockerDaemonWaitTimeout(t *testing.T) {
+	h := harness.New(t)
+	h.Engine.FailOn("Ping", errors.New("connection refused"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := service.New(context.Background(), h.Params())
+		done <- err
+	}()
+	for i := 0; i < 20; i++ {
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "not reachable") {
+				t.Fatalf("expected daemon wait timeout error, got: %v", err)
+			}
+			if calls := h.Engine.CallCount("ContainerList"); calls != 0 {
+				t.Errorf("expected no container API calls, got %d", calls)
+			}
+			return
+		default:
+		}
+		if h.Clock.WaitForWaiters(1, 100*time.Millisecond) {
+			h.Clock.Advance(30 * time.Second)
+		}
+	}
+	t.Fatalf("service.New didn't give up waiting for the daemon")
+}
+
+func TestServiceReportsDockerDaemonOutage(t *testing.T) {
+	h := harness.New(t)
+	h.Engine.Publish(harness.ImageName)
+	svc := newTestService(t, h)
+
+	h.Notifier.Reset()
+	h.Engine.FailOn("Ping", errors.New("connection refused"))
+	svc.UpdateMetrics(context.Background())
+	listCalls := h.Engine.CallCount("ContainerList")
+	svc.CheckForUpdates(context.Background())
+	if n := h.Notifier.Count("Docker daemon is unreachable"); n != 1 {
+		t.Errorf("expected 1 outage notification, got: %v", h.Notifier.Messages())
+	}
+	if calls := h.Engine.CallCount("ContainerList") - listCalls; calls != 0 {
+		t.Errorf("expected update check to be skipped during outage, ContainerList called %d times", calls)
+	}
+
+	h.Engine.FailOn("Ping", nil)
+	h.Clock.Advance(5 * time.Minute)
+	svc.UpdateMetrics(context.Background())
+	if !h.Notifier.Contains("Docker daemon is reachable again after 5m0s") {
+		t.Errorf("expected recovery notification, got: %v", h.Notifier.Messages())
+	}
+}
+
+func TestServiceHub(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	h := harness.New(t)
+	remote := h.Engine.Publish(harness.ImageName)
+	params := h.Params()
+	params.Version = "v1.2.3"
+	params.HubListen = addr
+	params.Hub = hub.ServerParams{Token: "secret"}
+	params.Heartbeat = hub.ClientParams{URL: "http://" + addr, Token: "secret"}
+	params.HeartbeatSchedule = "* * * * *"
+	svc, err := service.New(context.Background(), params)
+	if err != nil {
+		t.Fatalf("service.New: %v", err)
+	}
+	waitFirstCheck(t, svc)
+	defer func() {
+		if err := svc.Stop(context.Background()); err != nil {
+			t.Errorf("svc.Stop: %v", err)
+		}
+		if _, err := http.Get("http://" + addr + hub.FleetPath); err == nil {
+			t.Errorf("hub API is served after stop")
+		}
+	}()
+
+	svc.UpdateMetrics(context.Background())
+	svc.SendHeartbeat(context.Background())
+	fleet := svc.Hub.Fleet()
+	if len(fleet.Instances) != 1 {
+		t.Fatalf("expected 1 instance, got %+v", fleet)
+	}
+	inst := fleet.Instances[0]
+	if inst.InstanceID != harness.DisplayName || inst.ImageDigest != remote.Digest || inst.ImageID != remote.ID ||
+		inst.ContainerState != dockertest.StateRunning || inst.UpdaterVersion != "v1.2.3" ||
+		inst.Metrics["status"] != "healthy" || inst.Error != "" {
+		t.Errorf("unexpected instance state: %+v", inst)
+	}
+	if !h.Notifier.Contains(`fleet: instance "` + harness.DisplayName + `" joined`) {
+		t.Errorf("join was not notified: %v", h.Notifier.Messages())
+	}
+
+	jobs := make(map[string]bool)
+	for _, job := range svc.Scheduler.Jobs() {
+		jobs[job.Name] = true
+	}
+	if !jobs[service.JobHeartbeat] || !jobs[service.JobHubCheck] {
+		t.Errorf("hub jobs are not scheduled: %+v", svc.Scheduler.Jobs())
+	}
+}
+
+func TestServiceCanaryRollout(t *testing.T) {
+	h := harness.New(t)
+	first := h.Engine.Publish(harness.ImageName)
+	hubServer := hub.NewServer(hub.ServerParams{Soak: 30 * time.Minute, Clock: h.Clock})
+	hubHTTP := httptest.NewServer(hubServer)
+	defer hubHTTP.Close()
+	hubServer.Receive(hub.Heartbeat{InstanceID: "canary", Canary: true, ImageDigest: first.Digest, ContainerState: "running"})
+
+	params := h.Params()
+	params.Heartbeat = hub.ClientParams{URL: hubHTTP.URL}
+	params.HeartbeatSchedule = "* * * * *"
+	params.CoordinateRollouts = true
+	svc, err := service.New(context.Background(), params)
+	if err != nil {
+		t.Fatalf("service.New: %v", err)
+	}
+	waitFirstCheck(t, svc)
+	defer func() { _ = svc.Stop(context.Background()) }()
+	if cont, _ := h.Engine.Container(harness.ContainerName); cont.ImageID != first.ID {
+		t.Fatalf("the first installation was held: %+v", cont)
+	}
+
+	second := h.Engine.Publish(harness.ImageName)
+	svc.CheckForUpdates(context.Background())
+	svc.CheckForUpdates(context.Background())
+	if cont, _ := h.Engine.Container(harness.ContainerName); cont.ImageID != first.ID {
+		t.Fatalf("container was updated before the canary")
+	}
+	if n := h.Notifier.Count(`is held: waiting for canary "canary" to update`); n != 1 {
+		t.Errorf("expected one held update notification, got %v", h.Notifier.Messages())
+	}
+
+	hubServer.Receive(hub.Heartbeat{InstanceID: "canary", Canary: true, ImageDigest: second.Digest, ContainerState: "running"})
+	h.Clock.Advance(30 * time.Minute)
+	svc.CheckForUpdates(context.Background())
+	if cont, _ := h.Engine.Container(harness.ContainerName); cont.ImageID != second.ID {
+		t.Fatalf("container was not updated after the canary soak: %+v", cont)
+	}
+
+	svc.SendHeartbeat(context.Background())
+	hubServer.Check()
+	if fleet := hubServer.Fleet(); len(fleet.Instances) != 2 || len(fleet.Rollouts) != 0 {
+		t.Errorf("rollout was not completed: %+v", fleet)
+	}
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mtfelian/elixir-testnet-updater/clock"
+	"github.com/mtfelian/elixir-testnet-updater/delixir"
+	"github.com/mtfelian/elixir-testnet-updater/notifier"
+)
+
+// Status returns the current state of the validator container managed with the parameters,
+// without starting the service
+func Status(ctx context.Context, p Params) (delixir.ContainerStatus, error) {
+	envVars, _, err := delixir.ParseEnvFile(p.EnvFilePath)
+	if err != nil {
+		return delixir.ContainerStatus{}, fmt.Errorf("failed to parse env file: %v", err)
+	}
+	clk := p.Clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
+	dc, err := delixir.NewDockerClient(dockerClientParams(p, envVars, &notifier.Dummy{}, clk, nil, nil))
+	if err != nil {
+		return delixir.ContainerStatus{}, fmt.Errorf("failed to create Docker client: %v", err)
+	}
+	return dc.Status(ctx)
+}